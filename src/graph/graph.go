@@ -0,0 +1,335 @@
+package graph
+
+//
+// Undirected social graphs to run Whanau on, loaded from edge lists
+// (as SNAP and KONECT publish them) or GraphML, with a Sybil region
+// joined to the rest by a chosen number of attack edges.
+//
+// Nodes are numbered 0..Len()-1 in the order the file first mentions
+// them. Self-loops and repeated edges are dropped, and every edge
+// goes both ways.
+//
+
+import "bufio"
+import "compress/gzip"
+import "encoding/xml"
+import "fmt"
+import "io"
+import "math/rand"
+import "os"
+import "sort"
+import "strings"
+
+type Graph struct {
+	ids   []string       // the file's id for each node
+	index map[string]int // and back
+	adj   []map[int]bool
+	edges int
+}
+
+func New() *Graph {
+	g := &Graph{}
+	g.index = make(map[string]int)
+	return g
+}
+
+// The node with the file's id, added if it is new.
+func (g *Graph) node(id string) int {
+	if i, ok := g.index[id]; ok {
+		return i
+	}
+	i := len(g.ids)
+	g.ids = append(g.ids, id)
+	g.index[id] = i
+	g.adj = append(g.adj, make(map[int]bool))
+	return i
+}
+
+// Add the node with id, if it is not in g already.
+func (g *Graph) AddNode(id string) int {
+	return g.node(id)
+}
+
+// Join the nodes with ids u and v, adding them if need be.
+func (g *Graph) AddEdge(u string, v string) {
+	g.link(g.node(u), g.node(v))
+}
+
+func (g *Graph) link(i int, j int) {
+	if i == j || g.adj[i][j] {
+		return
+	}
+	g.adj[i][j] = true
+	g.adj[j][i] = true
+	g.edges++
+}
+
+func (g *Graph) unlink(i int, j int) {
+	if !g.adj[i][j] {
+		return
+	}
+	delete(g.adj[i], j)
+	delete(g.adj[j], i)
+	g.edges--
+}
+
+// The number of nodes.
+func (g *Graph) Len() int {
+	return len(g.ids)
+}
+
+// The number of edges.
+func (g *Graph) Edges() int {
+	return g.edges
+}
+
+// The file's id for node i.
+func (g *Graph) ID(i int) string {
+	return g.ids[i]
+}
+
+// The node with the file's id.
+func (g *Graph) Index(id string) (int, bool) {
+	i, ok := g.index[id]
+	return i, ok
+}
+
+// Node i's neighbors, in order.
+func (g *Graph) Neighbors(i int) []int {
+	neighbors := make([]int, 0, len(g.adj[i]))
+	for j := range g.adj[i] {
+		neighbors = append(neighbors, j)
+	}
+	sort.Ints(neighbors)
+	return neighbors
+}
+
+// Every node's neighbors, as sim.New takes them.
+func (g *Graph) Adjacency() [][]int {
+	adj := make([][]int, g.Len())
+	for i := range adj {
+		adj[i] = g.Neighbors(i)
+	}
+	return adj
+}
+
+// Every node's neighbors as server addresses, where addrs[i] is node
+// i's, as StartServer takes them.
+func (g *Graph) ServerNeighbors(addrs []string) [][]string {
+	neighbors := make([][]string, g.Len())
+	for i := range neighbors {
+		neighbors[i] = make([]string, 0, len(g.adj[i]))
+		for _, j := range g.Neighbors(i) {
+			neighbors[i] = append(neighbors[i], addrs[j])
+		}
+	}
+	return neighbors
+}
+
+// Read an edge list: a line per edge, the two node ids first and
+// anything after them ignored. Lines that start with # or % are
+// comments, which covers SNAP and KONECT files.
+func ReadEdgeList(r io.Reader) (*Graph, error) {
+	g := New()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' || text[0] == '%' {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want two node ids, got %q",
+				line, text)
+		}
+		g.AddEdge(fields[0], fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+type graphML struct {
+	Graph struct {
+		Nodes []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"node"`
+		Edges []struct {
+			Source string `xml:"source,attr"`
+			Target string `xml:"target,attr"`
+		} `xml:"edge"`
+	} `xml:"graph"`
+}
+
+// Read the first graph of a GraphML file. Edges are taken as
+// undirected whatever the file says.
+func ReadGraphML(r io.Reader) (*Graph, error) {
+	var doc graphML
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	g := New()
+	for _, n := range doc.Graph.Nodes {
+		g.AddNode(n.ID)
+	}
+	for _, e := range doc.Graph.Edges {
+		if e.Source == "" || e.Target == "" {
+			return nil, fmt.Errorf("edge without source or target")
+		}
+		g.AddEdge(e.Source, e.Target)
+	}
+	return g, nil
+}
+
+// Load the graph in path: GraphML if it ends in .graphml or .xml,
+// an edge list otherwise. Either may be gzipped, ending in .gz.
+func Load(path string) (*Graph, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	name := path
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+		name = strings.TrimSuffix(name, ".gz")
+	}
+
+	if strings.HasSuffix(name, ".graphml") || strings.HasSuffix(name, ".xml") {
+		return ReadGraphML(r)
+	}
+	return ReadEdgeList(r)
+}
+
+// A copy of g with size of its nodes made Sybils: a connected region
+// of the graph, grown breadth-first from a random node. The region
+// keeps its own edges, but is cut off from the honest nodes except
+// for attackEdges random edges between them. g itself is left as it
+// is. Returns the copy and which nodes are Sybils, or an error if no
+// connected part of the graph has size nodes.
+func (g *Graph) SybilRegion(size int, attackEdges int,
+	rng *rand.Rand) (*Graph, []bool, error) {
+	n := g.Len()
+	if size < 0 || size > n {
+		return nil, nil, fmt.Errorf("%d Sybils in a graph of %d nodes", size, n)
+	}
+	if attackEdges < 0 || attackEdges > size*(n-size) {
+		return nil, nil, fmt.Errorf("%d attack edges between %d Sybils and %d "+
+			"honest nodes", attackEdges, size, n-size)
+	}
+
+	sybil := make([]bool, n)
+	if size > 0 {
+		// a node whose part of the graph turned out too small is
+		// no use, and nor are the others in that part.
+		small := make([]bool, n)
+		grown := false
+		for _, start := range rng.Perm(n) {
+			if small[start] {
+				continue
+			}
+			region := g.grow(start, size)
+			if len(region) == size {
+				for _, i := range region {
+					sybil[i] = true
+				}
+				grown = true
+				break
+			}
+			for _, i := range region {
+				small[i] = true
+			}
+		}
+		if !grown {
+			return nil, nil, fmt.Errorf("no connected part of the graph "+
+				"has %d nodes", size)
+		}
+	}
+
+	c := g.copy()
+	sybils := make([]int, 0, size)
+	honest := make([]int, 0, n-size)
+	for i := 0; i < n; i++ {
+		if sybil[i] {
+			sybils = append(sybils, i)
+			for _, j := range c.Neighbors(i) {
+				if !sybil[j] {
+					c.unlink(i, j)
+				}
+			}
+		} else {
+			honest = append(honest, i)
+		}
+	}
+
+	for added := 0; added < attackEdges; {
+		i := sybils[rng.Intn(len(sybils))]
+		j := honest[rng.Intn(len(honest))]
+		if !c.adj[i][j] {
+			c.link(i, j)
+			added++
+		}
+	}
+	return c, sybil, nil
+}
+
+func (g *Graph) copy() *Graph {
+	c := New()
+	c.ids = append([]string(nil), g.ids...)
+	for id, i := range g.index {
+		c.index[id] = i
+	}
+	c.adj = make([]map[int]bool, len(g.adj))
+	for i, neighbors := range g.adj {
+		c.adj[i] = make(map[int]bool, len(neighbors))
+		for j := range neighbors {
+			c.adj[i][j] = true
+		}
+	}
+	c.edges = g.edges
+	return c
+}
+
+// Up to size nodes connected to start, breadth-first; fewer if
+// start's part of the graph is smaller.
+func (g *Graph) grow(start int, size int) []int {
+	seen := map[int]bool{start: true}
+	region := []int{start}
+	for next := 0; next < len(region) && len(region) < size; next++ {
+		for _, j := range g.Neighbors(region[next]) {
+			if !seen[j] && len(region) < size {
+				seen[j] = true
+				region = append(region, j)
+			}
+		}
+	}
+	return region
+}
+
+// The number of edges between Sybils and honest nodes.
+func (g *Graph) AttackEdges(sybil []bool) int {
+	count := 0
+	for i := 0; i < g.Len(); i++ {
+		if !sybil[i] {
+			continue
+		}
+		for j := range g.adj[i] {
+			if !sybil[j] {
+				count++
+			}
+		}
+	}
+	return count
+}
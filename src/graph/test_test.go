@@ -0,0 +1,246 @@
+package graph
+
+import "testing"
+import "fmt"
+import "compress/gzip"
+import "math/rand"
+import "os"
+import "path/filepath"
+import "strings"
+
+func checkEdges(t *testing.T, g *Graph, nodes int, edges int) {
+	if g.Len() != nodes || g.Edges() != edges {
+		t.Fatalf("got %d nodes and %d edges, expected %d and %d", g.Len(),
+			g.Edges(), nodes, edges)
+	}
+	for i := 0; i < g.Len(); i++ {
+		for _, j := range g.Neighbors(i) {
+			found := false
+			for _, k := range g.Neighbors(j) {
+				found = found || k == i
+			}
+			if !found {
+				t.Fatalf("edge %s-%s only goes one way", g.ID(i), g.ID(j))
+			}
+		}
+	}
+}
+
+func TestEdgeList(t *testing.T) {
+	fmt.Printf("Test: Edge lists ...\n")
+
+	// SNAP style, with a repeat, a reversed repeat and a self-loop.
+	snap := "# Directed graph: test.txt\n# Nodes: 4 Edges: 6\n" +
+		"# FromNodeId\tToNodeId\n" +
+		"10\t20\n20\t30\n30\t10\n10\t20\n20\t10\n40\t40\n"
+	g, err := ReadEdgeList(strings.NewReader(snap))
+	if err != nil {
+		t.Fatalf("ReadEdgeList: %v", err)
+	}
+	checkEdges(t, g, 4, 3)
+	if i, ok := g.Index("20"); !ok || g.ID(i) != "20" || i != 1 {
+		t.Fatalf("Index(20) = %d, %v", i, ok)
+	}
+	if len(g.Neighbors(3)) != 0 {
+		t.Fatalf("self-loop kept: %v", g.Neighbors(3))
+	}
+
+	// KONECT style, with weights.
+	g, err = ReadEdgeList(strings.NewReader("% sym unweighted\na b 1\nb c 2\n"))
+	if err != nil {
+		t.Fatalf("ReadEdgeList: %v", err)
+	}
+	checkEdges(t, g, 3, 2)
+
+	if _, err := ReadEdgeList(strings.NewReader("1 2\n3\n")); err == nil {
+		t.Fatalf("no error for a line with one id")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestGraphML(t *testing.T) {
+	fmt.Printf("Test: GraphML ...\n")
+
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="w" for="edge" attr.name="weight" attr.type="double"/>
+  <graph id="G" edgedefault="directed">
+    <node id="n0"/>
+    <node id="n1"/>
+    <node id="n2"/>
+    <node id="lonely"/>
+    <edge source="n0" target="n1"><data key="w">1.0</data></edge>
+    <edge source="n1" target="n0"/>
+    <edge source="n1" target="n2"/>
+  </graph>
+</graphml>`
+	g, err := ReadGraphML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("ReadGraphML: %v", err)
+	}
+	checkEdges(t, g, 4, 2)
+	if g.ID(3) != "lonely" || len(g.Neighbors(3)) != 0 {
+		t.Fatalf("node without edges lost")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLoad(t *testing.T) {
+	fmt.Printf("Test: Loading files ...\n")
+
+	dir, err := os.MkdirTemp("", "graph")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := filepath.Join(dir, "g.txt")
+	os.WriteFile(plain, []byte("1 2\n2 3\n"), 0666)
+	zipped := filepath.Join(dir, "g.txt.gz")
+	f, _ := os.Create(zipped)
+	zw := gzip.NewWriter(f)
+	zw.Write([]byte("# comment\n1 2\n2 3\n3 4\n"))
+	zw.Close()
+	f.Close()
+	ml := filepath.Join(dir, "g.graphml")
+	os.WriteFile(ml, []byte(`<graphml><graph><edge source="a" target="b"/>`+
+		`</graph></graphml>`), 0666)
+
+	for _, c := range []struct {
+		path  string
+		nodes int
+		edges int
+	}{{plain, 3, 2}, {zipped, 4, 3}, {ml, 2, 1}} {
+		g, err := Load(c.path)
+		if err != nil {
+			t.Fatalf("Load(%s): %v", c.path, err)
+		}
+		checkEdges(t, g, c.nodes, c.edges)
+	}
+
+	if _, err := Load(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Fatalf("no error for a missing file")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A ring of n nodes, each also joined to the nodes 2 and 3 on.
+func ring(n int) *Graph {
+	g := New()
+	for i := 0; i < n; i++ {
+		for _, d := range []int{1, 2, 3} {
+			g.AddEdge(fmt.Sprint(i), fmt.Sprint((i+d)%n))
+		}
+	}
+	return g
+}
+
+// How many Sybils the first one reaches over the Sybils' own edges.
+func connected(g *Graph, sybil []bool) int {
+	seen := make(map[int]bool)
+	var visit func(i int)
+	visit = func(i int) {
+		seen[i] = true
+		for _, j := range g.Neighbors(i) {
+			if sybil[j] && !seen[j] {
+				visit(j)
+			}
+		}
+	}
+	for i := range sybil {
+		if sybil[i] {
+			visit(i)
+			break
+		}
+	}
+	return len(seen)
+}
+
+func TestSybilRegion(t *testing.T) {
+	fmt.Printf("Test: Sybil regions ...\n")
+
+	orig := ring(100)
+	g, sybil, err := orig.SybilRegion(20, 5, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("SybilRegion: %v", err)
+	}
+	nsybils := 0
+	for _, s := range sybil {
+		if s {
+			nsybils++
+		}
+	}
+	if nsybils != 20 {
+		t.Fatalf("%d Sybils, expected 20", nsybils)
+	}
+	if n := g.AttackEdges(sybil); n != 5 {
+		t.Fatalf("%d attack edges, expected 5", n)
+	}
+	checkEdges(t, g, 100, g.Edges())
+
+	// the region is connected by its own edges.
+	if n := connected(g, sybil); n != 20 {
+		t.Fatalf("Sybil region falls apart: %d of 20 connected", n)
+	}
+
+	// the graph it was made from is left alone, so a second region
+	// comes out the same as the first.
+	checkEdges(t, orig, 100, 300)
+	g2, sybil2, _ := orig.SybilRegion(20, 5, rand.New(rand.NewSource(1)))
+	for i := range sybil {
+		if sybil[i] != sybil2[i] {
+			t.Fatalf("same seed, different Sybils")
+		}
+	}
+	if g2.Edges() != g.Edges() || g2.AttackEdges(sybil2) != 5 {
+		t.Fatalf("second region has %d edges, %d attack edges; first "+
+			"%d, 5", g2.Edges(), g2.AttackEdges(sybil2), g.Edges())
+	}
+
+	if _, _, err := ring(10).SybilRegion(11, 0, rand.New(rand.NewSource(1))); err == nil {
+		t.Fatalf("no error for more Sybils than nodes")
+	}
+	if _, _, err := ring(10).SybilRegion(5, 26, rand.New(rand.NewSource(1))); err == nil {
+		t.Fatalf("no error for more attack edges than pairs")
+	}
+
+	// in a graph of two parts, the region stays in one of them, and
+	// there is none bigger than the bigger part.
+	g = ring(30)
+	for i := 0; i < 10; i++ {
+		g.AddEdge(fmt.Sprint("other-", i), fmt.Sprint("other-", (i+1)%10))
+	}
+	for seed := int64(0); seed < 20; seed++ {
+		c, sybil, err := g.SybilRegion(15, 0, rand.New(rand.NewSource(seed)))
+		if err != nil {
+			t.Fatalf("SybilRegion in two parts: %v", err)
+		}
+		if n := connected(c, sybil); n != 15 {
+			t.Fatalf("Sybil region falls apart: %d of 15 connected", n)
+		}
+		if _, _, err := g.SybilRegion(31, 0, rand.New(rand.NewSource(seed))); err == nil {
+			t.Fatalf("no error for a region bigger than any part")
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestServerNeighbors(t *testing.T) {
+	fmt.Printf("Test: Server neighbors ...\n")
+
+	g, _ := ReadEdgeList(strings.NewReader("x y\ny z\n"))
+	addrs := []string{"addr-x", "addr-y", "addr-z"}
+	neighbors := g.ServerNeighbors(addrs)
+	if fmt.Sprint(neighbors) != "[[addr-y] [addr-x addr-z] [addr-y]]" {
+		t.Fatalf("ServerNeighbors = %v", neighbors)
+	}
+	if fmt.Sprint(g.Adjacency()) != "[[1] [0 2] [1]]" {
+		t.Fatalf("Adjacency = %v", g.Adjacency())
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
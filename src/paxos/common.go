@@ -8,9 +8,27 @@ const (
 
 type Err string
 
+// A proposal number. Higher rounds win, and the proposer's address
+// breaks ties, so no two proposers ever use the same ballot.
+type Ballot struct {
+	Round int64 // >= 1 for a real proposal
+	Peer  string
+}
+
+// h_accept of an instance that has not accepted anything. every real
+// ballot is higher.
+var noProposal = Ballot{}
+
+func (b Ballot) Less(o Ballot) bool {
+	if b.Round != o.Round {
+		return b.Round < o.Round
+	}
+	return b.Peer < o.Peer
+}
+
 type Instance struct {
-	h_prepare int64       // highest prepare seen
-	h_accept  int64       // highest number accepted
+	h_prepare Ballot      // highest prepare seen
+	h_accept  Ballot      // highest ballot accepted
 	h_value   interface{} // value for highest accepted
 
 	decided   bool        // is this instance decided?
@@ -19,32 +37,42 @@ type Instance struct {
 
 type PrepareArgs struct {
 	Seq         int
-	ProposalNum int64
+	ProposalNum Ballot
 	Done        int
+	Proposer    int // index of the proposer in peers[]
+	Config      int // first instance of the peers the proposer uses for Seq
 }
 
 type PrepareReply struct {
 	OK                  bool
-	HighestProposalSeen int64
+	HighestProposalSeen Ballot // the highest accepted
 	HighestValueSeen    interface{}
+	Promised            Ballot // the highest promised, which beat us if !OK
 	Done                int
+	Compacted           int  // instances <= Compacted are forgotten
+	Decided             bool // HighestValueSeen is the decided value
+	Leader              int  // if refused for a lease, its holder; else -1
 }
 
 type AcceptArgs struct {
 	Seq           int
-	ProposalNum   int64
+	ProposalNum   Ballot
 	ValueToAccept interface{}
 	Done          int
+	Proposer      int
+	Config        int
 }
 
 type AcceptReply struct {
-	OK   bool // if false, "reject"
-	Done int
+	OK        bool // if false, "reject"
+	Done      int
+	Compacted int
+	Promised  Ballot // the highest promised for Seq, which beat us if !OK
 }
 
 type DecidedArgs struct {
 	Seq          int
-	ProposalNum  int64
+	ProposalNum  Ballot
 	DecidedValue interface{}
 	Done         int
 }
@@ -53,3 +81,61 @@ type DecidedReply struct {
 	OK   bool
 	Done int
 }
+
+// Multi-Paxos: a would-be leader asks for a promise covering every
+// instance >= From at once.
+type PrepareLeaderArgs struct {
+	From   int
+	Ballot Ballot
+	Leader int // index of the candidate in peers[]
+	Done   int
+	Config int // first instance of the candidate's current peers
+}
+
+type PrepareLeaderReply struct {
+	OK        bool
+	Promised  Ballot             // if !OK, the ballot that beat us
+	Accepted  []AcceptedInstance // what we accepted at instances >= From
+	Done      int
+	Compacted int
+}
+
+type AcceptedInstance struct {
+	Seq      int
+	HAccept  Ballot
+	HValue   interface{}
+	Decided  bool
+	VDecided interface{}
+}
+
+type HeartbeatArgs struct {
+	Ballot Ballot
+	Leader int
+	Done   int
+	Config int
+}
+
+type HeartbeatReply struct {
+	OK       bool
+	Promised Ballot
+	Done     int
+	Max      int // highest instance this peer has seen
+}
+
+// a non-leader hands its proposal to the leader.
+type ForwardArgs struct {
+	Seq    int
+	Value  interface{}
+	Config int
+}
+
+type ForwardReply struct {
+	OK bool
+}
+
+// a follower checks that it can still reach the leader.
+type PingArgs struct {
+}
+
+type PingReply struct {
+}
@@ -0,0 +1,145 @@
+package paxos
+
+//
+// Changing the set of peers.
+//
+// The application agrees on a new set of peers through the log
+// itself: once instance s, holding "from now on the peers are P", is
+// decided, every peer calls Reconfigure(s+1, P). Instances >= s+1
+// are then agreed among P, while earlier ones keep the peers they
+// had, so a peer that is behind still learns them from the old
+// majority. A peer that is not in P stays an acceptor for the old
+// instances, but no longer campaigns or answers for the new ones.
+//
+// A peer that joins starts with Make(P, ...), calls Reconfigure(s+1,
+// P) too, and must not take part in instances before s+1; it gets
+// their effect from the application (a snapshot, say) and
+// Compact()s them away.
+//
+// Every message says which change of peers its sender goes by, as
+// the first instance of those peers, and an acceptor refuses a
+// proposer that has missed a change it knows of. An application
+// should therefore only propose instance seq once it has learned
+// every instance before seq, so that it can't miss one. Old peers
+// that are behind still accept for one another, though, so the
+// application should also wait until a majority of the old peers
+// has called Reconfigure before it lets the new peers get going.
+//
+// Peer indices, as used for leaders and leases, are indices into
+// the current peers; a leader counts only with peers that know the
+// same change as it does. A change of peers ends any leadership, and
+// with it the lease, so a leader can't serve reads past a change it
+// hasn't applied.
+//
+
+import "fmt"
+import "time"
+
+type config struct {
+	from  int // first instance these peers agree on
+	peers []string
+}
+
+//
+// instances >= from are agreed among peers from now on. every peer
+// of the old and the new set should call it with the same arguments,
+// and nothing >= from may have been started before.
+//
+func (px *Paxos) Reconfigure(from int, peers []string) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if !px.reconfigure(from, peers) {
+		return
+	}
+	if err := px.logConfig(from, peers); err != nil {
+		fmt.Printf("Paxos(%v) log Reconfigure: %v\n", px.me, err)
+	}
+}
+
+//
+// the peers agreeing on instance seq.
+//
+func (px *Paxos) Peers(seq int) []string {
+	return px.configAt(seq).peers
+}
+
+func (px *Paxos) configAt(seq int) config {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.configFor(seq)
+}
+
+// called with mu held.
+func (px *Paxos) configFor(seq int) config {
+	for i := len(px.configs) - 1; i > 0; i-- {
+		if seq >= px.configs[i].from {
+			return px.configs[i]
+		}
+	}
+	return px.configs[0]
+}
+
+// true if we must not take part in a round for seq run among the
+// peers that took over at cfg: the proposer has missed a change we
+// know of, or those peers don't include us. a proposer that knows a
+// change we have missed is fine; we are one of its peers, or it
+// wouldn't ask. called with mu held.
+func (px *Paxos) wrongConfig(seq int, cfg int) bool {
+	c := px.configFor(seq)
+	return cfg < c.from || (cfg == c.from && indexOf(c.peers, px.addr) < 0)
+}
+
+// switch to peers for instances >= from. false if we already had
+// that change, or a later one. called with mu held.
+func (px *Paxos) reconfigure(from int, peers []string) bool {
+	if from <= px.configs[len(px.configs)-1].from {
+		return false
+	}
+	px.configs = append(px.configs, config{from, peers})
+
+	old := px.peers
+	px.peers = peers
+	px.me = indexOf(peers, px.addr)
+
+	// indices have moved; follow the peers they stood for.
+	if px.leader >= 0 {
+		px.leader = indexOf(peers, old[px.leader])
+	}
+	if px.shunned >= 0 {
+		px.shunned = indexOf(peers, old[px.shunned])
+	}
+	if px.leader < 0 {
+		px.granted_at = time.Time{}
+	}
+	if px.leading {
+		px.stepDown()
+		px.last_heartbeat = time.Now()
+	}
+
+	done_values := make(map[string]int)
+	for _, peer := range peers {
+		if done, ok := px.done_values[peer]; ok {
+			done_values[peer] = done
+		} else {
+			done_values[peer] = -1
+		}
+	}
+	px.done_values = done_values
+	return true
+}
+
+// the first instance the current peers are in charge of.
+func (px *Paxos) configFrom() int {
+	return px.configs[len(px.configs)-1].from
+}
+
+// the index of addr in peers, or -1.
+func indexOf(peers []string, addr string) int {
+	for i, peer := range peers {
+		if peer == addr {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,475 @@
+package paxos
+
+//
+// Multi-Paxos with a stable leader.
+//
+// Without a leader every Start() runs a full prepare/accept/decide
+// round. With EnableLeader() the peers elect a leader: a candidate
+// runs one PrepareLeader round that covers every instance from some
+// seq on. Once a majority has promised, the leader skips the prepare
+// phase for each new instance and only sends Accept and Decided.
+//
+// The leader sends heartbeats. A peer that hears nothing for
+// electionTimeout campaigns with a higher ballot; lower-numbered
+// peers campaign sooner, so leadership stays put while the leader
+// lives. A leader that learns of a higher ballot steps down, and an
+// instance whose fast accept fails falls back to a full round, so
+// safety never depends on there being a single leader.
+//
+// Leases. A peer that acknowledges the leader (PrepareLeader or
+// Heartbeat) promises to accept nothing from any other proposer for
+// electionTimeout, and hands its own proposals to the leader with
+// Forward instead. A leader that heard from a majority at time t
+// therefore knows that until t+leaseDuration no other peer can get
+// an instance decided, and that every instance decided before then
+// is at most Max(). The application can serve reads locally while
+// HasLease() is true, once it has applied everything up to Max().
+// leaseDuration is shorter than electionTimeout to leave room for
+// clock drift between peers.
+//
+// A leader that can send but not receive (say, its socket was
+// removed) would otherwise hold its lease forever while nobody can
+// forward to it. So followers ping the leader, and stop
+// acknowledging one they can't reach; the lease then runs out and
+// someone else gets elected.
+//
+
+import "time"
+
+const heartbeatInterval = 50 * time.Millisecond
+const electionTimeout = 6 * heartbeatInterval
+const leaseDuration = 4 * heartbeatInterval
+
+//
+// switch this peer to Multi-Paxos. every peer of a group
+// should do it; peers that don't still interoperate, they just
+// never lead.
+//
+func (px *Paxos) EnableLeader() {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if px.leader_mode {
+		return
+	}
+	px.leader_mode = true
+	px.last_heartbeat = time.Now()
+	go px.tick()
+}
+
+//
+// the peer that currently leads, as far as this peer knows.
+//
+func (px *Paxos) Leader() (string, bool) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if px.leading {
+		return px.peers[px.me], true
+	}
+	if px.leader_mode && px.leader >= 0 &&
+		time.Since(px.last_heartbeat) < electionTimeout {
+		return px.peers[px.leader], true
+	}
+	return "", false
+}
+
+//
+// true if this peer leads and holds a lease: no other peer can get
+// an instance decided before the lease runs out.
+//
+func (px *Paxos) HasLease() bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.leading && time.Now().Before(px.lease_until)
+}
+
+func (px *Paxos) tick() {
+	for !px.dead {
+		time.Sleep(heartbeatInterval)
+
+		px.mu.Lock()
+		if px.me < 0 {
+			// no longer one of the peers; nothing to lead.
+			px.mu.Unlock()
+			continue
+		}
+		leading := px.leading
+		// stagger candidates by index, so the lowest live peer
+		// usually wins and keeps winning.
+		timeout := electionTimeout + time.Duration(px.me)*2*heartbeatInterval
+		quiet := time.Since(px.last_heartbeat) > timeout
+		px.mu.Unlock()
+
+		if leading {
+			px.sendHeartbeats()
+		} else if quiet {
+			px.campaign()
+		} else {
+			px.pingLeader()
+		}
+	}
+}
+
+// the ballot promised for seq: the instance's own, or the one
+// promised to a leader for a range that includes seq.
+// called with mu held.
+func (px *Paxos) promiseFor(seq int, inst Instance) Ballot {
+	p := inst.h_prepare
+	if seq >= px.promised_from && p.Less(px.promised) {
+		p = px.promised
+	}
+	return p
+}
+
+// make sure the leader we follow can hear us.
+func (px *Paxos) pingLeader() {
+	px.mu.Lock()
+	leader := px.leader
+	peers := px.peers
+	from := px.configFrom()
+	px.mu.Unlock()
+	if leader < 0 || leader == px.me {
+		return
+	}
+
+	ok := call(px.tr, peers[leader], px.service+".Ping",
+		&PingArgs{}, &PingReply{})
+
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.configFrom() != from {
+		// the peers changed under us; the index means someone else.
+		return
+	}
+	if !ok {
+		px.shunned = leader
+	} else if px.shunned == leader {
+		px.shunned = -1
+	}
+}
+
+// true if we promised the leader to take nothing from proposer.
+// called with mu held.
+func (px *Paxos) leaseGranted(proposer int) bool {
+	return px.leader >= 0 && proposer != px.leader &&
+		time.Since(px.granted_at) < electionTimeout
+}
+
+// stop leading. called with mu held.
+func (px *Paxos) stepDown() {
+	px.leading = false
+	px.leader_vals = nil
+	px.lease_until = time.Time{}
+}
+
+// a peer told us of ballot b: our next one must beat it, and if it
+// beats our leader ballot, we no longer lead.
+func (px *Paxos) noteBallot(b Ballot) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.seeBallot(b)
+	if px.leading && px.ballot.Less(b) {
+		px.stepDown()
+	}
+}
+
+// start a lease at start, if we still lead under ballot.
+func (px *Paxos) extendLease(ballot Ballot, start time.Time, max int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if max > px.seq {
+		px.seq = max
+	}
+	if px.leading && px.ballot == ballot {
+		px.lease_until = start.Add(leaseDuration)
+	}
+}
+
+// hand a proposal to the leader we acknowledged or, failing that,
+// to hint, a leader some acceptor acknowledged. false if there is
+// none, or it can't be reached.
+func (px *Paxos) forwardToLeader(seq int, v interface{}, hint int) bool {
+	px.mu.Lock()
+	leader := hint
+	if px.leaseGranted(px.me) {
+		leader = px.leader
+	}
+	peers := px.peers
+	cfg := px.configFor(seq).from
+	px.mu.Unlock()
+
+	if leader < 0 || leader >= len(peers) || leader == px.me {
+		return false
+	}
+	args := ForwardArgs{seq, v, cfg}
+	var reply ForwardReply
+	return call(px.tr, peers[leader], px.service+".Forward", &args,
+		&reply) && reply.OK
+}
+
+// try to become leader for every instance not yet compacted.
+func (px *Paxos) campaign() {
+	start := time.Now()
+	px.mu.Lock()
+	// instances before the current peers took over are none of
+	// their business.
+	from := px.compacted_seen + 1
+	if px.configFrom() > from {
+		from = px.configFrom()
+	}
+	cfg_from := px.configFrom()
+	args := PrepareLeaderArgs{from, px.newBallot(), px.me, px.my_done,
+		cfg_from}
+	peers := px.peers
+	px.last_heartbeat = time.Now() // don't campaign again right away
+	px.mu.Unlock()
+
+	n_ok := 0
+	highest := make(map[int]AcceptedInstance)
+	// ourselves first, as in DoPrepareRound.
+	for _, peer := range selfFirst(peers, px.addr) {
+		var reply PrepareLeaderReply
+		ok := true
+		if peer == px.addr {
+			px.PrepareLeader(&args, &reply)
+		} else {
+			ok = call(px.tr, peer, px.service+".PrepareLeader", &args, &reply)
+		}
+		if !ok {
+			continue
+		}
+		px.noteCompacted(reply.Compacted)
+		px.noteBallot(reply.Promised)
+		if !reply.OK && peer == px.addr {
+			return
+		}
+		if !reply.OK {
+			continue
+		}
+		px.handleDoneMessage(peer, reply.Done)
+		n_ok++
+
+		for _, a := range reply.Accepted {
+			if h, ok := highest[a.Seq]; !ok || a.Decided ||
+				(!h.Decided && h.HAccept.Less(a.HAccept)) {
+				highest[a.Seq] = a
+			}
+		}
+	}
+
+	if n_ok < len(peers)/2+1 {
+		return
+	}
+
+	px.mu.Lock()
+	if px.promised != args.Ballot || px.configFrom() != cfg_from {
+		// someone outbid us while we were counting, or the
+		// peers changed.
+		px.mu.Unlock()
+		return
+	}
+	px.leading = true
+	px.ballot = args.Ballot
+	px.lead_from = args.From
+	px.leader = px.me
+	px.leader_vals = make(map[int]interface{})
+	max := 0
+	for seq, a := range highest {
+		if a.Decided {
+			px.leader_vals[seq] = a.VDecided
+		} else {
+			px.leader_vals[seq] = a.HValue
+		}
+		if seq > max {
+			max = seq
+		}
+	}
+	px.mu.Unlock()
+	px.extendLease(args.Ballot, start, max)
+
+	// finish whatever earlier leaders left half done, with the
+	// values they chose.
+	for seq, a := range highest {
+		if a.Decided {
+			var reply DecidedReply
+			px.Decided(&DecidedArgs{seq, a.HAccept, a.VDecided, px.my_done}, &reply)
+		} else {
+			go px.leaderPropose(seq, a.HValue)
+		}
+	}
+	px.sendHeartbeats()
+}
+
+// phase 2 only, under our leader ballot.
+func (px *Paxos) leaderPropose(seq int, v interface{}) {
+	px.mu.Lock()
+	if !px.leading || seq < px.lead_from {
+		px.mu.Unlock()
+		px.Propose(seq, v)
+		return
+	}
+	if inst, ok := px.instances[seq]; ok && inst.decided {
+		// someone asked, so maybe not everyone knows; tell them.
+		px.mu.Unlock()
+		px.DoDecidedRound(seq, inst.v_decided, inst.h_accept)
+		return
+	}
+	// never propose two values for one instance under one ballot.
+	if prev, ok := px.leader_vals[seq]; ok {
+		v = prev
+	} else {
+		px.leader_vals[seq] = v
+	}
+	ballot := px.ballot
+	px.mu.Unlock()
+
+	if px.DoAcceptRound(seq, v, ballot) {
+		px.DoDecidedRound(seq, v, ballot)
+	} else {
+		// lost the instance, or the leadership; do it the slow way.
+		px.Propose(seq, v)
+	}
+}
+
+func (px *Paxos) sendHeartbeats() {
+	start := time.Now()
+	px.mu.Lock()
+	args := HeartbeatArgs{px.ballot, px.me, px.my_done, px.configFrom()}
+	peers := px.peers
+	px.granted_at = start
+	px.mu.Unlock()
+
+	n_ok := 1 // ourselves
+	max := 0
+	for i, peer := range peers {
+		if i == args.Leader {
+			continue
+		}
+		var reply HeartbeatReply
+		if call(px.tr, peer, px.service+".Heartbeat", &args, &reply) {
+			px.handleDoneMessage(peer, reply.Done)
+			px.noteBallot(reply.Promised)
+			if reply.OK {
+				n_ok++
+				if reply.Max > max {
+					max = reply.Max
+				}
+			}
+		}
+	}
+
+	if n_ok >= len(peers)/2+1 {
+		px.extendLease(args.Ballot, start, max)
+	}
+}
+
+func (px *Paxos) PrepareLeader(args *PrepareLeaderArgs,
+	reply *PrepareLeaderReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	reply.Done = px.my_done
+	reply.Compacted = px.compacted
+	reply.OK = false
+	reply.Promised = px.promised
+
+	px.seeBallot(args.Ballot)
+	if !px.promised.Less(args.Ballot) || px.leaseGranted(args.Leader) ||
+		args.Config != px.configFrom() {
+		return nil
+	}
+	accepted := make([]AcceptedInstance, 0)
+	for seq, inst := range px.instances {
+		if seq < args.From {
+			continue
+		}
+		if !inst.h_prepare.Less(args.Ballot) {
+			reply.Promised = inst.h_prepare
+			return nil
+		}
+		if inst.h_accept != noProposal || inst.decided {
+			accepted = append(accepted, AcceptedInstance{seq, inst.h_accept,
+				inst.h_value, inst.decided, inst.v_decided})
+		}
+	}
+
+	px.promised = args.Ballot
+	px.promised_from = args.From
+	if err := px.logPromise(); err != nil {
+		return err
+	}
+	if px.leading && args.Leader != px.me {
+		px.stepDown()
+	}
+	px.leader = args.Leader
+	px.last_heartbeat = time.Now()
+	px.granted_at = px.last_heartbeat
+
+	reply.OK = true
+	reply.Promised = args.Ballot
+	reply.Accepted = accepted
+	return nil
+}
+
+func (px *Paxos) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	px.mu.Lock()
+	reply.Done = px.my_done
+	reply.Promised = px.promised
+	reply.Max = px.seq
+	// a leader we can't reach gets no more of our time.
+	// and one that counts different peers than we do isn't ours.
+	known := args.Config == px.configFrom()
+	px.seeBallot(args.Ballot)
+	reply.OK = !args.Ballot.Less(px.promised) && args.Leader != px.shunned && known
+	if reply.OK {
+		px.leader = args.Leader
+		px.last_heartbeat = time.Now()
+		px.granted_at = px.last_heartbeat
+	}
+	leader := ""
+	if known {
+		leader = px.peers[args.Leader]
+	}
+	px.mu.Unlock()
+
+	if leader != "" {
+		px.handleDoneMessage(leader, args.Done)
+	}
+	return nil
+}
+
+func (px *Paxos) Ping(args *PingArgs, reply *PingReply) error {
+	return nil
+}
+
+//
+// a follower wants seq to hold v. propose it as if it were ours;
+// even if we no longer lead, the acceptors that sent the follower
+// here will take it from us.
+//
+func (px *Paxos) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	px.mu.Lock()
+	if args.Config != px.configFor(args.Seq).from {
+		// one of us has missed a change of peers; it must not be
+		// us proposing with the wrong ones.
+		px.mu.Unlock()
+		reply.OK = false
+		return nil
+	}
+	if args.Seq > px.seq {
+		px.seq = args.Seq
+	}
+	fast := px.leading && args.Seq >= px.lead_from
+	px.mu.Unlock()
+
+	if fast {
+		go px.leaderPropose(args.Seq, args.Value)
+	} else {
+		go px.propose(args.Seq, args.Value, false)
+	}
+	reply.OK = true
+	return nil
+}
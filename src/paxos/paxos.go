@@ -6,20 +6,38 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers changes only when the application says so.
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// Given a directory, keeps a write-ahead log there (see wal.go), so
+// it can handle crash+restart; without one it keeps everything in
+// memory and cannot.
 //
 // The application interface:
 //
-// px = paxos.Make(peers []string, me string)
+// px = paxos.Make(peers []string, me string, rpcs *rpc.Server, tr transport.Transport)
+// px = paxos.MakeService(service string, peers, me, rpcs, tr, dir string) --
+//   same, but registered under service instead of "Paxos", so that several
+//   peers can share one rpc.Server (and so one address), and logged to
+//   disk under dir unless dir is "".
 // px.Start(seq int, v interface{}) -- start agreement on new instance
 // px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.Compact(seq int) -- forget instances <= seq now, whatever the
+//   other peers have seen; the application must have their effect
+//   saved elsewhere (e.g. a snapshot)
+// px.Compacted() int -- highest seq some peer is known to have compacted
+// px.EnableLeader() -- switch to Multi-Paxos with a stable leader (leader.go)
+// px.Leader() (string, bool) -- the peer currently leading, if known
+// px.HasLease() bool -- we lead, and no other peer can get anything
+//   decided for now; see leader.go
+// px.Reconfigure(from int, peers []string) -- instances >= from are
+//   agreed among peers instead; see config.go
+// px.Peers(seq int) []string -- the peers agreeing on instance seq
 //
 
+import "errors"
 import "net"
 import "net/rpc"
 import "log"
@@ -30,6 +48,8 @@ import "fmt"
 import "math/rand"
 import "time"
 import "math"
+import "path/filepath"
+import "transport"
 
 type Paxos struct {
 	mu         sync.Mutex
@@ -37,8 +57,12 @@ type Paxos struct {
 	dead       bool
 	unreliable bool
 	rpcCount   int
-	peers      []string
-	me         int // index into peers[]
+	peers      []string // the current peers
+	me         int      // index into peers[], or -1 if no longer one of them
+	addr       string   // our own address; me changes with the peers
+	configs    []config // every set of peers we had; see config.go
+	tr         transport.Transport
+	service    string // rpc service name, the same on every peer
 
 	proposelock sync.Mutex
 
@@ -49,7 +73,26 @@ type Paxos struct {
 	min_done    float64 // min Done of all peers. float64 for comparisons
 	seq         int     // highest seq instance seen thus far
 
-	ref_time time.Time // reference time for calculating n
+	compacted      int // instances <= compacted are forgotten here
+	compacted_seen int // highest compacted seq heard from any peer
+
+	// Multi-Paxos; see leader.go
+	leader_mode    bool
+	promised       Ballot // promised to a leader for all instances >= promised_from
+	promised_from  int
+	leader         int       // peer we last heard lead, or -1
+	last_heartbeat time.Time // when we last heard from it
+	leading        bool      // we hold ballot for all instances >= lead_from
+	ballot         Ballot
+	lead_from      int
+	leader_vals    map[int]interface{} // what we proposed under ballot
+	granted_at     time.Time           // when we last acknowledged the leader
+	lease_until    time.Time           // while we lead, our lease ends here
+	shunned        int                 // a leader we could not reach, or -1
+
+	wal *wal // nil if not persistent
+
+	highest Ballot // the highest ballot seen, our own included
 }
 
 //
@@ -68,15 +111,16 @@ type Paxos struct {
 // please use call() to send all RPCs, in client.go and server.go.
 // please do not change this function.
 //
-func call(srv string, name string, args interface{}, reply interface{}) bool {
-	c, err := rpc.Dial("unix", srv)
+func call(tr transport.Transport, srv string, name string,
+	args interface{}, reply interface{}) bool {
+	conn, err := tr.Dial(srv)
 	if err != nil {
-		err1 := err.(*net.OpError)
-		if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-			fmt.Printf("paxos Dial() failed: %v for server %v\n", err1, srv)
+		if !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ECONNREFUSED) {
+			fmt.Printf("paxos Dial() failed: %v for server %v\n", err, srv)
 		}
 		return false
 	}
+	c := rpc.NewClient(conn)
 	defer c.Close()
 
 	err = c.Call(name, args, reply)
@@ -89,64 +133,90 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
 }
 
 func (px *Paxos) DoPrepareRound(seq int, value interface{},
-	proposalNum int64) (ok bool, nextVal interface{}) {
+	proposalNum Ballot) (ok bool, nextVal interface{}, leader int) {
 
-	args := PrepareArgs{seq, proposalNum, px.my_done}
-	var reply PrepareReply
+	cfg := px.configAt(seq)
+	peers := cfg.peers
+	args := PrepareArgs{seq, proposalNum, px.my_done, px.me, cfg.from}
 
 	n_ok := 0
-	var nextNum int64 = -1
+	nextNum := noProposal
 	nextVal = value
+	leader = -1
 
-	for _, peer := range px.peers {
+	// ask ourselves first: once our own promise is on disk, a
+	// restart can't hand the same ballot out again.
+	for _, peer := range selfFirst(peers, px.addr) {
 		var all_ok bool = true
+		var reply PrepareReply
 
 		// Send prepare(n) to all servers.
-		if peer == px.peers[px.me] {
+		if peer == px.addr {
 			px.Prepare(&args, &reply)
 			all_ok = true
 		} else {
-			all_ok = call(peer, "Paxos.Prepare", &args, &reply)
+			all_ok = call(px.tr, peer, px.service+".Prepare", &args, &reply)
 		}
 
+		if all_ok {
+			px.noteCompacted(reply.Compacted)
+			px.noteBallot(reply.Promised)
+			if reply.Decided {
+				// no need to go on; just learn it.
+				var d_reply DecidedReply
+				px.Decided(&DecidedArgs{seq, reply.HighestProposalSeen,
+					reply.HighestValueSeen, px.my_done}, &d_reply)
+				return false, nextVal, -1
+			}
+			if !reply.OK && reply.Leader >= 0 {
+				leader = reply.Leader
+			}
+		}
 		if all_ok && reply.OK {
 			px.handleDoneMessage(peer, reply.Done)
 			n_ok += 1
 
-			if reply.HighestProposalSeen > nextNum {
+			if nextNum.Less(reply.HighestProposalSeen) {
 				// update the value with the highest value seen.
 				nextVal = reply.HighestValueSeen
 				nextNum = reply.HighestProposalSeen
 			}
+		} else if peer == px.addr {
+			// nobody else has seen this ballot; don't let them.
+			return false, nextVal, leader
 		}
 	}
 
-	time.Sleep(time.Millisecond * 50)
-
 	ok = false
-	if n_ok >= (len(px.peers)+1)/2. {
+	if n_ok >= (len(peers)+1)/2. {
 		ok = true
 	}
 
-	return ok, nextVal
+	return ok, nextVal, leader
 }
 
 func (px *Paxos) DoAcceptRound(seq int, value interface{},
-	proposalNum int64) (ok bool) {
+	proposalNum Ballot) (ok bool) {
 	n_accept := 0
+	cfg := px.configAt(seq)
+	peers := cfg.peers
 
-	for _, peer := range px.peers {
+	for _, peer := range peers {
 		var all_ok bool = true
-		a_args := AcceptArgs{seq, proposalNum, value, px.my_done}
+		a_args := AcceptArgs{seq, proposalNum, value, px.my_done, px.me, cfg.from}
 		var a_reply AcceptReply
 
-		if peer == px.peers[px.me] {
+		if peer == px.addr {
 			px.Accept(&a_args, &a_reply)
 			all_ok = true
 		} else {
-			all_ok = call(peer, "Paxos.Accept", &a_args, &a_reply)
+			all_ok = call(px.tr, peer, px.service+".Accept", &a_args, &a_reply)
 		}
 
+		if all_ok {
+			px.noteCompacted(a_reply.Compacted)
+			px.noteBallot(a_reply.Promised)
+		}
 		if all_ok && a_reply.OK {
 			px.handleDoneMessage(peer, a_reply.Done)
 			n_accept += 1
@@ -154,7 +224,7 @@ func (px *Paxos) DoAcceptRound(seq int, value interface{},
 	}
 
 	ok = false
-	if n_accept >= (len(px.peers)+1)/2. {
+	if n_accept >= (len(peers)+1)/2. {
 		ok = true
 	}
 
@@ -162,31 +232,61 @@ func (px *Paxos) DoAcceptRound(seq int, value interface{},
 }
 
 func (px *Paxos) DoDecidedRound(seq int, value interface{},
-	proposalNum int64) {
+	proposalNum Ballot) {
 
 	d_args := DecidedArgs{seq, proposalNum, value, px.my_done}
 	var d_reply DecidedReply
-	for _, peer := range px.peers {
-		if peer == px.peers[px.me] {
+	for _, peer := range px.Peers(seq) {
+		if peer == px.addr {
 			px.Decided(&d_args, &d_reply)
 		} else {
-			call(peer, "Paxos.Decided", &d_args, &d_reply)
+			call(px.tr, peer, px.service+".Decided", &d_args, &d_reply)
 		}
 	}
 }
 
 func (px *Paxos) Propose(seq int, value interface{}) {
+	px.propose(seq, value, true)
+}
+
+// like Propose; forward says whether we may hand the value to a
+// leader instead of proposing it ourselves. a value that was
+// forwarded to us is never forwarded again, so two peers that each
+// think the other leads can't bounce it back and forth.
+func (px *Paxos) propose(seq int, value interface{}, forward bool) {
 	px.proposelock.Lock()
 	defer px.proposelock.Unlock()
 
-	for !px.dead {
-		// Choose n, unique and higher than any n seen so far.
-		var proposalNum int64
-		t := (time.Now().Sub(px.ref_time)).Nanoseconds()
-		proposalNum = t*int64(len(px.peers))*10 + int64(px.me)
+	leader := -1 // a lease holder some acceptor told us about
+	duels := 0   // times in a row another proposer outbid us
+
+	// once a peer has compacted seq, its value can only be
+	// learned from that peer's application, not from Paxos.
+	for !px.dead && seq > px.Compacted() {
+		if forward && px.forwardToLeader(seq, value, leader) {
+			// the leader will propose it, or something else, for us.
+			time.Sleep(heartbeatInterval)
+			if decided, _, _ := px.decidedValue(seq); decided {
+				break
+			}
+			leader = -1
+			continue
+		}
+
+		px.mu.Lock()
+		proposalNum := px.newBallot()
+		px.mu.Unlock()
 
-		prepare_success, newValue := px.DoPrepareRound(seq,
+		prepare_success, newValue, l := px.DoPrepareRound(seq,
 			value, proposalNum)
+		leader = l
+
+		if decided, v, n := px.decidedValue(seq); decided {
+			// an acceptor told us the outcome; pass it on to any
+			// peer that missed it, as a full round would have.
+			px.DoDecidedRound(seq, v, n)
+			break
+		}
 
 		if prepare_success {
 			accept_success := px.DoAcceptRound(seq, newValue, proposalNum)
@@ -197,10 +297,67 @@ func (px *Paxos) Propose(seq int, value interface{}) {
 			}
 		}
 
-		time.Sleep(50 * time.Millisecond)
+		if !px.outbid(proposalNum) {
+			// too few peers answered; give them a moment.
+			duels = 0
+			time.Sleep(time.Duration(10+rand.Intn(50)) * time.Millisecond)
+			continue
+		}
+		// the rejections told us the ballot to beat, so the next
+		// round can go right away. but if two proposers keep
+		// outbidding each other, they back off a random, growing
+		// amount, or neither gets anywhere.
+		duels++
+		if duels > 1 {
+			backoff := 160
+			if duels < 6 {
+				backoff = 10 << uint(duels-2)
+			}
+			time.Sleep(time.Duration(rand.Intn(backoff)) * time.Millisecond)
+		}
+	}
+}
+
+// the value decided for seq, and the proposal it was accepted at,
+// if this peer knows it.
+func (px *Paxos) decidedValue(seq int) (bool, interface{}, Ballot) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	inst := px.instances[seq]
+	return inst.decided, inst.v_decided, inst.h_accept
+}
+
+// a ballot higher than any seen so far, and so unique: no other
+// peer's ballot has our address in it. called with mu held.
+func (px *Paxos) newBallot() Ballot {
+	px.highest = Ballot{px.highest.Round + 1, px.addr}
+	return px.highest
+}
+
+// remember b, so that our next ballot beats it. called with mu held.
+func (px *Paxos) seeBallot(b Ballot) {
+	if px.highest.Less(b) {
+		px.highest = b
 	}
 }
 
+// true if some peer has a higher ballot than b.
+func (px *Paxos) outbid(b Ballot) bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return b.Less(px.highest)
+}
+
+// peers, with self (if there) moved to the front.
+func selfFirst(peers []string, self string) []string {
+	i := indexOf(peers, self)
+	if i <= 0 {
+		return peers
+	}
+	ordered := append([]string{self}, peers[:i]...)
+	return append(ordered, peers[i+1:]...)
+}
+
 //
 // the application wants paxos to start agreement on
 // instance seq, with proposed value v.
@@ -209,12 +366,19 @@ func (px *Paxos) Propose(seq int, value interface{}) {
 // is reached.
 //
 func (px *Paxos) Start(seq int, v interface{}) {
+	px.mu.Lock()
 	if seq > px.seq {
 		px.seq = seq
 	}
+	fast := px.leading && seq >= px.lead_from
+	px.mu.Unlock()
 
 	// Spawn a goroutine and return.
-	go px.Propose(seq, v)
+	if fast {
+		go px.leaderPropose(seq, v)
+	} else {
+		go px.Propose(seq, v)
+	}
 }
 
 //
@@ -224,8 +388,14 @@ func (px *Paxos) Start(seq int, v interface{}) {
 // see the comments for Min() for more explanation.
 //
 func (px *Paxos) Done(seq int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
 	if seq > px.my_done {
 		px.my_done = seq
+		if err := px.logDone("", seq); err != nil {
+			fmt.Printf("Paxos(%v) log Done: %v\n", px.me, err)
+		}
 	}
 }
 
@@ -235,9 +405,63 @@ func (px *Paxos) Done(seq int) {
 // this peer.
 //
 func (px *Paxos) Max() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
 	return px.seq
 }
 
+//
+// the application has saved the effect of every instance <= seq
+// (in a snapshot, say), so this peer may forget them right away,
+// without waiting for every peer to call Done(). peers that are
+// behind learn about it from Prepare and Accept replies, and must
+// then catch up through the application.
+//
+func (px *Paxos) Compact(seq int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if seq <= px.compacted {
+		return
+	}
+	px.compacted = seq
+	px.noteCompactedLocked(seq)
+	for i := range px.instances {
+		if i <= seq {
+			delete(px.instances, i)
+		}
+	}
+	if err := px.logCompact(seq); err != nil {
+		fmt.Printf("Paxos(%v) log Compact: %v\n", px.me, err)
+	}
+}
+
+//
+// the highest seq that some peer is known to have compacted.
+// Status() reports those instances as decided, with a nil value,
+// unless this peer still knows the value.
+//
+func (px *Paxos) Compacted() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.compacted_seen
+}
+
+func (px *Paxos) noteCompacted(seq int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.noteCompactedLocked(seq)
+}
+
+func (px *Paxos) noteCompactedLocked(seq int) {
+	if seq > px.compacted_seen {
+		px.compacted_seen = seq
+	}
+	if seq > px.seq {
+		px.seq = seq
+	}
+}
+
 // Update our minimum Done values.
 func (px *Paxos) handleDoneMessage(peer string, seq int) {
 	px.mu.Lock()
@@ -258,7 +482,13 @@ func (px *Paxos) handleDoneMessage(peer string, seq int) {
 		delete(px.instances, int(i))
 	}
 
-	px.done_values[peer] = int(math.Max(float64(px.done_values[peer]), float64(seq)))
+	// peers we no longer have don't hold anything back.
+	if done, ok := px.done_values[peer]; ok && seq > done {
+		px.done_values[peer] = seq
+		if err := px.logDone(peer, seq); err != nil {
+			fmt.Printf("Paxos(%v) log Done: %v\n", px.me, err)
+		}
+	}
 }
 
 //
@@ -301,10 +531,13 @@ func (px *Paxos) Min() int {
 // it should not contact other Paxos peers.
 //
 func (px *Paxos) Status(seq int) (bool, interface{}) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
 	if instance, ok := px.instances[seq]; ok && instance.decided {
 		return instance.decided, instance.v_decided
 	} else {
-		if seq < px.my_done {
+		if seq < px.my_done || seq <= px.compacted_seen {
 			// This is a stale sequence number. It shouldn't matter what
 			// gets returned.
 			return true, nil
@@ -317,31 +550,52 @@ func (px *Paxos) Status(seq int) (bool, interface{}) {
 func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
 	px.mu.Lock()
 	defer px.mu.Unlock()
-	existingInstance, ok := px.instances[args.Seq]
 
-	if !ok {
-		reply.OK = true
-		reply.HighestProposalSeen = -1
+	reply.Done = px.my_done
+	reply.Compacted = px.compacted
+	reply.Leader = -1
+	if args.Seq <= px.compacted || px.wrongConfig(args.Seq, args.Config) {
+		reply.OK = false
+		return nil
+	}
 
-		newInstance := Instance{args.ProposalNum, -1, nil, false, nil}
+	px.seeBallot(args.ProposalNum)
+	existingInstance, ok := px.instances[args.Seq]
+	if !ok {
+		existingInstance = Instance{noProposal, noProposal, nil, false, nil}
+	}
+	reply.Promised = px.promiseFor(args.Seq, existingInstance)
+
+	if existingInstance.decided && args.Proposer != px.me {
+		// the proposer is behind; tell it the outcome.
+		reply.OK = false
+		reply.Decided = true
+		reply.HighestProposalSeen = existingInstance.h_accept
+		reply.HighestValueSeen = existingInstance.v_decided
+	} else if px.leaseGranted(args.Proposer) {
+		reply.OK = false
+		reply.Leader = px.leader
+	} else if reply.Promised.Less(args.ProposalNum) {
+		newInstance := existingInstance
+		newInstance.h_prepare = args.ProposalNum
 		px.instances[args.Seq] = newInstance
-	} else {
-		if args.ProposalNum > existingInstance.h_prepare {
-			newInstance := px.instances[args.Seq]
-			newInstance.h_prepare = args.ProposalNum
-			px.instances[args.Seq] = newInstance
+		reply.Promised = args.ProposalNum
 
-			reply.HighestProposalSeen = existingInstance.h_accept
-			reply.HighestValueSeen = existingInstance.h_value
+		reply.HighestProposalSeen = existingInstance.h_accept
+		reply.HighestValueSeen = existingInstance.h_value
 
-			reply.OK = true
-		} else {
+		reply.OK = true
+	} else {
+		reply.OK = false
+	}
+
+	if reply.OK {
+		// the promise has to be on disk before we make it.
+		if err := px.logInstance(args.Seq); err != nil {
 			reply.OK = false
+			return err
 		}
-
 	}
-
-	reply.Done = px.my_done
 	return nil
 }
 
@@ -350,13 +604,34 @@ func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
 	defer px.mu.Unlock()
 
 	reply.OK = false
-	existingInstance := px.instances[args.Seq]
-	if args.ProposalNum >= existingInstance.h_prepare {
+	reply.Compacted = px.compacted
+	reply.Promised = px.promised
+	if args.Seq <= px.compacted || px.wrongConfig(args.Seq, args.Config) {
+		reply.Done = px.my_done
+		return nil
+	}
+
+	px.seeBallot(args.ProposalNum)
+	existingInstance, ok := px.instances[args.Seq]
+	if !ok {
+		existingInstance = Instance{noProposal, noProposal, nil, false, nil}
+	}
+	reply.Promised = px.promiseFor(args.Seq, existingInstance)
+	if !args.ProposalNum.Less(reply.Promised) &&
+		!px.leaseGranted(args.Proposer) {
 		newInstance := Instance{args.ProposalNum, args.ProposalNum,
 			args.ValueToAccept, existingInstance.decided,
 			existingInstance.v_decided}
 		px.instances[args.Seq] = newInstance
 		reply.OK = true
+		if args.Seq > px.seq {
+			px.seq = args.Seq
+		}
+
+		if err := px.logInstance(args.Seq); err != nil {
+			reply.OK = false
+			return err
+		}
 	}
 
 	reply.Done = px.my_done
@@ -368,13 +643,32 @@ func (px *Paxos) Decided(args *DecidedArgs, reply *DecidedReply) error {
 	px.mu.Lock()
 	defer px.mu.Unlock()
 
-	if (args.ProposalNum <= px.instances[args.Seq].h_prepare) &&
-		(args.Seq >= px.my_done) {
-		newInstance := px.instances[args.Seq]
+	existingInstance, ok := px.instances[args.Seq]
+	if !ok {
+		existingInstance = Instance{noProposal, noProposal, nil, false, nil}
+	}
+
+	if !existingInstance.decided && args.Seq >= px.my_done &&
+		args.Seq > px.compacted {
+		newInstance := existingInstance
 		newInstance.v_decided = args.DecidedValue
 		newInstance.decided = true
 
+		// a majority accepted the decided value at ProposalNum, so it
+		// is safe to report it as accepted to later proposers.
+		if newInstance.h_accept.Less(args.ProposalNum) {
+			newInstance.h_accept = args.ProposalNum
+			newInstance.h_value = args.DecidedValue
+		}
+
 		px.instances[args.Seq] = newInstance
+		if args.Seq > px.seq {
+			px.seq = args.Seq
+		}
+
+		if err := px.logInstance(args.Seq); err != nil {
+			return err
+		}
 	}
 
 	reply.Done = px.my_done
@@ -392,20 +686,47 @@ func (px *Paxos) Kill() {
 	if px.l != nil {
 		px.l.Close()
 	}
+
+	px.mu.Lock()
+	if px.wal != nil {
+		px.wal.close()
+	}
+	px.mu.Unlock()
 }
 
 //
 // the application wants to create a paxos peer.
 // the ports of all the paxos peers (including this one)
 // are in peers[]. this servers port is peers[me].
+// tr is used both to reach the other peers and, if rpcs
+// is nil, to listen on peers[me]. a nil tr means unix sockets.
+//
+func Make(peers []string, me int, rpcs *rpc.Server,
+	tr transport.Transport) *Paxos {
+	return MakeService("Paxos", peers, me, rpcs, tr, "")
+}
+
 //
-func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+// like Make, but the peers talk to each other through the rpc
+// service called service. peers[] are then simply the addresses
+// of the rpc.Servers the peers are registered with, and one
+// server can host many Paxos peers, each under its own name.
+//
+// if dir is not "", the peer logs its state to dir/<service>.wal
+// and, if that file already exists, picks up where it left off.
+//
+func MakeService(service string, peers []string, me int,
+	rpcs *rpc.Server, tr transport.Transport, dir string) *Paxos {
 	px := &Paxos{}
+	px.service = service
 	px.peers = peers
 	px.me = me
-
-	// pick a reasonably close time
-	px.ref_time = time.Date(2014, time.May, 10, 0, 0, 0, 0, time.UTC)
+	px.addr = peers[me]
+	px.configs = []config{{0, peers}}
+	if tr == nil {
+		tr = transport.Unix{}
+	}
+	px.tr = tr
 
 	px.instances = make(map[int]Instance)
 	px.my_done = -1
@@ -415,18 +736,33 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
 	}
 	px.min_done = -1
 	px.seq = 0
+	px.compacted = -1
+	px.compacted_seen = -1
+	px.promised = noProposal
+	px.leader = -1
+	px.shunned = -1
+
+	if dir != "" {
+		os.MkdirAll(dir, 0777)
+		w, recs, err := openWAL(filepath.Join(dir, service+".wal"))
+		if err != nil {
+			log.Fatal("wal error: ", err)
+		}
+		px.wal = w
+		px.recover(recs)
+	}
 
 	if rpcs != nil {
 		// caller will create socket &c
-		rpcs.Register(px)
+		rpcs.RegisterName(service, px)
 	} else {
 		rpcs = rpc.NewServer()
-		rpcs.Register(px)
+		rpcs.RegisterName(service, px)
 
 		// prepare to receive connections from clients.
-		// change "unix" to "tcp" to use over a network.
-		os.Remove(peers[me]) // only needed for "unix"
-		l, e := net.Listen("unix", peers[me])
+		// the transport decides whether this is a unix socket,
+		// a tcp port, or an in-memory endpoint.
+		l, e := px.tr.Listen(peers[me])
 		if e != nil {
 			log.Fatal("listen error: ", e)
 		}
@@ -445,9 +781,16 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
 						conn.Close()
 					} else if px.unreliable && (rand.Int63()%1000) < 200 {
 						// process the request but force discard of reply.
-						c1 := conn.(*net.UnixConn)
-						f, _ := c1.File()
-						err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+						// every transport's conns can half-close; one
+						// that can't loses the request instead.
+						c1, ok := conn.(interface {
+							CloseWrite() error
+						})
+						if !ok {
+							conn.Close()
+							continue
+						}
+						err := c1.CloseWrite()
 						if err != nil {
 							fmt.Printf("shutdown: %v\n", err)
 						}
@@ -7,6 +7,8 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "net"
+import "transport"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -87,7 +89,7 @@ func noTestSpeed(t *testing.T) {
     pxh[i] = port("time", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
   }
 
   t0 := time.Now()
@@ -113,7 +115,7 @@ func TestBasic(t *testing.T) {
     pxh[i] = port("basic", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
   }
 
   fmt.Printf("Test: Single proposer ...\n")
@@ -173,7 +175,7 @@ func TestDeaf(t *testing.T) {
     pxh[i] = port("deaf", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
   }
 
   fmt.Printf("Test: Deaf proposer ...\n")
@@ -216,7 +218,7 @@ func TestForget(t *testing.T) {
     pxh[i] = port("gc", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
   }
 
   fmt.Printf("Test: Forgetting ...\n")
@@ -298,7 +300,7 @@ func TestManyForget(t *testing.T) {
     pxh[i] = port("manygc", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
     pxa[i].unreliable = true
   }
 
@@ -367,7 +369,7 @@ func TestForgetMem(t *testing.T) {
     pxh[i] = port("gcmem", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
   }
 
   pxa[0].Start(0, "x")
@@ -431,7 +433,7 @@ func TestRPCCount(t *testing.T) {
     pxh[i] = port("count", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
   }
 
   ninst1 := 5
@@ -506,7 +508,7 @@ func TestMany(t *testing.T) {
     pxh[i] = port("many", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
     pxa[i].Start(0, 0)
   }
 
@@ -556,20 +558,20 @@ func TestOld(t *testing.T) {
     pxh[i] = port("old", i)
   }
 
-  pxa[1] = Make(pxh, 1, nil)
-  pxa[2] = Make(pxh, 2, nil)
-  pxa[3] = Make(pxh, 3, nil)
+  pxa[1] = Make(pxh, 1, nil, nil)
+  pxa[2] = Make(pxh, 2, nil, nil)
+  pxa[3] = Make(pxh, 3, nil, nil)
   pxa[1].Start(1, 111)
 
   waitmajority(t, pxa, 1)
 
-  pxa[0] = Make(pxh, 0, nil)
+  pxa[0] = Make(pxh, 0, nil, nil)
   pxa[0].Start(1, 222)
 
   waitn(t, pxa, 1, 4)
 
   if false {
-    pxa[4] = Make(pxh, 4, nil)
+    pxa[4] = Make(pxh, 4, nil, nil)
     waitn(t, pxa, 1, npaxos)
   }
 
@@ -593,7 +595,7 @@ func TestManyUnreliable(t *testing.T) {
     pxh[i] = port("manyun", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
     pxa[i].unreliable = true
     pxa[i].Start(0, 0)
   }
@@ -685,7 +687,7 @@ func TestPartition(t *testing.T) {
         pxh[j] = pp(tag, i, j)
       }
     }
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
   }
   defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 
@@ -787,7 +789,7 @@ func TestLots(t *testing.T) {
         pxh[j] = pp(tag, i, j)
       }
     }
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, nil)
     pxa[i].unreliable = true
   }
   defer part(t, tag, npaxos, []int{}, []int{}, []int{})
@@ -872,3 +874,760 @@ func TestLots(t *testing.T) {
 
   fmt.Printf("  ... Passed\n")
 }
+
+func TestTransports(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+
+  fmt.Printf("Test: Agreement over in-memory transport ...\n")
+
+  mem := transport.NewMem()
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = "px-mem-" + strconv.Itoa(i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, mem)
+  }
+
+  pxa[0].Start(0, "hello")
+  pxa[1].Start(1, 101)
+  pxa[2].Start(1, 102)
+  waitn(t, pxa, 0, npaxos)
+  waitn(t, pxa, 1, npaxos)
+  cleanup(pxa)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Agreement over TCP loopback ...\n")
+
+  pxa = make([]*Paxos, npaxos)
+  pxh = make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = tcpport(t)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, transport.TCP{})
+  }
+  defer cleanup(pxa)
+
+  pxa[0].Start(0, "hello")
+  pxa[1].Start(1, 101)
+  pxa[2].Start(1, 102)
+  waitn(t, pxa, 0, npaxos)
+  waitn(t, pxa, 1, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Dead peer over in-memory transport ...\n")
+
+  mem = transport.NewMem()
+  pxb := make([]*Paxos, npaxos)
+  pxm := make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxm[i] = "px-mem-" + strconv.Itoa(i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxb[i] = Make(pxm, i, nil, mem)
+  }
+  defer cleanup(pxb)
+
+  pxb[2].Kill()
+  pxb[0].Start(0, "x")
+  waitn(t, pxb[:2], 0, 2)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Unreliable agreement over in-memory transport ...\n")
+
+  mem = transport.NewMem()
+  pxu := make([]*Paxos, npaxos)
+  pxv := make([]string, npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxv[i] = "px-memun-" + strconv.Itoa(i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxu[i] = Make(pxv, i, nil, mem)
+    pxu[i].unreliable = true
+  }
+  defer cleanup(pxu)
+
+  const ninst = 10
+  for seq := 0; seq < ninst; seq++ {
+    for i := 0; i < npaxos; i++ {
+      pxu[i].Start(seq, (seq * 10) + i)
+    }
+  }
+  for seq := 0; seq < ninst; seq++ {
+    waitn(t, pxu, seq, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// pick a free loopback port for a tcp test.
+func tcpport(t *testing.T) string {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("cannot find a free port: %v", err)
+  }
+  defer l.Close()
+  return l.Addr().String()
+}
+
+// per-peer log directory for the crash+restart tests.
+func waldir(tag string, host int) string {
+  return port("wal-" + tag, host) + ".d"
+}
+
+func cleanwal(tag string, n int) {
+  for i := 0; i < n; i++ {
+    os.RemoveAll(waldir(tag, i))
+  }
+}
+
+func makePersistent(pxh []string, tag string, me int) *Paxos {
+  return MakeService("Paxos", pxh, me, nil, nil, waldir(tag, me))
+}
+
+func TestPersistRestart(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+  defer cleanwal("restart", npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("restart", i)
+  }
+  cleanwal("restart", npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = makePersistent(pxh, "restart", i)
+  }
+
+  fmt.Printf("Test: Restarted peer remembers decisions ...\n")
+
+  for seq := 0; seq < 5; seq++ {
+    pxa[seq % npaxos].Start(seq, seq * 10)
+  }
+  for seq := 0; seq < 5; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  pxa[2].Kill()
+  pxa[2] = makePersistent(pxh, "restart", 2)
+
+  for seq := 0; seq < 5; seq++ {
+    decided, v := pxa[2].Status(seq)
+    if !decided || v != seq * 10 {
+      t.Fatalf("restarted peer lost instance %v: decided=%v v=%v", seq, decided, v)
+    }
+  }
+  if pxa[2].Max() != 4 {
+    t.Fatalf("restarted peer has wrong Max() %v", pxa[2].Max())
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted peer remembers Done ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Done(3)
+  }
+  pxa[0].Start(5, "x")
+  waitn(t, pxa, 5, npaxos)
+  pxa[1].Start(6, "y")
+  waitn(t, pxa, 6, npaxos)
+
+  min := pxa[2].Min()
+  pxa[2].Kill()
+  pxa[2] = makePersistent(pxh, "restart", 2)
+  if pxa[2].Min() != min {
+    t.Fatalf("restarted peer has Min() %v, expected %v", pxa[2].Min(), min)
+  }
+  pxa[2].Start(7, "z")
+  waitn(t, pxa, 7, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// a majority accepts a value and crashes before anyone hears
+// that it was decided. after they restart, no other value
+// may be chosen for that instance.
+//
+func TestPersistAccepted(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+  defer cleanwal("accepted", npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("accepted", i)
+  }
+  cleanwal("accepted", npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = makePersistent(pxh, "accepted", i)
+  }
+
+  fmt.Printf("Test: Accepted value survives crash of its majority ...\n")
+
+  // play the part of a proposer that dies after the accept phase.
+  // it uses the lowest possible ballot, so any later proposer will
+  // outrank it.
+  n := Ballot{1, pxh[0]}
+  for i := 0; i < 2; i++ {
+    var preply PrepareReply
+    pxa[i].Prepare(&PrepareArgs{0, n, -1, 0, 0}, &preply)
+    var areply AcceptReply
+    pxa[i].Accept(&AcceptArgs{0, n, "first", -1, 0, 0}, &areply)
+    if !preply.OK || !areply.OK {
+      t.Fatalf("peer %v did not accept", i)
+    }
+  }
+
+  for i := 0; i < 2; i++ {
+    pxa[i].Kill()
+    pxa[i] = makePersistent(pxh, "accepted", i)
+  }
+
+  pxa[2].Start(0, "second")
+  waitn(t, pxa, 0, npaxos)
+  if _, v := pxa[2].Status(0); v != "first" {
+    t.Fatalf("decided %v, but a majority had accepted first", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// a proposer that finds its ballot beaten starts the next one just
+// past the winner, and a restarted peer never reuses a ballot it
+// handed out before the crash.
+//
+func TestBallots(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+  defer cleanwal("ballots", npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("ballots", i)
+  }
+  cleanwal("ballots", npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = makePersistent(pxh, "ballots", i)
+  }
+
+  fmt.Printf("Test: Rejected proposer jumps past the higher ballot ...\n")
+
+  // a proposer that got far ahead, and then died.
+  high := Ballot{1000, pxh[2]}
+  for i := 0; i < npaxos; i++ {
+    var reply PrepareReply
+    pxa[i].Prepare(&PrepareArgs{0, high, -1, 2, 0}, &reply)
+    if !reply.OK {
+      t.Fatalf("peer %v did not promise", i)
+    }
+  }
+
+  pxa[0].Start(0, "x")
+  waitn(t, pxa, 0, npaxos)
+  pxa[0].mu.Lock()
+  b := pxa[0].instances[0].h_accept
+  pxa[0].mu.Unlock()
+  if b != (Ballot{1001, pxh[0]}) {
+    t.Fatalf("decided under ballot %v, expected one just past %v", b, high)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted peer's ballots stay ahead ...\n")
+
+  pxa[0].Kill()
+  pxa[0] = makePersistent(pxh, "ballots", 0)
+  pxa[0].mu.Lock()
+  next := pxa[0].newBallot()
+  pxa[0].mu.Unlock()
+  if !b.Less(next) {
+    t.Fatalf("restarted peer's ballot %v does not beat %v", next, b)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPersistCrashDuringAgreement(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 5
+  const ninst = 20
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+  defer cleanwal("crash", npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("crash", i)
+  }
+  cleanwal("crash", npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = makePersistent(pxh, "crash", i)
+  }
+
+  fmt.Printf("Test: Peers crash and restart mid-agreement ...\n")
+
+  for seq := 0; seq < ninst; seq++ {
+    // competing proposers.
+    for i := 0; i < 3; i++ {
+      pxa[rand.Int() % npaxos].Start(seq, seq * 100 + i)
+    }
+    time.Sleep(time.Duration(rand.Int63() % 40) * time.Millisecond)
+
+    victim := rand.Int() % npaxos
+    pxa[victim].Kill()
+    pxa[victim] = makePersistent(pxh, "crash", victim)
+  }
+
+  // a proposer may have died between accept and decide; finish up.
+  for seq := 0; seq < ninst; seq++ {
+    pxa[seq % npaxos].Start(seq, -1)
+  }
+  for seq := 0; seq < ninst; seq++ {
+    waitmajority(t, pxa, seq)
+  }
+
+  // restart everyone and check nobody changed their mind.
+  before := make([]interface{}, ninst)
+  for seq := 0; seq < ninst; seq++ {
+    for i := 0; i < npaxos; i++ {
+      if decided, v := pxa[i].Status(seq); decided {
+        before[seq] = v
+      }
+    }
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Kill()
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = makePersistent(pxh, "crash", i)
+  }
+  for seq := 0; seq < ninst; seq++ {
+    pxa[0].Start(seq, -2)
+    waitn(t, pxa, seq, npaxos)
+    if _, v := pxa[0].Status(seq); v != before[seq] {
+      t.Fatalf("instance %v changed from %v to %v across restart", seq, before[seq], v)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestCompact(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+  defer cleanwal("compact", npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("compact", i)
+  }
+  cleanwal("compact", npaxos)
+
+  fmt.Printf("Test: Compacted instances are not re-decided ...\n")
+
+  // peer 2 sleeps through the first ten instances.
+  for i := 0; i < npaxos-1; i++ {
+    pxa[i] = makePersistent(pxh, "compact", i)
+  }
+  for seq := 0; seq < 10; seq++ {
+    pxa[0].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos-1)
+  }
+  pxa[0].Compact(5)
+  pxa[1].Compact(5)
+
+  // compaction survives a restart.
+  pxa[1].Kill()
+  pxa[1] = makePersistent(pxh, "compact", 1)
+
+  pxa[2] = makePersistent(pxh, "compact", 2)
+  pxa[2].Start(3, "late")
+  to := 10 * time.Millisecond
+  for iters := 0; pxa[2].Compacted() < 5; iters++ {
+    if iters > 20 {
+      t.Fatalf("peer 2 never heard about the compaction")
+    }
+    time.Sleep(to)
+    to *= 2
+  }
+  if decided, v := pxa[2].Status(3); !decided || v != nil {
+    t.Fatalf("compacted instance reported as %v %v", decided, v)
+  }
+  for i := 0; i < npaxos-1; i++ {
+    if decided, v := pxa[i].Status(3); !decided || v != nil {
+      t.Fatalf("peer %v re-decided compacted instance: %v", i, v)
+    }
+  }
+
+  // instances after the compaction point are still learned normally.
+  pxa[2].Start(7, "late")
+  waitn(t, pxa, 7, npaxos)
+  if _, v := pxa[2].Status(7); v != 7 {
+    t.Fatalf("peer 2 learned %v for instance 7, expected 7", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTornWAL(t *testing.T) {
+  fmt.Printf("Test: Torn log tails are cut off ...\n")
+
+  path := port("torn", 0) + ".wal"
+  os.Remove(path)
+  defer os.Remove(path)
+
+  w, _, err := openWAL(path)
+  if err != nil {
+    t.Fatalf("openWAL: %v", err)
+  }
+  w.append(walRecord{Kind: recDone, Done: 1})
+  w.append(walRecord{Kind: recDone, Done: 2})
+  w.close()
+  st, _ := os.Stat(path)
+  good := st.Size()
+
+  // a header whose length is far past anything written, as a
+  // crash in the middle of a length field might leave.
+  f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+  f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2, 3})
+  f.Close()
+
+  w, recs, err := openWAL(path)
+  if err != nil {
+    t.Fatalf("openWAL: %v", err)
+  }
+  defer w.close()
+  if len(recs) != 2 || recs[1].Done != 2 {
+    t.Fatalf("recovered %v, expected the two good records", recs)
+  }
+  if st, _ := os.Stat(path); st.Size() != good {
+    t.Fatalf("log is %v bytes after recovery, expected %v", st.Size(), good)
+  }
+
+  if err := w.append(walRecord{Kind: recInstance,
+    HValue: string(make([]byte, MaxRecord))}); err == nil {
+    t.Fatalf("appended a record over MaxRecord")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// wait until every live peer agrees on one leader, and return it.
+func waitleader(t *testing.T, pxa []*Paxos) int {
+  for iters := 0; iters < 100; iters++ {
+    leader := -1
+    agree := true
+    for i := 0; i < len(pxa); i++ {
+      if pxa[i] == nil {
+        continue
+      }
+      l, ok := pxa[i].Leader()
+      if !ok {
+        agree = false
+        break
+      }
+      for j := 0; j < len(pxa); j++ {
+        if pxa[j] != nil && pxa[j].peers[j] == l {
+          if leader != -1 && leader != j {
+            agree = false
+          }
+          leader = j
+        }
+      }
+    }
+    if agree && leader != -1 {
+      return leader
+    }
+    time.Sleep(50 * time.Millisecond)
+  }
+  t.Fatalf("peers never agreed on a leader")
+  return -1
+}
+
+func TestLeader(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 5
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("leader", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, nil)
+    pxa[i].EnableLeader()
+  }
+
+  fmt.Printf("Test: Leader skips the prepare phase ...\n")
+
+  leader := waitleader(t, pxa)
+  for seq := 0; seq < 20; seq++ {
+    pxa[leader].Start(seq, seq*10)
+  }
+  for seq := 0; seq < 20; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  // every instance was accepted under the leader's one ballot,
+  // rather than under a fresh proposal number of its own.
+  pxa[leader].mu.Lock()
+  ballot := pxa[leader].ballot
+  pxa[leader].mu.Unlock()
+  for i := 0; i < npaxos; i++ {
+    pxa[i].mu.Lock()
+    for seq := 0; seq < 20; seq++ {
+      if pxa[i].instances[seq].h_accept != ballot {
+        pxa[i].mu.Unlock()
+        t.Fatalf("peer %v accepted instance %v outside the leader's ballot", i, seq)
+      }
+    }
+    pxa[i].mu.Unlock()
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Non-leaders still reach agreement ...\n")
+
+  for seq := 20; seq < 30; seq++ {
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, seq*10+i)
+    }
+  }
+  for seq := 20; seq < 30; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Leader failover ...\n")
+
+  pxa[leader].Kill()
+  pxa[leader] = nil
+  newleader := waitleader(t, pxa)
+  if newleader == leader {
+    t.Fatalf("dead peer %v is still leader", leader)
+  }
+
+  for seq := 30; seq < 40; seq++ {
+    pxa[newleader].Start(seq, seq*10)
+  }
+  for seq := 30; seq < 40; seq++ {
+    waitn(t, pxa, seq, npaxos-1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLease(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "lease"
+  const npaxos = 5
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  defer cleanup(pxa)
+  defer cleanpp(tag, npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    var pxh []string = make([]string, npaxos)
+    for j := 0; j < npaxos; j++ {
+      if j == i {
+        pxh[j] = port(tag, i)
+      } else {
+        pxh[j] = pp(tag, i, j)
+      }
+    }
+    pxa[i] = Make(pxh, i, nil, nil)
+    pxa[i].EnableLeader()
+  }
+  part(t, tag, npaxos, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+
+  fmt.Printf("Test: Leader gets a lease ...\n")
+
+  leader := -1
+  for iters := 0; iters < 100 && leader < 0; iters++ {
+    for i := 0; i < npaxos; i++ {
+      if pxa[i].HasLease() {
+        leader = i
+      }
+    }
+    time.Sleep(50 * time.Millisecond)
+  }
+  if leader < 0 {
+    t.Fatalf("no peer ever held a lease")
+  }
+
+  // a follower's proposal goes through the leader.
+  other := (leader + 1) % npaxos
+  pxa[other].Start(0, "x")
+  waitn(t, pxa, 0, npaxos)
+  pxa[leader].mu.Lock()
+  ballot := pxa[leader].ballot
+  pxa[leader].mu.Unlock()
+  pxa[other].mu.Lock()
+  if pxa[other].instances[0].h_accept != ballot {
+    pxa[other].mu.Unlock()
+    t.Fatalf("follower proposal was not accepted under the leader's ballot")
+  }
+  pxa[other].mu.Unlock()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Nothing is decided behind a leased leader ...\n")
+
+  rest := []int{}
+  for i := 0; i < npaxos; i++ {
+    if i != leader {
+      rest = append(rest, i)
+    }
+  }
+  part(t, tag, npaxos, []int{leader}, rest, []int{})
+  pxa[other].Start(1, "y")
+
+  for iters := 0; iters < 200; iters++ {
+    decided := ndecided(t, pxa, 1) > 0
+    if decided && pxa[leader].HasLease() {
+      t.Fatalf("instance decided while the old leader still held its lease")
+    }
+    if decided {
+      break
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  waitn(t, pxa, 1, npaxos-1)
+  if pxa[leader].HasLease() {
+    t.Fatalf("isolated leader still holds a lease")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Old leader catches up after the partition heals ...\n")
+
+  part(t, tag, npaxos, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+  pxa[leader].Start(1, "z")
+  waitn(t, pxa, 1, npaxos)
+  if _, v := pxa[leader].Status(1); v != "y" {
+    t.Fatalf("old leader learned %v for instance 1, expected y", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestReconfigure(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "reconfig"
+  const npaxos = 5
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+  defer cleanwal(tag, npaxos)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port(tag, i)
+  }
+  cleanwal(tag, npaxos)
+
+  // peers 0, 1 and 2 hand over to 2, 3 and 4 at instance 5.
+  oldpeers := pxh[0:3]
+  newpeers := pxh[2:5]
+  start := func(i int, peers []string) *Paxos {
+    for j, peer := range peers {
+      if peer == pxh[i] {
+        px := MakeService("Paxos", peers, j, nil, nil, waldir(tag, i))
+        px.EnableLeader()
+        return px
+      }
+    }
+    t.Fatalf("peer %v is not among %v", i, peers)
+    return nil
+  }
+  for i := 0; i < 3; i++ {
+    pxa[i] = start(i, oldpeers)
+  }
+
+  fmt.Printf("Test: New peers take over from a reconfiguration point ...\n")
+
+  for seq := 0; seq < 5; seq++ {
+    pxa[seq % 3].Start(seq, seq * 10)
+    waitn(t, pxa[0:3], seq, 3)
+  }
+  // peer 1 misses the change.
+  pxa[0].Reconfigure(5, newpeers)
+  pxa[2].Reconfigure(5, newpeers)
+  for i := 3; i < npaxos; i++ {
+    // the newcomers get instances < 5 some other way.
+    pxa[i] = start(i, newpeers)
+    pxa[i].Reconfigure(5, newpeers)
+    pxa[i].Compact(4)
+  }
+
+  if p := pxa[2].Peers(4); len(p) != 3 || p[0] != pxh[0] {
+    t.Fatalf("instance 4 moved to the new peers: %v", p)
+  }
+  if p := pxa[2].Peers(5); len(p) != 3 || p[0] != pxh[2] {
+    t.Fatalf("instance 5 stayed with the old peers: %v", p)
+  }
+
+  // having missed it, peer 1 gets nothing decided with the old peers.
+  pxa[1].Start(5, "stale")
+  time.Sleep(time.Second)
+  if decided, v := pxa[1].Status(5); decided {
+    t.Fatalf("peer that missed the change decided %v", v)
+  }
+
+  // the old peers are gone for good; the new ones carry on alone.
+  pxa[0].Kill()
+  pxa[0] = nil
+  pxa[1].Kill()
+  pxa[1] = nil
+  for seq := 5; seq < 10; seq++ {
+    pxa[3 + seq % 2].Start(seq, seq * 10)
+    waitn(t, pxa[2:5], seq, 3)
+  }
+  if _, v := pxa[2].Status(3); v != 30 {
+    t.Fatalf("instance 3 is %v after the change, expected 30", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A reconfiguration survives a restart ...\n")
+
+  pxa[2].Kill()
+  pxa[2] = start(2, oldpeers)
+  if p := pxa[2].Peers(5); len(p) != 3 || p[0] != pxh[2] {
+    t.Fatalf("restarted peer forgot the new peers: %v", p)
+  }
+
+  // without peer 4, instance 10 needs the restarted peer.
+  pxa[4].Kill()
+  pxa[4] = nil
+  pxa[3].Start(10, 100)
+  waitn(t, pxa, 10, 2)
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,356 @@
+package paxos
+
+//
+// Write-ahead log, so that a Paxos peer can crash, restart, and
+// still keep the promises it made before the crash.
+//
+// Every change to an instance (h_prepare, h_accept, h_value,
+// decided), every change to a Done value and every change of peers
+// is appended to the log and fsync()ed before the peer answers the
+// message that caused it. Make() replays the log on restart.
+//
+// Each record is framed as
+//   length (4 bytes) | crc32 of payload (4 bytes) | gob payload
+// so a record torn by a crash is detected and cut off during
+// recovery; so is a length over MaxRecord, rather than trusted for
+// an allocation. Every CompactEvery records the log is rewritten
+// from the in-memory state, which drops forgotten instances.
+//
+
+import "bytes"
+import "encoding/binary"
+import "encoding/gob"
+import "errors"
+import "hash/crc32"
+import "io"
+import "math"
+import "os"
+import "path/filepath"
+
+const CompactEvery = 1000
+
+// the largest payload a record may have.
+const MaxRecord = 64 << 20
+
+const (
+	recInstance = iota
+	recDone
+	recCompact
+	recPromise
+	recConfig
+)
+
+var errTorn = errors.New("paxos: torn wal record")
+var errTooBig = errors.New("paxos: wal record too big")
+
+type walRecord struct {
+	Kind int
+
+	// recInstance
+	Seq      int
+	HPrepare Ballot
+	HAccept  Ballot
+	HValue   interface{}
+	Decided  bool
+	VDecided interface{}
+
+	// recDone. Peer is "" for this peer's own Done() value.
+	Peer string
+	Done int
+
+	// recCompact uses Seq: instances <= Seq were compacted.
+	// recPromise uses Seq and HPrepare: ballot HPrepare was promised
+	// to a leader for every instance >= Seq.
+
+	// recConfig uses Seq: instances >= Seq are agreed among Peers.
+	Peers []string
+}
+
+type wal struct {
+	f     *os.File
+	path  string
+	nrecs int // records appended since the last rewrite
+}
+
+// Open the log at path, creating it if needed, and return the
+// records that survived. A torn tail is truncated away.
+func openWAL(path string) (*wal, []walRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recs := make([]walRecord, 0)
+	var good int64 = 0
+	for {
+		r, n, err := readRecord(f)
+		if err != nil {
+			break
+		}
+		recs = append(recs, r)
+		good += n
+	}
+
+	// cut off whatever a crash left half-written.
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &wal{f, path, len(recs)}, recs, nil
+}
+
+func readRecord(r io.Reader) (walRecord, int64, error) {
+	var rec walRecord
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return rec, 0, err
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	sum := binary.BigEndian.Uint32(hdr[4:8])
+	if n > MaxRecord {
+		return rec, 0, errTorn
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return rec, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return rec, 0, errTorn
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+		return rec, 0, err
+	}
+	return rec, int64(len(hdr)) + int64(n), nil
+}
+
+func encodeRecord(buf *bytes.Buffer, rec walRecord) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(rec); err != nil {
+		return err
+	}
+	if payload.Len() > MaxRecord {
+		return errTooBig
+	}
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	buf.Write(hdr[:])
+	buf.Write(payload.Bytes())
+	return nil
+}
+
+// Durably append one record.
+func (w *wal) append(rec walRecord) error {
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	var buf bytes.Buffer
+	if err := encodeRecord(&buf, rec); err != nil {
+		return err
+	}
+	if _, err := w.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.nrecs++
+	return w.f.Sync()
+}
+
+// Atomically replace the whole log with recs.
+func (w *wal) rewrite(recs []walRecord) error {
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		if err := encodeRecord(&buf, rec); err != nil {
+			return err
+		}
+	}
+
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		f.Close()
+		return err
+	}
+	syncDir(filepath.Dir(w.path))
+
+	w.f.Close()
+	w.f = f
+	w.nrecs = 0
+	return nil
+}
+
+func (w *wal) close() {
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+}
+
+// make a rename durable.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+//
+// Paxos side of the log. All of these are called with px.mu held.
+//
+
+func instanceRecord(seq int, inst Instance) walRecord {
+	return walRecord{Kind: recInstance, Seq: seq,
+		HPrepare: inst.h_prepare, HAccept: inst.h_accept, HValue: inst.h_value,
+		Decided: inst.decided, VDecided: inst.v_decided}
+}
+
+// record instance seq before replying about it.
+func (px *Paxos) logInstance(seq int) error {
+	if px.wal == nil {
+		return nil
+	}
+	if err := px.wal.append(instanceRecord(seq, px.instances[seq])); err != nil {
+		return err
+	}
+	return px.maybeCompact()
+}
+
+// record a Done value; peer is "" for our own.
+func (px *Paxos) logDone(peer string, done int) error {
+	if px.wal == nil {
+		return nil
+	}
+	if err := px.wal.append(walRecord{Kind: recDone, Peer: peer, Done: done}); err != nil {
+		return err
+	}
+	return px.maybeCompact()
+}
+
+// record a Compact() before forgetting anything for good.
+func (px *Paxos) logCompact(seq int) error {
+	if px.wal == nil {
+		return nil
+	}
+	if err := px.wal.append(walRecord{Kind: recCompact, Seq: seq}); err != nil {
+		return err
+	}
+	return px.maybeCompact()
+}
+
+// record a promise made to a leader before replying to it.
+func (px *Paxos) logPromise() error {
+	if px.wal == nil {
+		return nil
+	}
+	rec := walRecord{Kind: recPromise, Seq: px.promised_from, HPrepare: px.promised}
+	if err := px.wal.append(rec); err != nil {
+		return err
+	}
+	return px.maybeCompact()
+}
+
+// record a change of peers.
+func (px *Paxos) logConfig(from int, peers []string) error {
+	if px.wal == nil {
+		return nil
+	}
+	if err := px.wal.append(walRecord{Kind: recConfig, Seq: from, Peers: peers}); err != nil {
+		return err
+	}
+	return px.maybeCompact()
+}
+
+func (px *Paxos) maybeCompact() error {
+	if px.wal.nrecs < CompactEvery {
+		return nil
+	}
+
+	recs := make([]walRecord, 0, len(px.instances)+len(px.done_values)+
+		len(px.configs)+3)
+	// the peers first, so that recovery knows whose Done values to keep.
+	for _, c := range px.configs[1:] {
+		recs = append(recs, walRecord{Kind: recConfig, Seq: c.from, Peers: c.peers})
+	}
+	recs = append(recs, walRecord{Kind: recDone, Peer: "", Done: px.my_done})
+	recs = append(recs, walRecord{Kind: recCompact, Seq: px.compacted})
+	recs = append(recs, walRecord{Kind: recPromise, Seq: px.promised_from,
+		HPrepare: px.promised})
+	for peer, done := range px.done_values {
+		recs = append(recs, walRecord{Kind: recDone, Peer: peer, Done: done})
+	}
+	for seq, inst := range px.instances {
+		recs = append(recs, instanceRecord(seq, inst))
+	}
+	return px.wal.rewrite(recs)
+}
+
+// rebuild instances and Done values from the log.
+func (px *Paxos) recover(recs []walRecord) {
+	for _, r := range recs {
+		switch r.Kind {
+		case recInstance:
+			px.instances[r.Seq] = Instance{r.HPrepare, r.HAccept, r.HValue,
+				r.Decided, r.VDecided}
+			// our next ballot must beat any we used before the
+			// crash; we always promised our own first.
+			px.seeBallot(r.HPrepare)
+			if r.Seq > px.seq {
+				px.seq = r.Seq
+			}
+		case recDone:
+			if r.Peer == "" {
+				if r.Done > px.my_done {
+					px.my_done = r.Done
+				}
+			} else if done, ok := px.done_values[r.Peer]; ok && r.Done > done {
+				px.done_values[r.Peer] = r.Done
+			}
+		case recCompact:
+			if r.Seq > px.compacted {
+				px.compacted = r.Seq
+			}
+		case recPromise:
+			if px.promised.Less(r.HPrepare) {
+				px.promised = r.HPrepare
+				px.promised_from = r.Seq
+			}
+			px.seeBallot(r.HPrepare)
+		case recConfig:
+			px.reconfigure(r.Seq, r.Peers)
+		}
+	}
+	px.noteCompactedLocked(px.compacted)
+
+	// forget whatever every peer was done with before the crash.
+	min_done := math.Inf(1)
+	for _, peerval := range px.done_values {
+		if float64(peerval) < min_done {
+			min_done = float64(peerval)
+		}
+	}
+	px.min_done = min_done
+	for seq := range px.instances {
+		if float64(seq) < min_done || seq <= px.compacted {
+			delete(px.instances, seq)
+		}
+	}
+}
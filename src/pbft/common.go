@@ -0,0 +1,159 @@
+package pbft
+
+import "crypto/ed25519"
+import "crypto/sha256"
+import "bytes"
+import "encoding/gob"
+import "encoding/hex"
+import "fmt"
+
+// the primary assigns Value to instance Seq in View.
+type PrePrepare struct {
+	View   int
+	Seq    int
+	Digest string
+	Value  interface{}
+	Sig    []byte // by the primary of View
+}
+
+// Sender accepted the primary's pre-prepare for Seq in View.
+type Prepare struct {
+	View   int
+	Seq    int
+	Digest string
+	Sender int
+	Sig    []byte
+}
+
+// Sender saw 2f+1 replicas prepare Digest for Seq in View.
+type Commit struct {
+	View   int
+	Seq    int
+	Digest string
+	Sender int
+	Sig    []byte
+}
+
+// proof that Digest was prepared for Seq in PrePrepare.View: the
+// pre-prepare and 2f matching prepares from other replicas.
+type Certificate struct {
+	PrePrepare PrePrepare
+	Prepares   []Prepare
+}
+
+// Sender gives up on the primary of View-1 and wants View.
+type ViewChange struct {
+	View      int
+	Sender    int
+	Compacted int           // Sender has applied and forgotten instances <= this
+	Prepared  []Certificate // for every instance > Compacted it prepared
+	Sig       []byte
+}
+
+// the primary of View starts it, with the view changes that justify
+// it and the pre-prepares that carry over from earlier views.
+type NewView struct {
+	View        int
+	ViewChanges []ViewChange
+	PrePrepares []PrePrepare
+	Sig         []byte
+}
+
+// an instance that carried over with no value prepared for it.
+type Null struct {
+}
+
+type RequestArgs struct {
+	Seq   int
+	Value interface{}
+}
+
+type RequestReply struct {
+}
+
+type PrePrepareReply struct {
+}
+
+type PrepareReply struct {
+}
+
+type CommitReply struct {
+}
+
+type ViewChangeReply struct {
+}
+
+type NewViewReply struct {
+}
+
+// ask a replica how instance Seq turned out.
+type FetchArgs struct {
+	Seq int
+}
+
+type FetchReply struct {
+	Decided   bool
+	Value     interface{}
+	Commits   []Commit // 2f+1 matching commits prove Value
+	Compacted int
+}
+
+type PubKeyArgs struct {
+}
+
+type PubKeyReply struct {
+	Key []byte
+}
+
+// the digest of a value, as signed in place of the value itself.
+func digest(v interface{}) string {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		panic(fmt.Sprintf("pbft: cannot encode %v: %v", v, err))
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+//
+// what each message's signature covers.
+//
+
+func (m *PrePrepare) signed() []byte {
+	return []byte(fmt.Sprintf("pre-prepare %d %d %s", m.View, m.Seq, m.Digest))
+}
+
+func (m *Prepare) signed() []byte {
+	return []byte(fmt.Sprintf("prepare %d %d %s %d", m.View, m.Seq, m.Digest,
+		m.Sender))
+}
+
+func (m *Commit) signed() []byte {
+	return []byte(fmt.Sprintf("commit %d %d %s %d", m.View, m.Seq, m.Digest,
+		m.Sender))
+}
+
+func (m *ViewChange) signed() []byte {
+	s := fmt.Sprintf("view-change %d %d %d", m.View, m.Sender, m.Compacted)
+	for _, c := range m.Prepared {
+		s += fmt.Sprintf(" %d/%d/%s", c.PrePrepare.Seq, c.PrePrepare.View,
+			c.PrePrepare.Digest)
+	}
+	return []byte(s)
+}
+
+func (m *NewView) signed() []byte {
+	s := fmt.Sprintf("new-view %d", m.View)
+	for _, vc := range m.ViewChanges {
+		s += fmt.Sprintf(" vc/%d", vc.Sender)
+	}
+	for _, pp := range m.PrePrepares {
+		s += fmt.Sprintf(" %d/%s", pp.Seq, pp.Digest)
+	}
+	return []byte(s)
+}
+
+func verify(key ed25519.PublicKey, msg []byte, sig []byte) bool {
+	return key != nil && len(sig) == ed25519.SignatureSize &&
+		ed25519.Verify(key, msg, sig)
+}
@@ -0,0 +1,809 @@
+package pbft
+
+//
+// PBFT-style agreement on a sequence of values, for groups whose
+// members may lie. It has the same interface as the paxos package,
+// so an application can use either one: with n = 3f+1 peers it
+// agrees on every instance as long as at most f peers are faulty,
+// whatever those f peers do.
+//
+// The primary of the current view, peers[view % n], orders the
+// instances: Start(seq, v) hands v to the primary, which assigns it
+// to seq with a signed pre-prepare unless seq is taken. The peers
+// then prepare and commit the value, each with its own signed
+// message, and a peer decides once 2f+1 peers have committed it. A
+// peer whose Start()ed instance is not decided in time asks for a new
+// view; see viewchange.go.
+//
+// Every message is signed with ed25519. A peer's public key is
+// fetched from the peer's own address, so it is exactly as good as
+// the transport's addressing, which is what Whanau trusts anyway.
+// Given a dir, a peer keeps its key pair there and signs with the
+// same key after a restart; one that has no dir comes back with a
+// new key, which the others fetch again once its signatures stop
+// checking out with the old one.
+//
+// A peer that is behind fetches decided instances from the others,
+// with 2f+1 signed commits as proof. Instances that f+1 peers say
+// they have compacted are reported as decided with a nil value, and
+// the application must get their effect elsewhere, from f+1 peers
+// that agree.
+//
+// There is no log on disk, beyond the key: a peer that crashes comes
+// back empty, and counts as one of the f faulty peers until it has
+// caught up. Nor can the set of peers change.
+//
+// The application interface:
+//
+// px = pbft.Make(peers []string, me int, rpcs *rpc.Server, tr transport.Transport)
+// px = pbft.MakeService(service string, peers, me, rpcs, tr, dir) -- see paxos
+// px.Start(seq int, v interface{}) -- start agreement on instance seq
+// px.Status(seq int) (decided bool, v interface{})
+// px.Done(seq int) -- ok to forget instances <= seq; a no-op, see Compact
+// px.Max() int -- highest instance seq known, or -1
+// px.Min() int -- instances before this seq have been forgotten
+// px.Compact(seq int) -- forget instances <= seq now
+// px.Compacted() int -- highest seq f+1 peers say they compacted
+// px.Leader() (string, bool) -- the current primary
+// px.HasLease() bool -- always false: no peer may answer for the others
+//
+
+import "crypto/ed25519"
+import crand "crypto/rand"
+import "encoding/gob"
+import "errors"
+import "fmt"
+import "log"
+import "net"
+import "net/rpc"
+import "os"
+import "path/filepath"
+import "sort"
+import "sync"
+import "syscall"
+import "time"
+import "transport"
+
+const tickInterval = 50 * time.Millisecond
+const resendInterval = 250 * time.Millisecond
+const viewTimeout = time.Second // before we give up on a primary; doubles
+
+type PBFT struct {
+	mu      sync.Mutex
+	l       net.Listener
+	dead    bool
+	peers   []string
+	me      int // index into peers[]
+	f       int // faulty peers we tolerate
+	tr      transport.Transport
+	service string
+
+	key     ed25519.PrivateKey
+	pubkeys []ed25519.PublicKey // nil until fetched
+	fetched []time.Time         // when we last fetched each one
+
+	view         int
+	changing     bool      // waiting for the new-view of view
+	change_start time.Time // when we asked for it
+	timeout      time.Duration
+	view_changes map[int]map[int]ViewChange // by view, then sender
+	new_view     int                        // last view we sent a new-view for
+	started      *NewView                   // the one that started our view
+
+	instances map[int]*instance
+	pending   map[int]*request // Start()ed here and not decided yet
+
+	max            int
+	compacted      int // instances <= compacted are forgotten here
+	compacted_seen int // f+1 peers say they forgot instances <= this
+
+	faulty bool // for testing: lie in every message we send
+}
+
+type instance struct {
+	view     int    // of the pre-prepare we accepted
+	digest   string // its digest
+	value    interface{}
+	pp       *PrePrepare
+	prepares map[int]Prepare // latest from each sender
+	commits  map[int]Commit  // latest from each sender
+	prepared bool            // in view
+	cert     *Certificate    // the latest view we prepared in
+
+	decided   bool
+	v_decided interface{}
+	proof     []Commit
+}
+
+type request struct {
+	value   interface{}
+	started time.Time
+	sent    time.Time
+}
+
+// call() sends an RPC, as in the paxos package.
+func call(tr transport.Transport, srv string, name string,
+	args interface{}, reply interface{}) bool {
+	conn, err := tr.Dial(srv)
+	if err != nil {
+		if !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ECONNREFUSED) {
+			fmt.Printf("pbft Dial() failed: %v for server %v\n", err, srv)
+		}
+		return false
+	}
+	c := rpc.NewClient(conn)
+	defer c.Close()
+
+	err = c.Call(name, args, reply)
+	if err == nil {
+		return true
+	}
+	return false
+}
+
+func (px *PBFT) primary(view int) int {
+	return view % len(px.peers)
+}
+
+// the instance seq, created if need be. called with mu held.
+func (px *PBFT) get(seq int) *instance {
+	inst, ok := px.instances[seq]
+	if !ok {
+		inst = &instance{view: -1}
+		inst.prepares = make(map[int]Prepare)
+		inst.commits = make(map[int]Commit)
+		px.instances[seq] = inst
+	}
+	return inst
+}
+
+// the public key of peer i, fetched from its address the first time.
+func (px *PBFT) pubkey(i int) ed25519.PublicKey {
+	if i < 0 || i >= len(px.peers) {
+		return nil
+	}
+	px.mu.Lock()
+	key := px.pubkeys[i]
+	px.mu.Unlock()
+	if key != nil {
+		return key
+	}
+	return px.fetchKey(i)
+}
+
+// ask peer i for its public key, and keep it if it is one.
+func (px *PBFT) fetchKey(i int) ed25519.PublicKey {
+	px.mu.Lock()
+	px.fetched[i] = time.Now()
+	px.mu.Unlock()
+
+	var reply PubKeyReply
+	if !call(px.tr, px.peers[i], px.service+".PubKey", &PubKeyArgs{}, &reply) ||
+		len(reply.Key) != ed25519.PublicKeySize {
+		return nil
+	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.pubkeys[i] = ed25519.PublicKey(reply.Key)
+	return px.pubkeys[i]
+}
+
+// true if peer i signed msg. i may have restarted with a new key
+// since we fetched its old one, so a bad signature sends us back for
+// the key, though no more than once every resendInterval, or a liar
+// could keep us fetching.
+func (px *PBFT) verifyFrom(i int, msg []byte, sig []byte) bool {
+	if verify(px.pubkey(i), msg, sig) {
+		return true
+	}
+	if i < 0 || i >= len(px.peers) || i == px.me {
+		return false
+	}
+	px.mu.Lock()
+	stale := time.Since(px.fetched[i]) >= resendInterval
+	px.mu.Unlock()
+	return stale && verify(px.fetchKey(i), msg, sig)
+}
+
+func (px *PBFT) sign(msg []byte) []byte {
+	return ed25519.Sign(px.key, msg)
+}
+
+// send a message to every other peer, without waiting.
+func (px *PBFT) broadcast(method string, args interface{}) {
+	for i, peer := range px.peers {
+		if i != px.me {
+			go call(px.tr, peer, px.service+"."+method, args, new(struct{}))
+		}
+	}
+}
+
+//
+// the application wants agreement on instance seq, with value v.
+// returns right away; Status() tells when it is decided, perhaps
+// with a different value.
+//
+func (px *PBFT) Start(seq int, v interface{}) {
+	px.mu.Lock()
+	behind := seq < px.max
+	if seq > px.max {
+		px.max = seq
+	}
+	px.mu.Unlock()
+
+	args := &RequestArgs{seq, v}
+	px.Request(args, &RequestReply{})
+	px.broadcast("Request", args)
+	if behind {
+		// the others may have decided it long ago.
+		go px.learn(seq)
+	}
+}
+
+//
+// a peer wants v at seq. the primary orders it; the others keep an
+// eye on the primary until seq is decided.
+//
+func (px *PBFT) Request(args *RequestArgs, reply *RequestReply) error {
+	px.mu.Lock()
+	if px.forgotten(args.Seq) {
+		px.mu.Unlock()
+		return nil
+	}
+	inst := px.get(args.Seq)
+	if inst.decided {
+		px.mu.Unlock()
+		return nil
+	}
+	if _, ok := px.pending[args.Seq]; !ok {
+		px.pending[args.Seq] = &request{args.Value, time.Now(), time.Now()}
+	}
+	if px.primary(px.view) != px.me || px.changing {
+		px.mu.Unlock()
+		return nil
+	}
+	if inst.pp != nil && inst.view == px.view {
+		// seq is taken; say so again, in case a peer missed it.
+		pp := *inst.pp
+		px.mu.Unlock()
+		px.sendPrePrepare(&pp)
+		return nil
+	}
+	pp := &PrePrepare{px.view, args.Seq, digest(args.Value), args.Value, nil}
+	pp.Sig = px.sign(pp.signed())
+	px.mu.Unlock()
+
+	px.acceptPrePrepare(pp)
+	px.sendPrePrepare(pp)
+	return nil
+}
+
+func (px *PBFT) sendPrePrepare(pp *PrePrepare) {
+	if !px.faulty {
+		px.broadcast("PrePrepare", pp)
+		return
+	}
+	// a lying primary tells every peer something else.
+	for i, peer := range px.peers {
+		if i != px.me {
+			lie := &PrePrepare{pp.View, pp.Seq, "", fmt.Sprintf("lie-%d", i), nil}
+			lie.Digest = digest(lie.Value)
+			lie.Sig = px.sign(lie.signed())
+			go call(px.tr, peer, px.service+".PrePrepare", lie, &PrePrepareReply{})
+		}
+	}
+}
+
+// true if pp is a well-formed pre-prepare from the primary of its view.
+func (px *PBFT) validPrePrepare(pp *PrePrepare) bool {
+	return px.verifyFrom(px.primary(pp.View), pp.signed(), pp.Sig) &&
+		digest(pp.Value) == pp.Digest
+}
+
+func (px *PBFT) PrePrepare(args *PrePrepare, reply *PrePrepareReply) error {
+	px.mu.Lock()
+	current := args.View == px.view && !px.changing
+	px.mu.Unlock()
+	if !current || !px.validPrePrepare(args) {
+		return nil
+	}
+	px.acceptPrePrepare(args)
+	return nil
+}
+
+// take the primary's word for seq in pp.View, unless it already told
+// us something else, and prepare it.
+func (px *PBFT) acceptPrePrepare(pp *PrePrepare) {
+	px.mu.Lock()
+	if px.forgotten(pp.Seq) || pp.View != px.view {
+		px.mu.Unlock()
+		return
+	}
+	inst := px.get(pp.Seq)
+	if inst.pp != nil && inst.view == pp.View && inst.digest != pp.Digest {
+		// the primary is lying; the view change will deal with it.
+		px.mu.Unlock()
+		return
+	}
+	if inst.view > pp.View {
+		px.mu.Unlock()
+		return
+	}
+	if inst.view < pp.View {
+		inst.view = pp.View
+		inst.digest = pp.Digest
+		inst.value = pp.Value
+		inst.pp = pp
+		inst.prepared = false
+	}
+	if pp.Seq > px.max {
+		px.max = pp.Seq
+	}
+
+	var p *Prepare
+	if px.me != px.primary(pp.View) {
+		p = &Prepare{pp.View, pp.Seq, pp.Digest, px.me, nil}
+	}
+	c := px.checkPrepared(pp.Seq, inst)
+	if c == nil && inst.prepared {
+		// we've been here before; say it all again for whoever
+		// missed it.
+		c = px.commitFor(pp.Seq, inst)
+	}
+	px.mu.Unlock()
+
+	if p != nil {
+		px.sendPrepare(p)
+	}
+	if c != nil {
+		px.sendCommit(c)
+	}
+}
+
+func (px *PBFT) sendPrepare(p *Prepare) {
+	if px.faulty {
+		p.Digest = digest("lie")
+	}
+	p.Sig = px.sign(p.signed())
+	px.Prepare(p, &PrepareReply{})
+	px.broadcast("Prepare", p)
+}
+
+func (px *PBFT) sendCommit(c *Commit) {
+	if px.faulty {
+		c.Digest = digest("lie")
+	}
+	c.Sig = px.sign(c.signed())
+	px.Commit(c, &CommitReply{})
+	px.broadcast("Commit", c)
+}
+
+func (px *PBFT) Prepare(args *Prepare, reply *PrepareReply) error {
+	if !px.verifyFrom(args.Sender, args.signed(), args.Sig) {
+		return nil
+	}
+
+	px.mu.Lock()
+	if args.Seq <= px.compacted {
+		px.mu.Unlock()
+		return nil
+	}
+	inst := px.get(args.Seq)
+	if prev, ok := inst.prepares[args.Sender]; !ok || prev.View <= args.View {
+		inst.prepares[args.Sender] = *args
+	}
+	c := px.checkPrepared(args.Seq, inst)
+	px.mu.Unlock()
+
+	if c != nil {
+		px.sendCommit(c)
+	}
+	return nil
+}
+
+// if inst has just become prepared, keep the certificate and return
+// our commit. called with mu held.
+func (px *PBFT) checkPrepared(seq int, inst *instance) *Commit {
+	if inst.pp == nil || inst.prepared {
+		return nil
+	}
+	prepares := make([]Prepare, 0)
+	for sender, p := range inst.prepares {
+		if sender != px.primary(inst.view) && p.View == inst.view &&
+			p.Digest == inst.digest {
+			prepares = append(prepares, p)
+		}
+	}
+	if len(prepares) < 2*px.f {
+		return nil
+	}
+	inst.prepared = true
+	inst.cert = &Certificate{*inst.pp, prepares[:2*px.f]}
+	return px.commitFor(seq, inst)
+}
+
+// called with mu held.
+func (px *PBFT) commitFor(seq int, inst *instance) *Commit {
+	return &Commit{inst.view, seq, inst.digest, px.me, nil}
+}
+
+func (px *PBFT) Commit(args *Commit, reply *CommitReply) error {
+	if !px.verifyFrom(args.Sender, args.signed(), args.Sig) {
+		return nil
+	}
+
+	px.mu.Lock()
+	if args.Seq <= px.compacted {
+		px.mu.Unlock()
+		return nil
+	}
+	inst := px.get(args.Seq)
+	if prev, ok := inst.commits[args.Sender]; !ok || prev.View <= args.View {
+		inst.commits[args.Sender] = *args
+	}
+	if inst.decided {
+		px.mu.Unlock()
+		return nil
+	}
+
+	// 2f+1 commits for one digest in one view settle the instance.
+	proof := matching(inst.commits, args.View, args.Digest)
+	if len(proof) < 2*px.f+1 {
+		px.mu.Unlock()
+		return nil
+	}
+	var value interface{}
+	known := false
+	if inst.digest == args.Digest {
+		value, known = inst.value, true
+	} else if inst.cert != nil && inst.cert.PrePrepare.Digest == args.Digest {
+		value, known = inst.cert.PrePrepare.Value, true
+	}
+	if known {
+		px.decide(args.Seq, inst, value, proof[:2*px.f+1])
+	}
+	px.mu.Unlock()
+
+	if !known {
+		// we never saw the value; someone who did can show it.
+		go px.learn(args.Seq)
+	}
+	return nil
+}
+
+func matching(commits map[int]Commit, view int, d string) []Commit {
+	proof := make([]Commit, 0)
+	for _, c := range commits {
+		if c.View == view && c.Digest == d {
+			proof = append(proof, c)
+		}
+	}
+	return proof
+}
+
+// called with mu held.
+func (px *PBFT) decide(seq int, inst *instance, value interface{},
+	proof []Commit) {
+	inst.decided = true
+	inst.v_decided = value
+	inst.proof = proof
+	delete(px.pending, seq)
+	if seq > px.max {
+		px.max = seq
+	}
+	px.timeout = viewTimeout
+}
+
+// ask the others how seq turned out.
+func (px *PBFT) learn(seq int) {
+	claims := make([]int, 0)
+	for i, peer := range px.peers {
+		if i == px.me {
+			continue
+		}
+		var reply FetchReply
+		if !call(px.tr, peer, px.service+".Fetch", &FetchArgs{seq}, &reply) {
+			continue
+		}
+		claims = append(claims, reply.Compacted)
+		if reply.Decided && px.validProof(seq, reply.Value, reply.Commits) {
+			px.mu.Lock()
+			if seq > px.compacted {
+				if inst := px.get(seq); !inst.decided {
+					px.decide(seq, inst, reply.Value, reply.Commits)
+				}
+			}
+			px.mu.Unlock()
+			return
+		}
+	}
+
+	// f+1 claims include an honest one.
+	sort.Sort(sort.Reverse(sort.IntSlice(claims)))
+	if len(claims) > px.f {
+		px.noteCompacted(claims[px.f])
+	}
+}
+
+// true if commits are 2f+1 signed commits of value at seq, in one view.
+func (px *PBFT) validProof(seq int, value interface{}, commits []Commit) bool {
+	if len(commits) == 0 {
+		return false
+	}
+	d := digest(value)
+	senders := make(map[int]bool)
+	for _, c := range commits {
+		if c.Seq != seq || c.View != commits[0].View || c.Digest != d ||
+			senders[c.Sender] || !px.verifyFrom(c.Sender, c.signed(), c.Sig) {
+			return false
+		}
+		senders[c.Sender] = true
+	}
+	return len(senders) >= 2*px.f+1
+}
+
+func (px *PBFT) Fetch(args *FetchArgs, reply *FetchReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	reply.Compacted = px.compacted
+	if inst, ok := px.instances[args.Seq]; ok && inst.decided {
+		reply.Decided = true
+		reply.Value = inst.v_decided
+		reply.Commits = inst.proof
+	}
+	return nil
+}
+
+func (px *PBFT) PubKey(args *PubKeyArgs, reply *PubKeyReply) error {
+	reply.Key = []byte(px.key.Public().(ed25519.PublicKey))
+	return nil
+}
+
+// true if seq was decided long ago, and some honest peer has forgotten
+// it; a primary that orders it again is up to no good. called with mu
+// held.
+func (px *PBFT) forgotten(seq int) bool {
+	return seq <= px.compacted || seq <= px.compacted_seen
+}
+
+func (px *PBFT) noteCompacted(seq int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if seq > px.compacted_seen {
+		px.compacted_seen = seq
+	}
+	if seq > px.max {
+		px.max = seq
+	}
+}
+
+func (px *PBFT) Status(seq int) (bool, interface{}) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if inst, ok := px.instances[seq]; ok && inst.decided {
+		return true, inst.v_decided
+	}
+	if seq <= px.compacted || seq <= px.compacted_seen {
+		return true, nil
+	}
+	return false, nil
+}
+
+func (px *PBFT) Max() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.max
+}
+
+func (px *PBFT) Done(seq int) {
+}
+
+func (px *PBFT) Min() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.compacted + 1
+}
+
+//
+// forget instances <= seq. peers that are behind can no longer
+// fetch them from us.
+//
+func (px *PBFT) Compact(seq int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	if seq <= px.compacted {
+		return
+	}
+	px.compacted = seq
+	for i := range px.instances {
+		if i <= seq {
+			delete(px.instances, i)
+		}
+	}
+	for i := range px.pending {
+		if i <= seq {
+			delete(px.pending, i)
+		}
+	}
+}
+
+func (px *PBFT) Compacted() int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.compacted > px.compacted_seen {
+		return px.compacted
+	}
+	return px.compacted_seen
+}
+
+func (px *PBFT) Leader() (string, bool) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.changing {
+		return "", false
+	}
+	return px.peers[px.primary(px.view)], true
+}
+
+func (px *PBFT) HasLease() bool {
+	return false
+}
+
+// the set of peers is fixed, so this does nothing; a faulty peer
+// must not be able to crash the others by asking for a change.
+func (px *PBFT) Reconfigure(from int, peers []string) {
+}
+
+func (px *PBFT) tick() {
+	for !px.dead {
+		time.Sleep(tickInterval)
+
+		px.mu.Lock()
+		now := time.Now()
+		resend := make(map[int]interface{})
+		stuck := false
+		for seq, r := range px.pending {
+			if now.Sub(r.sent) > resendInterval {
+				r.sent = now
+				resend[seq] = r.value
+			}
+			if !px.changing && now.Sub(r.started) > px.timeout {
+				stuck = true
+			}
+		}
+		if px.changing && now.Sub(px.change_start) > px.timeout {
+			// the new primary isn't getting anywhere either.
+			stuck = true
+		}
+		view := px.view
+		px.mu.Unlock()
+
+		if stuck {
+			px.startViewChange(view + 1)
+			continue
+		}
+		for seq, v := range resend {
+			px.broadcast("Request", &RequestArgs{seq, v})
+			go px.learn(seq)
+		}
+	}
+}
+
+func (px *PBFT) Kill() {
+	px.dead = true
+	if px.l != nil {
+		px.l.Close()
+	}
+}
+
+func Make(peers []string, me int, rpcs *rpc.Server,
+	tr transport.Transport) *PBFT {
+	return MakeService("PBFT", peers, me, rpcs, tr, "")
+}
+
+//
+// like Make, but registered under service, so that several peers
+// can share one rpc.Server.
+//
+// if dir is not "", the peer keeps its key pair in dir/<service>.key,
+// and signs with the key it finds there if the file already exists.
+//
+func MakeService(service string, peers []string, me int,
+	rpcs *rpc.Server, tr transport.Transport, dir string) *PBFT {
+	px := &PBFT{}
+	px.service = service
+	px.peers = peers
+	px.me = me
+	px.f = (len(peers) - 1) / 3
+	if tr == nil {
+		tr = transport.Unix{}
+	}
+	px.tr = tr
+
+	key, err := loadKey(dir, service)
+	if err != nil {
+		log.Fatal("pbft key: ", err)
+	}
+	px.key = key
+	px.pubkeys = make([]ed25519.PublicKey, len(peers))
+	px.pubkeys[me] = key.Public().(ed25519.PublicKey)
+	px.fetched = make([]time.Time, len(peers))
+
+	px.timeout = viewTimeout
+	px.view_changes = make(map[int]map[int]ViewChange)
+	px.new_view = -1
+	px.instances = make(map[int]*instance)
+	px.pending = make(map[int]*request)
+	px.max = -1
+	px.compacted = -1
+	px.compacted_seen = -1
+
+	gob.Register(Null{})
+
+	if rpcs == nil {
+		rpcs = rpc.NewServer()
+		l, e := px.tr.Listen(peers[me])
+		if e != nil {
+			log.Fatal("listen error: ", e)
+		}
+		px.l = l
+		go func() {
+			for !px.dead {
+				conn, err := px.l.Accept()
+				if err == nil && !px.dead {
+					go rpcs.ServeConn(conn)
+				} else if err == nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+	rpcs.RegisterName(service, px)
+
+	go px.tick()
+	return px
+}
+
+// the key pair kept in dir/<service>.key, made and saved there if
+// there is none yet. a fresh one every time if dir is "".
+func loadKey(dir string, service string) (ed25519.PrivateKey, error) {
+	if dir == "" {
+		_, key, err := ed25519.GenerateKey(crand.Reader)
+		return key, err
+	}
+	path := filepath.Join(dir, service+".key")
+	if seed, err := os.ReadFile(path); err == nil &&
+		len(seed) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	_, key, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	// written aside and renamed, so a crash leaves no half a key.
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(key.Seed()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,299 @@
+package pbft
+
+import "testing"
+import "runtime"
+import "strconv"
+import "os"
+import "time"
+import "fmt"
+
+func port(tag string, host int) string {
+  s := "/var/tmp/824-"
+  s += strconv.Itoa(os.Getuid()) + "/"
+  os.Mkdir(s, 0777)
+  s += "bft-"
+  s += strconv.Itoa(os.Getpid()) + "-"
+  s += tag + "-"
+  s += strconv.Itoa(host)
+  return s
+}
+
+// how many of the honest peers decided seq; fails if they disagree.
+func ndecided(t *testing.T, pxa []*PBFT, seq int) int {
+  count := 0
+  var v interface{}
+  for i := 0; i < len(pxa); i++ {
+    if pxa[i] != nil && !pxa[i].faulty {
+      decided, v1 := pxa[i].Status(seq)
+      if decided {
+        if count > 0 && v != v1 {
+          t.Fatalf("decided values do not match; seq=%v i=%v v=%v v1=%v",
+            seq, i, v, v1)
+        }
+        count++
+        v = v1
+      }
+    }
+  }
+  return count
+}
+
+func waitn(t *testing.T, pxa []*PBFT, seq int, wanted int) {
+  to := 10 * time.Millisecond
+  for iters := 0; iters < 30; iters++ {
+    if ndecided(t, pxa, seq) >= wanted {
+      break
+    }
+    time.Sleep(to)
+    if to < time.Second {
+      to *= 2
+    }
+  }
+  nd := ndecided(t, pxa, seq)
+  if nd < wanted {
+    t.Fatalf("too few decided; seq=%v ndecided=%v wanted=%v", seq, nd, wanted)
+  }
+}
+
+func cleanup(pxa []*PBFT) {
+  for i := 0; i < len(pxa); i++ {
+    if pxa[i] != nil {
+      pxa[i].Kill()
+    }
+  }
+}
+
+func makePeers(tag string, n int) ([]*PBFT, []string) {
+  var pxa []*PBFT = make([]*PBFT, n)
+  var pxh []string = make([]string, n)
+  for i := 0; i < n; i++ {
+    pxh[i] = port(tag, i)
+    os.Remove(pxh[i])
+  }
+  for i := 0; i < n; i++ {
+    pxa[i] = Make(pxh, i, nil, nil)
+  }
+  return pxa, pxh
+}
+
+func TestBasic(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  pxa, _ := makePeers("basic", npaxos)
+  defer cleanup(pxa)
+
+  fmt.Printf("Test: Single proposer ...\n")
+
+  pxa[0].Start(0, "hello")
+  waitn(t, pxa, 0, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Many proposers, same value ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Start(1, 77)
+  }
+  waitn(t, pxa, 1, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Many proposers, different values ...\n")
+
+  pxa[0].Start(2, 100)
+  pxa[1].Start(2, 101)
+  pxa[2].Start(2, 102)
+  pxa[3].Start(2, 103)
+  waitn(t, pxa, 2, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Out-of-order instances ...\n")
+
+  pxa[1].Start(7, 700)
+  pxa[2].Start(6, 600)
+  pxa[3].Start(5, 500)
+  waitn(t, pxa, 7, npaxos)
+  pxa[0].Start(4, 400)
+  pxa[1].Start(3, 300)
+  waitn(t, pxa, 6, npaxos)
+  waitn(t, pxa, 5, npaxos)
+  waitn(t, pxa, 4, npaxos)
+  waitn(t, pxa, 3, npaxos)
+
+  if pxa[0].Max() != 7 {
+    t.Fatalf("wrong Max()")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLyingBackup(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  pxa, _ := makePeers("backup", npaxos)
+  defer cleanup(pxa)
+
+  fmt.Printf("Test: A backup lies in every prepare and commit ...\n")
+
+  pxa[2].faulty = true
+  for seq := 0; seq < 5; seq++ {
+    pxa[seq%npaxos].Start(seq, seq*10)
+    waitn(t, pxa, seq, npaxos-1)
+    if _, v := pxa[0].Status(seq); v != seq*10 {
+      t.Fatalf("seq %v decided %v, not %v", seq, v, seq*10)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLyingPrimary(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  pxa, pxh := makePeers("primary", npaxos)
+  defer cleanup(pxa)
+
+  fmt.Printf("Test: The primary tells each backup something else ...\n")
+
+  pxa[0].faulty = true
+  pxa[1].Start(0, "x")
+  waitn(t, pxa, 0, npaxos-1)
+  if _, v := pxa[1].Status(0); v != "x" {
+    t.Fatalf("decided %v, not x", v)
+  }
+  if leader, _ := pxa[1].Leader(); leader == pxh[0] {
+    t.Fatalf("the lying primary is still in charge")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: The new view keeps going ...\n")
+
+  for seq := 1; seq < 4; seq++ {
+    pxa[3].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos-1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestDeadPrimary(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  pxa, _ := makePeers("dead", npaxos)
+  defer cleanup(pxa)
+
+  fmt.Printf("Test: The primary dies ...\n")
+
+  pxa[1].Start(0, "a")
+  waitn(t, pxa, 0, npaxos)
+
+  pxa[0].Kill()
+  pxa[0] = nil
+  pxa[2].Start(1, "b")
+  waitn(t, pxa, 1, npaxos-1)
+  pxa[3].Start(2, "c")
+  waitn(t, pxa, 2, npaxos-1)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestCatchUp(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  var pxa []*PBFT = make([]*PBFT, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("catchup", i)
+    os.Remove(pxh[i])
+  }
+  for i := 0; i < npaxos-1; i++ {
+    pxa[i] = Make(pxh, i, nil, nil)
+  }
+
+  fmt.Printf("Test: A missing peer learns what it missed ...\n")
+
+  for seq := 0; seq < 10; seq++ {
+    pxa[seq%3].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos-1)
+  }
+
+  pxa[3] = Make(pxh, 3, nil, nil)
+  pxa[3].Start(9, "late")
+  waitn(t, pxa, 9, npaxos)
+  if _, v := pxa[3].Status(9); v != 9 {
+    t.Fatalf("late peer learned %v, not 9", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Instances the others compacted ...\n")
+
+  for i := 0; i < npaxos-1; i++ {
+    pxa[i].Compact(5)
+  }
+  pxa[3].Start(4, "late")
+  waitn(t, pxa[3:], 4, 1)
+  if decided, v := pxa[3].Status(4); !decided || v != nil {
+    t.Fatalf("compacted instance: decided=%v v=%v", decided, v)
+  }
+  if pxa[3].Compacted() < 5 {
+    t.Fatalf("Compacted() %v, not 5", pxa[3].Compacted())
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestRestartedPeer(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  pxa, pxh := makePeers("restart", npaxos)
+  defer cleanup(pxa)
+
+  fmt.Printf("Test: A restarted peer signs with a new key ...\n")
+
+  pxa[1].Start(0, "a")
+  waitn(t, pxa, 0, npaxos)
+
+  // peer 1 comes back with a new key, and with peer 2 gone the
+  // others can't decide without it.
+  pxa[1].Kill()
+  pxa[1] = Make(pxh, 1, nil, nil)
+  pxa[2].Kill()
+  pxa[2] = nil
+  pxa[0].Start(1, "b")
+  waitn(t, pxa, 1, npaxos-1)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A peer keeps its key in its dir ...\n")
+
+  dir := port("key", 0) + ".d"
+  os.RemoveAll(dir)
+  defer os.RemoveAll(dir)
+
+  key, err := loadKey(dir, "PBFT")
+  if err != nil {
+    t.Fatalf("loadKey: %v", err)
+  }
+  again, err := loadKey(dir, "PBFT")
+  if err != nil || !key.Equal(again) {
+    t.Fatalf("key changed across a restart")
+  }
+  other, _ := loadKey(dir, "PBFT-other")
+  fresh, _ := loadKey("", "PBFT")
+  if key.Equal(other) || key.Equal(fresh) {
+    t.Fatalf("different services share a key")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,255 @@
+package pbft
+
+//
+// Replacing a primary that is faulty, or just slow.
+//
+// A peer that gives up on the primary of view v sends every peer a
+// signed view-change for v+1, carrying a prepared certificate for
+// each instance it hasn't compacted. It joins a higher view as soon
+// as f+1 peers ask for one, since one of them is honest.
+//
+// Once the primary of v+1 has 2f+1 view-changes, it sends them in a
+// new-view, with a pre-prepare for every instance from the (f+1)-th
+// highest compacted seq up to the highest prepared one: the value of
+// the certificate from the highest view, or Null if there is none.
+// Backups check the new-view by working out the same pre-prepares
+// from the same view-changes, so a lying primary can't make them up.
+// A peer that asks for a view the others are already in, or past, is
+// sent the new-view that started theirs.
+//
+// Anything decided was prepared by f+1 honest peers, and 2f+1
+// view-changes include one of those, so it carries over unchanged.
+//
+
+import "sort"
+import "time"
+
+// give up on the current view and ask for view.
+func (px *PBFT) startViewChange(view int) {
+	px.mu.Lock()
+	if view <= px.view {
+		px.mu.Unlock()
+		return
+	}
+	if px.changing {
+		// the last change went nowhere; wait longer this time.
+		px.timeout *= 2
+	}
+	px.view = view
+	px.changing = true
+	px.change_start = time.Now()
+
+	vc := &ViewChange{view, px.me, px.compacted, make([]Certificate, 0), nil}
+	seqs := make([]int, 0)
+	for seq, inst := range px.instances {
+		if inst.cert != nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		vc.Prepared = append(vc.Prepared, *px.instances[seq].cert)
+	}
+	vc.Sig = px.sign(vc.signed())
+	px.mu.Unlock()
+
+	px.ViewChange(vc, &ViewChangeReply{})
+	px.broadcast("ViewChange", vc)
+}
+
+// true if c proves that its value was prepared: a pre-prepare from
+// the primary of its view, and 2f matching prepares from others.
+func (px *PBFT) validCert(c *Certificate) bool {
+	pp := &c.PrePrepare
+	if !px.validPrePrepare(pp) {
+		return false
+	}
+	senders := make(map[int]bool)
+	for _, p := range c.Prepares {
+		if p.View != pp.View || p.Seq != pp.Seq || p.Digest != pp.Digest ||
+			p.Sender == px.primary(pp.View) || senders[p.Sender] ||
+			!px.verifyFrom(p.Sender, p.signed(), p.Sig) {
+			return false
+		}
+		senders[p.Sender] = true
+	}
+	return len(senders) >= 2*px.f
+}
+
+func (px *PBFT) validViewChange(vc *ViewChange) bool {
+	if !px.verifyFrom(vc.Sender, vc.signed(), vc.Sig) {
+		return false
+	}
+	for i := range vc.Prepared {
+		c := &vc.Prepared[i]
+		if c.PrePrepare.View >= vc.View || c.PrePrepare.Seq <= vc.Compacted ||
+			!px.validCert(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (px *PBFT) ViewChange(args *ViewChange, reply *ViewChangeReply) error {
+	if !px.validViewChange(args) {
+		return nil
+	}
+
+	px.mu.Lock()
+	if args.View <= px.view && !px.changing && px.started != nil &&
+		args.Sender != px.me {
+		// the sender missed the change to our view; show it.
+		go call(px.tr, px.peers[args.Sender], px.service+".NewView",
+			px.started, &NewViewReply{})
+	}
+	if args.View < px.view {
+		px.mu.Unlock()
+		return nil
+	}
+	if px.view_changes[args.View] == nil {
+		px.view_changes[args.View] = make(map[int]ViewChange)
+	}
+	px.view_changes[args.View][args.Sender] = *args
+
+	// f+1 peers want a later view, so at least one honest peer
+	// does; go along with the lowest of those views.
+	join := -1
+	askers := make(map[int]bool)
+	for view, vcs := range px.view_changes {
+		if view > px.view {
+			for sender := range vcs {
+				askers[sender] = true
+			}
+			if join < 0 || view < join {
+				join = view
+			}
+		}
+	}
+	if len(askers) <= px.f {
+		join = -1
+	}
+
+	var nv *NewView
+	vcs := px.view_changes[args.View]
+	if px.primary(args.View) == px.me && len(vcs) >= 2*px.f+1 &&
+		px.new_view < args.View && args.View == px.view {
+		nv = &NewView{View: args.View}
+		for _, vc := range vcs {
+			nv.ViewChanges = append(nv.ViewChanges, vc)
+		}
+		sort.Slice(nv.ViewChanges, func(i, j int) bool {
+			return nv.ViewChanges[i].Sender < nv.ViewChanges[j].Sender
+		})
+		nv.ViewChanges = nv.ViewChanges[:2*px.f+1]
+		nv.PrePrepares, _ = carryOver(nv.View, nv.ViewChanges, px.f)
+		for i := range nv.PrePrepares {
+			pp := &nv.PrePrepares[i]
+			pp.Sig = px.sign(pp.signed())
+		}
+		nv.Sig = px.sign(nv.signed())
+		px.new_view = args.View
+	}
+	px.mu.Unlock()
+
+	if join >= 0 {
+		px.startViewChange(join)
+	}
+	if nv != nil {
+		px.NewView(nv, &NewViewReply{})
+		px.broadcast("NewView", nv)
+	}
+	return nil
+}
+
+// the pre-prepares view starts with, unsigned, given the view-changes
+// that justify it, and the seq below which they start.
+func carryOver(view int, vcs []ViewChange, f int) ([]PrePrepare, int) {
+	compacted := make([]int, 0)
+	for _, vc := range vcs {
+		compacted = append(compacted, vc.Compacted)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(compacted)))
+	low := compacted[f]
+
+	high := low
+	best := make(map[int]*PrePrepare)
+	for i := range vcs {
+		for j := range vcs[i].Prepared {
+			pp := &vcs[i].Prepared[j].PrePrepare
+			if pp.Seq <= low {
+				continue
+			}
+			if b, ok := best[pp.Seq]; !ok || pp.View > b.View {
+				best[pp.Seq] = pp
+			}
+			if pp.Seq > high {
+				high = pp.Seq
+			}
+		}
+	}
+
+	pps := make([]PrePrepare, 0)
+	for seq := low + 1; seq <= high; seq++ {
+		var v interface{} = Null{}
+		if b, ok := best[seq]; ok {
+			v = b.Value
+		}
+		pps = append(pps, PrePrepare{view, seq, digest(v), v, nil})
+	}
+	return pps, low
+}
+
+func (px *PBFT) NewView(args *NewView, reply *NewViewReply) error {
+	primary := px.primary(args.View)
+	if !px.verifyFrom(primary, args.signed(), args.Sig) ||
+		len(args.ViewChanges) < 2*px.f+1 {
+		return nil
+	}
+	senders := make(map[int]bool)
+	for i := range args.ViewChanges {
+		vc := &args.ViewChanges[i]
+		if vc.View != args.View || senders[vc.Sender] || !px.validViewChange(vc) {
+			return nil
+		}
+		senders[vc.Sender] = true
+	}
+	pps, low := carryOver(args.View, args.ViewChanges, px.f)
+	if len(pps) != len(args.PrePrepares) {
+		return nil
+	}
+	for i := range pps {
+		pp := &args.PrePrepares[i]
+		if pp.View != args.View || pp.Seq != pps[i].Seq ||
+			pp.Digest != pps[i].Digest || !px.validPrePrepare(pp) {
+			return nil
+		}
+	}
+
+	px.mu.Lock()
+	if args.View < px.view || (args.View == px.view && !px.changing) {
+		px.mu.Unlock()
+		return nil
+	}
+	px.view = args.View
+	px.changing = false
+	px.started = args
+	if px.new_view < args.View && primary == px.me {
+		px.new_view = args.View
+	}
+	now := time.Now()
+	for _, r := range px.pending {
+		// give the new primary a fair chance.
+		r.started = now
+		r.sent = time.Time{}
+	}
+	if low > px.compacted_seen {
+		// f+1 peers, one of them honest, have compacted up to low.
+		px.compacted_seen = low
+	}
+	px.mu.Unlock()
+
+	for i := range args.PrePrepares {
+		px.acceptPrePrepare(&args.PrePrepares[i])
+	}
+	return nil
+}
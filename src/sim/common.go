@@ -0,0 +1,62 @@
+package sim
+
+//
+// A discrete-event simulator for Whanau. Every node is a real
+// whanau server, made with whanau.MakeNode and following its
+// whanau.Behavior, so setup, lookups and the attacks in whanau's
+// attacks.go all run the whanau package's own code. What the
+// simulator replaces is the network: the nodes reach each other
+// through a transport.Simulated that delivers each RPC by hand, a
+// virtual Latency (plus Jitter) after it is sent.
+//
+// Each node's setup, and each lookup, runs in a goroutine of its
+// own, but only one of them runs at a time: a goroutine runs until
+// it sends an RPC or sleeps, and the next is the one whose event on
+// the virtual clock is due first. With whanau's random choices
+// seeded too (whanau.SeedRandom), a run with the same graph, keys
+// and Config gives the same result every time, and nothing waits on
+// the real clock.
+//
+// There is no Paxos, and no pending writes or later setup rounds;
+// the whanau tests are for those.
+//
+
+import "math"
+import "time"
+import "whanau"
+
+type Config struct {
+	Seed    int64
+	Latency time.Duration // how long every message takes
+	Jitter  time.Duration // plus up to this much, at random
+	W       int           // steps of systolic mixing
+	Layers  int
+	Rd      int // records in the db
+	Rf      int // fingers per layer
+	Rs      int // nodes to sample successors from, per layer
+	T       int // successors sampled per node
+}
+
+// The parameters the whanau tests use for n nodes holding keys keys
+// between them.
+func DefaultConfig(n int, keys int) Config {
+	const constant = 5
+	root := int(math.Sqrt(float64(keys)))
+	return Config{
+		Seed:    1,
+		Latency: 10 * time.Millisecond,
+		W:       constant * int(math.Log(float64(n))),
+		Layers:  int(math.Log(float64(keys))) + 1,
+		Rd:      2 * root,
+		Rf:      root,
+		Rs:      constant * root,
+		T:       5,
+	}
+}
+
+// The result of a lookup.
+type Result struct {
+	Value   whanau.ValueType
+	Found   bool
+	Latency time.Duration
+}
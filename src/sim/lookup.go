@@ -0,0 +1,15 @@
+package sim
+
+import "whanau"
+
+// Look key up from node from, with its whanau Lookup handler, as a
+// client of the node would. done gets the result once the lookup is
+// over; Run the simulation to get there.
+func (s *Sim) Lookup(from int, key whanau.KeyType, done func(Result)) {
+	s.spawn(func() {
+		start := s.now
+		var reply whanau.LookupReply
+		s.Nodes[from].Lookup(&whanau.LookupArgs{Key: key}, &reply)
+		done(Result{reply.Value, reply.Err == whanau.OK, s.now - start})
+	})
+}
@@ -0,0 +1,17 @@
+package sim
+
+import "whanau"
+
+// Give node the key, before Setup. Sybils keep no keys.
+func (s *Sim) Put(node int, key whanau.KeyType, value whanau.ValueType) {
+	s.Nodes[node].AddToKvstore(key, value)
+}
+
+// Run every node's whanau setup, all at once, as a setup round
+// would, until they are done.
+func (s *Sim) Setup() {
+	for _, ws := range s.Nodes {
+		s.spawn(ws.Setup)
+	}
+	s.Run()
+}
@@ -0,0 +1,229 @@
+package sim
+
+import "container/heap"
+import "errors"
+import "math/rand"
+import "net"
+import "reflect"
+import "strconv"
+import "strings"
+import "time"
+import "transport"
+import "whanau"
+
+// The times that events are due at, earliest first.
+type times []time.Duration
+
+func (q times) Len() int { return len(q) }
+
+func (q times) Less(i, j int) bool { return q[i] < q[j] }
+
+func (q times) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *times) Push(x interface{}) { *q = append(*q, x.(time.Duration)) }
+
+func (q *times) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return t
+}
+
+// A goroutine the simulation runs: a node's setup, or a lookup.
+type proc struct {
+	wake chan bool
+}
+
+type Sim struct {
+	cfg      Config
+	rng      *rand.Rand // for Jitter; whanau has its own
+	now      time.Duration
+	times    times
+	due      map[time.Duration][]func() // in the order they were sent
+	messages int
+	running  *proc     // the one that has the turn, if any
+	yielded  chan bool // it has given the turn back
+	Nodes    []*whanau.WhanauServer
+	index    map[string]int           // node by address
+	handlers map[string]reflect.Value // WhanauServer methods, by name
+}
+
+// A simulation of len(neighbors) nodes; node i is a neighbor of the
+// nodes in neighbors[i], and does what behaviors[i] does. behaviors,
+// or any of them, may be nil for whanau.Honest.
+func New(cfg Config, neighbors [][]int,
+	behaviors []whanau.Behavior) *Sim {
+	s := &Sim{}
+	s.cfg = cfg
+	s.rng = rand.New(rand.NewSource(cfg.Seed))
+	s.due = make(map[time.Duration][]func())
+	s.yielded = make(chan bool)
+	s.index = make(map[string]int)
+	s.handlers = make(map[string]reflect.Value)
+	whanau.SeedRandom(cfg.Seed)
+
+	s.Nodes = make([]*whanau.WhanauServer, len(neighbors))
+	for i := range neighbors {
+		s.index[Addr(i)] = i
+	}
+	for i := range neighbors {
+		addrs := make([]string, len(neighbors[i]))
+		for j, nb := range neighbors[i] {
+			addrs[j] = Addr(nb)
+		}
+		var behavior whanau.Behavior = whanau.Honest{}
+		if behaviors != nil && behaviors[i] != nil {
+			behavior = behaviors[i]
+		}
+		s.Nodes[i] = whanau.MakeNode(Addr(i), addrs, behavior, cfg.Layers,
+			cfg.Rf, cfg.W, cfg.Rd, cfg.Rs, cfg.T, endpoint{s, Addr(i)})
+	}
+	return s
+}
+
+// Node i's address.
+func Addr(i int) string {
+	return "sim-" + strconv.Itoa(i)
+}
+
+// The virtual time: how long the simulated network has taken so far.
+func (s *Sim) Now() time.Duration {
+	return s.now
+}
+
+// How many messages have been sent so far.
+func (s *Sim) Messages() int {
+	return s.messages
+}
+
+// Run fn after d.
+func (s *Sim) after(d time.Duration, fn func()) {
+	at := s.now + d
+	if _, ok := s.due[at]; !ok {
+		heap.Push(&s.times, at)
+	}
+	s.due[at] = append(s.due[at], fn)
+}
+
+// Run fn in a goroutine of its own, when Run gets to it.
+func (s *Sim) spawn(fn func()) {
+	p := &proc{make(chan bool)}
+	go func() {
+		<-p.wake
+		fn()
+		s.running = nil
+		s.yielded <- true
+	}()
+	s.after(0, func() { s.resume(p) })
+}
+
+// Give p the turn, and wait for it back.
+func (s *Sim) resume(p *proc) {
+	s.running = p
+	p.wake <- true
+	<-s.yielded
+}
+
+// Give the turn back, and have it again after d.
+func (s *Sim) block(d time.Duration) {
+	p := s.running
+	s.after(d, func() { s.resume(p) })
+	s.yielded <- true
+	<-p.wake
+}
+
+// How long a message takes.
+func (s *Sim) delay() time.Duration {
+	d := s.cfg.Latency
+	if s.cfg.Jitter > 0 {
+		d += time.Duration(s.rng.Int63n(int64(s.cfg.Jitter)))
+	}
+	return d
+}
+
+// Run events until there are none left.
+func (s *Sim) Run() {
+	for len(s.times) > 0 {
+		s.now = heap.Pop(&s.times).(time.Duration)
+		// events due now may add more.
+		for i := 0; i < len(s.due[s.now]); i++ {
+			fn := s.due[s.now][i]
+			s.due[s.now][i] = nil
+			fn()
+		}
+		delete(s.due, s.now)
+	}
+}
+
+// Call the rpcname handler at node to, as net/rpc would, in the
+// goroutine that sent it. false if there is no such handler, or it
+// returned an error.
+func (s *Sim) handle(to int, rpcname string, args interface{},
+	reply interface{}) bool {
+	name := strings.TrimPrefix(rpcname, "WhanauServer.")
+	fn, ok := s.handlers[name]
+	if !ok {
+		m, found := reflect.TypeOf(s.Nodes[to]).MethodByName(name)
+		if !found {
+			return false
+		}
+		fn = m.Func
+		s.handlers[name] = fn
+	}
+
+	a := reflect.ValueOf(args)
+	if a.Kind() != reflect.Ptr {
+		p := reflect.New(a.Type())
+		p.Elem().Set(a)
+		a = p
+	}
+	out := fn.Call([]reflect.Value{reflect.ValueOf(s.Nodes[to]), a,
+		reflect.ValueOf(reply)})
+	return out[0].IsNil()
+}
+
+var errSimulated = errors.New("sim: no connections in a simulation")
+
+// How node addr reaches the others.
+type endpoint struct {
+	s    *Sim
+	addr string
+}
+
+var _ transport.Simulated = endpoint{}
+
+func (e endpoint) Dial(addr string) (net.Conn, error) {
+	return nil, errSimulated
+}
+
+func (e endpoint) Listen(addr string) (net.Listener, error) {
+	return nil, errSimulated
+}
+
+func (e endpoint) ParseAddr(addr string) (string, error) {
+	return addr, nil
+}
+
+// The request takes a message there, and the reply one back. A
+// node's RPCs to itself take no time.
+func (e endpoint) Call(addr string, rpcname string, args interface{},
+	reply interface{}) bool {
+	to, ok := e.s.index[addr]
+	if !ok {
+		return false
+	}
+	if addr == e.addr {
+		return e.s.handle(to, rpcname, args, reply)
+	}
+
+	e.s.messages++
+	e.s.block(e.s.delay())
+	ok = e.s.handle(to, rpcname, args, reply)
+	e.s.messages++
+	e.s.block(e.s.delay())
+	return ok
+}
+
+func (e endpoint) Sleep(d time.Duration) {
+	e.s.block(d)
+}
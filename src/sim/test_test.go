@@ -0,0 +1,193 @@
+package sim
+
+import "testing"
+import "fmt"
+import "math/rand"
+import "strconv"
+import "time"
+import "whanau"
+
+// A ring of n nodes, each also linked to extra random others.
+func randomGraph(n int, extra int, seed int64) [][]int {
+	rng := rand.New(rand.NewSource(seed))
+	linked := make([]map[int]bool, n)
+	for i := range linked {
+		linked[i] = make(map[int]bool)
+	}
+	link := func(i, j int) {
+		if i != j {
+			linked[i][j] = true
+			linked[j][i] = true
+		}
+	}
+	for i := 0; i < n; i++ {
+		link(i, (i+1)%n)
+		for e := 0; e < extra; e++ {
+			link(i, rng.Intn(n))
+		}
+	}
+
+	neighbors := make([][]int, n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if linked[i][j] {
+				neighbors[i] = append(neighbors[i], j)
+			}
+		}
+	}
+	return neighbors
+}
+
+// Set up n nodes, the first nsybils of them doing what sybil does,
+// and look up nlookups random keys from random honest nodes. There
+// are nkeys keys, and every honest node holds one, round robin; a
+// key's value names the first node to hold it, as a whanau key's
+// value names the cluster all of whose members hold it.
+func run(cfg Config, n int, nsybils int, sybil whanau.Behavior, nkeys int,
+	nlookups int) (*Sim, []Result, []string) {
+	behaviors := make([]whanau.Behavior, n)
+	for i := 0; i < nsybils; i++ {
+		behaviors[i] = sybil
+	}
+	s := New(cfg, randomGraph(n, 3, cfg.Seed), behaviors)
+	for i := nsybils; i < n; i++ {
+		k := (i - nsybils) % nkeys
+		s.Put(i, whanau.KeyType(strconv.Itoa(k)),
+			whanau.ValueType{Servers: []string{Addr(nsybils + k)}})
+	}
+	s.Setup()
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	results := make([]Result, nlookups)
+	want := make([]string, nlookups)
+	for i := range results {
+		i := i
+		from := nsybils + rng.Intn(n-nsybils)
+		k := rng.Intn(nkeys)
+		want[i] = Addr(nsybils + k)
+		s.Lookup(from, whanau.KeyType(strconv.Itoa(k)), func(r Result) {
+			results[i] = r
+		})
+	}
+	s.Run()
+	return s, results, want
+}
+
+// The fraction of results that found the value in want, and the
+// fraction that found another.
+func found(results []Result, want []string) (float64, float64) {
+	nfound, nwrong := 0, 0
+	for i, r := range results {
+		if !r.Found {
+			continue
+		}
+		if len(r.Value.Servers) == 1 && r.Value.Servers[0] == want[i] {
+			nfound++
+		} else {
+			nwrong++
+		}
+	}
+	return float64(nfound) / float64(len(results)),
+		float64(nwrong) / float64(len(results))
+}
+
+// 10,000 nodes, with the parameters the whanau tests would use for
+// them. Those grow with the number of keys, and each node mixes
+// Rd*Layers*(1+Rf+Rs)+Rd*Rd walks, so a key of its own for every node
+// would be over a million walks each; 16 keys, each held by 625
+// nodes, keep it to 664.
+func TestScale(t *testing.T) {
+	const n = 10000
+	const nkeys = 16
+	cfg := DefaultConfig(n, nkeys)
+	fmt.Printf("Test: 10,000 nodes, %d keys, W=%d, Layers=%d, Rd=%d, Rf=%d, Rs=%d ...\n",
+		nkeys, cfg.W, cfg.Layers, cfg.Rd, cfg.Rf, cfg.Rs)
+
+	start := time.Now()
+	s, results, want := run(cfg, n, 0, nil, nkeys, 1000)
+	right, wrong := found(results, want)
+	fmt.Printf("  found %f of lookups in %v virtual, %d messages, %v real\n",
+		right, s.Now(), s.Messages(), time.Since(start))
+	if right < 0.9 || wrong > 0 {
+		t.Fatalf("%f of lookups succeeded, %f found a wrong value", right,
+			wrong)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A key on every node, with Sybils that know nothing among them.
+func TestSybils(t *testing.T) {
+	const n = 300
+	const nsybils = 30
+	cfg := DefaultConfig(n, n-nsybils)
+	fmt.Printf("Test: %d nodes, %d Sybils, W=%d, Layers=%d, Rd=%d, Rf=%d, Rs=%d ...\n",
+		n, nsybils, cfg.W, cfg.Layers, cfg.Rd, cfg.Rf, cfg.Rs)
+
+	start := time.Now()
+	s, results, want := run(cfg, n, nsybils, whanau.Sybil{}, n-nsybils,
+		1000)
+	right, wrong := found(results, want)
+	fmt.Printf("  found %f of lookups in %v virtual, %d messages, %v real\n",
+		right, s.Now(), s.Messages(), time.Since(start))
+	if right < 0.9 || wrong > 0 {
+		t.Fatalf("%f of lookups succeeded, %f found a wrong value", right,
+			wrong)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// whanau's Behaviors take part like any node. Sybils that forge every
+// value, with as many links as any honest node, get through to some
+// lookups, but few.
+func TestForging(t *testing.T) {
+	fmt.Printf("Test: Sybils forging values ...\n")
+
+	const n = 300
+	const nsybils = 30
+	cfg := DefaultConfig(n, n-nsybils)
+	forging := whanau.Forging{Servers: []string{"forged"}}
+
+	_, results, want := run(cfg, n, nsybils, forging, n-nsybils, 1000)
+	right, wrong := found(results, want)
+	fmt.Printf("  found %f of lookups, %f forged\n", right, wrong)
+	if wrong == 0 {
+		t.Fatalf("Sybils forged no lookups")
+	}
+	if right < 0.9 {
+		t.Fatalf("%f of lookups succeeded, %f found the forgery", right,
+			wrong)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestDeterministic(t *testing.T) {
+	fmt.Printf("Test: Same seed, same run ...\n")
+
+	const n = 300
+	const nsybils = 30
+	cfg := DefaultConfig(n, n-nsybils)
+	cfg.Jitter = 5 * time.Millisecond
+
+	s1, r1, _ := run(cfg, n, nsybils, whanau.Sybil{}, n-nsybils, 200)
+	s2, r2, _ := run(cfg, n, nsybils, whanau.Sybil{}, n-nsybils, 200)
+	if s1.Now() != s2.Now() || s1.Messages() != s2.Messages() {
+		t.Fatalf("runs took %v and %v, %d and %d messages", s1.Now(),
+			s2.Now(), s1.Messages(), s2.Messages())
+	}
+	for i := range r1 {
+		if r1[i].Found != r2[i].Found || r1[i].Latency != r2[i].Latency {
+			t.Fatalf("lookup %d: %v and %v", i, r1[i], r2[i])
+		}
+	}
+
+	cfg.Seed++
+	s3, _, _ := run(cfg, n, nsybils, whanau.Sybil{}, n-nsybils, 200)
+	if s3.Now() == s1.Now() && s3.Messages() == s1.Messages() {
+		t.Fatalf("another seed made no difference")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
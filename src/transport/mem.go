@@ -0,0 +1,163 @@
+package transport
+
+//
+// An in-process network. Every Mem value is a separate network:
+// Listen registers an address, and Dial hands the listener one end
+// of a net.Pipe. No sockets or files are involved, so tests can
+// start hundreds of servers quickly. Addresses are arbitrary
+// non-empty strings.
+//
+// A connection is a pair of pipes, one each way, so that CloseWrite
+// can shut down one direction as a socket's does.
+//
+
+import "errors"
+import "io"
+import "net"
+import "sync"
+import "syscall"
+import "time"
+
+type Mem struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+func NewMem() *Mem {
+	m := &Mem{}
+	m.listeners = make(map[string]*memListener)
+	return m
+}
+
+func (m *Mem) Dial(addr string) (net.Conn, error) {
+	m.mu.Lock()
+	l, ok := m.listeners[addr]
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, refused(addr)
+	}
+
+	client, server := memPipe(addr)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, refused(addr)
+	}
+}
+
+func (m *Mem) Listen(addr string) (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "mem",
+			Addr: memAddr(addr), Err: syscall.EADDRINUSE}
+	}
+
+	l := &memListener{m, memAddr(addr), make(chan net.Conn), make(chan bool)}
+	m.listeners[addr] = l
+	return l, nil
+}
+
+func (m *Mem) ParseAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", ErrBadAddr
+	}
+	return addr, nil
+}
+
+func refused(addr string) error {
+	return &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr),
+		Err: syscall.ECONNREFUSED}
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	m     *Mem
+	addr  memAddr
+	conns chan net.Conn
+	done  chan bool // closed by Close()
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "mem", Addr: l.addr,
+			Err: net.ErrClosed}
+	}
+}
+
+func (l *memListener) Close() error {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return net.ErrClosed
+	default:
+	}
+	close(l.done)
+	if l.m.listeners[string(l.addr)] == l {
+		delete(l.m.listeners, string(l.addr))
+	}
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+var errNoDeadline = errors.New("transport: mem connections have no deadlines")
+
+// one end of a connection to addr.
+type memConn struct {
+	r      *io.PipeReader
+	w      *io.PipeWriter
+	local  memAddr
+	remote memAddr
+}
+
+// both ends of a connection from a dialer to addr.
+func memPipe(addr string) (*memConn, *memConn) {
+	r1, w1 := io.Pipe() // dialer to listener
+	r2, w2 := io.Pipe() // listener to dialer
+	return &memConn{r2, w1, "dialer", memAddr(addr)},
+		&memConn{r1, w2, memAddr(addr), "dialer"}
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *memConn) Close() error {
+	c.r.Close()
+	c.w.Close()
+	return nil
+}
+
+// stop sending: the other end reads EOF, but can still send to us,
+// like shutdown(SHUT_WR) on a socket.
+func (c *memConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error      { return errNoDeadline }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return errNoDeadline }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return errNoDeadline }
@@ -0,0 +1,191 @@
+package transport
+
+import "testing"
+import "fmt"
+import "net/rpc"
+import "os"
+import "strconv"
+
+type Echo struct{}
+
+func (e *Echo) Echo(args *string, reply *string) error {
+	*reply = *args
+	return nil
+}
+
+// serve an Echo service on addr until the listener is closed.
+func serveEcho(t *testing.T, tr Transport, addr string) func() {
+	rpcs := rpc.NewServer()
+	rpcs.Register(&Echo{})
+	l, err := tr.Listen(addr)
+	if err != nil {
+		t.Fatalf("listen %v: %v", addr, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+	return func() { l.Close() }
+}
+
+func echo(tr Transport, addr string, msg string) (string, bool) {
+	conn, err := tr.Dial(addr)
+	if err != nil {
+		return "", false
+	}
+	c := rpc.NewClient(conn)
+	defer c.Close()
+
+	var reply string
+	if c.Call("Echo.Echo", &msg, &reply) != nil {
+		return "", false
+	}
+	return reply, true
+}
+
+func TestRoundTrip(t *testing.T) {
+	fmt.Printf("Test: RPC round trip over every transport ...\n")
+
+	unixaddr := "/var/tmp/824-" + strconv.Itoa(os.Getuid()) + "/"
+	os.Mkdir(unixaddr, 0777)
+	unixaddr += "tr-" + strconv.Itoa(os.Getpid())
+
+	cases := []struct {
+		tr   Transport
+		addr string
+	}{
+		{Unix{}, unixaddr},
+		{TCP{}, "127.0.0.1:0"},
+		{NewMem(), "mem-0"},
+	}
+
+	for _, c := range cases {
+		addr := c.addr
+		if _, ok := c.tr.(TCP); ok {
+			// find out which port the kernel picked.
+			l, err := c.tr.Listen(addr)
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			addr = l.Addr().String()
+			l.Close()
+		}
+
+		stop := serveEcho(t, c.tr, addr)
+		reply, ok := echo(c.tr, addr, "hello")
+		if !ok || reply != "hello" {
+			t.Fatalf("%T: wrong reply %q ok=%v", c.tr, reply, ok)
+		}
+		stop()
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestMem(t *testing.T) {
+	fmt.Printf("Test: In-memory network ...\n")
+
+	m := NewMem()
+	if _, ok := echo(m, "nobody", "x"); ok {
+		t.Fatalf("dial to unknown address succeeded")
+	}
+
+	stop := serveEcho(t, m, "a")
+	if _, err := m.Listen("a"); err == nil {
+		t.Fatalf("second listen on the same address succeeded")
+	}
+
+	// separate networks do not see each other.
+	if _, ok := echo(NewMem(), "a", "x"); ok {
+		t.Fatalf("dial crossed into another network")
+	}
+
+	for i := 0; i < 50; i++ {
+		msg := strconv.Itoa(i)
+		reply, ok := echo(m, "a", msg)
+		if !ok || reply != msg {
+			t.Fatalf("wrong reply %q ok=%v", reply, ok)
+		}
+	}
+
+	stop()
+	if _, ok := echo(m, "a", "x"); ok {
+		t.Fatalf("dial to closed listener succeeded")
+	}
+
+	// the address can be reused after close, like a restarted server.
+	stop = serveEcho(t, m, "a")
+	if _, ok := echo(m, "a", "x"); !ok {
+		t.Fatalf("dial to restarted listener failed")
+	}
+	stop()
+
+	// a half-closed server still reads the request, but the reply
+	// is lost, as on a socket shut down for writing.
+	l, err := m.Listen("b")
+	if err != nil {
+		t.Fatalf("listen b: %v", err)
+	}
+	got := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.(interface{ CloseWrite() error }).CloseWrite()
+		buf := make([]byte, 5)
+		n, _ := conn.Read(buf)
+		got <- string(buf[:n])
+		conn.Close()
+	}()
+	conn, err := m.Dial("b")
+	if err != nil {
+		t.Fatalf("dial b: %v", err)
+	}
+	conn.Write([]byte("hello"))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("read from half-closed server: %d, %v", n, err)
+	}
+	if msg := <-got; msg != "hello" {
+		t.Fatalf("half-closed server read %q", msg)
+	}
+	conn.Close()
+	l.Close()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestParseAddr(t *testing.T) {
+	fmt.Printf("Test: Address parsing ...\n")
+
+	good := map[string]string{
+		"127.0.0.1:7000":  "127.0.0.1:7000",
+		"localhost:0080":  "localhost:80",
+		"[::1]:9":         "[::1]:9",
+		"node7.lan:31337": "node7.lan:31337",
+	}
+	for in, want := range good {
+		got, err := TCP{}.ParseAddr(in)
+		if err != nil || got != want {
+			t.Fatalf("TCP.ParseAddr(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	bad := []string{"", "/var/tmp/824-0/sm-1", "host", "host:port", "host:70000"}
+	for _, in := range bad {
+		if _, err := (TCP{}).ParseAddr(in); err == nil {
+			t.Fatalf("TCP.ParseAddr(%q) should fail", in)
+		}
+	}
+
+	if _, err := (Unix{}).ParseAddr(""); err == nil {
+		t.Fatalf("Unix.ParseAddr(\"\") should fail")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
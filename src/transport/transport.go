@@ -0,0 +1,99 @@
+package transport
+
+//
+// Transports used by Paxos peers and Whanau servers to reach
+// each other. A Transport knows how to listen on an address,
+// how to dial one, and what a well-formed address looks like.
+//
+// Unix  -- unix-domain sockets named by file paths; one machine only.
+// TCP   -- host:port addresses; works across machines.
+// Mem   -- an in-process network for fast tests; see mem.go.
+//
+// Callers wrap the net.Conn returned by Dial with rpc.NewClient
+// and serve the net.Conn returned by Accept with rpc.ServeConn,
+// exactly as they would for a socket.
+//
+// A Simulated transport has no connections: it hands each RPC to
+// its handler itself, and keeps time of its own, as the simulator
+// in package sim does.
+//
+
+import "errors"
+import "net"
+import "os"
+import "strconv"
+import "time"
+
+// how long a TCP dial waits before giving up on a peer.
+const DialTimeout = 5 * time.Second
+
+var ErrBadAddr = errors.New("transport: malformed address")
+
+type Transport interface {
+	// connect to the server listening on addr.
+	Dial(addr string) (net.Conn, error)
+
+	// start accepting connections on addr.
+	Listen(addr string) (net.Listener, error)
+
+	// check that addr makes sense for this transport, and
+	// return it in canonical form.
+	ParseAddr(addr string) (string, error)
+}
+
+type Simulated interface {
+	Transport
+
+	// deliver an RPC to the rpcname handler at addr, and wait for
+	// its reply, as rpc.Client.Call would. false if addr is not
+	// there.
+	Call(addr string, rpcname string, args interface{},
+		reply interface{}) bool
+
+	// wait d on the transport's clock.
+	Sleep(d time.Duration)
+}
+
+// unix-domain sockets. addresses are socket file paths,
+// e.g. /var/tmp/824-1000/sm-4242-basic-3.
+type Unix struct{}
+
+func (Unix) Dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", addr)
+}
+
+func (Unix) Listen(addr string) (net.Listener, error) {
+	os.Remove(addr) // a previous run may have left the socket behind
+	return net.Listen("unix", addr)
+}
+
+func (Unix) ParseAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", ErrBadAddr
+	}
+	return addr, nil
+}
+
+// TCP sockets. addresses are host:port, e.g. 10.0.0.7:7000
+// or [::1]:7000.
+type TCP struct{}
+
+func (TCP) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, DialTimeout)
+}
+
+func (TCP) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (TCP) ParseAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return "", ErrBadAddr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n)), nil
+}
@@ -0,0 +1,169 @@
+package whanau
+
+/*
+   Sybil strategies beyond the plain Sybil, for measuring how well
+   Whanau holds up against the attacks in the writeup.
+*/
+
+import "strconv"
+
+// Clustering.Layer for a clustering attack on every layer.
+const AllLayers = -1
+
+// The clustering attack: the Sybils take layer ids just below Victim,
+// so honest fingers that precede it, and that lookups of it go
+// through, are theirs. Only Layer is targeted, or every layer with
+// AllLayers; layered ids are meant to keep the attack to that one.
+type Clustering struct {
+	Sybil
+	Victim KeyType
+	Layer  int
+}
+
+func (c Clustering) targets(layer int) bool {
+	return c.Layer == AllLayers || c.Layer == layer
+}
+
+// An id strictly below victim, and above every honest key below it,
+// for as long as none of them start with the same bytes; tag tells
+// the Sybils' ids apart. Trailing zero bytes can't be counted down,
+// and nothing lies between "ab" and "ab\x00", so they are dropped
+// first. false if nothing is below victim at all.
+func clusterID(victim KeyType, tag string) (KeyType, bool) {
+	n := len(victim)
+	for n > 0 && victim[n-1] == 0 {
+		n--
+	}
+	if n == 0 {
+		// only "" is below a victim of zero bytes, and nothing is
+		// below "".
+		return "", len(victim) > 0
+	}
+	return victim[:n-1] + KeyType([]byte{victim[n-1] - 1, 0xff}) +
+		KeyType(tag), true
+}
+
+func (c Clustering) ChooseID(ws *WhanauServer, layer int) KeyType {
+	if c.targets(layer) {
+		if id, ok := clusterID(c.Victim, ws.myaddr); ok {
+			return id
+		}
+	}
+	return c.Sybil.ChooseID(ws, layer)
+}
+
+func (c Clustering) GetId(ws *WhanauServer, layer int) GetIdReply {
+	if c.targets(layer) {
+		if id, ok := clusterID(c.Victim, ws.myaddr); ok {
+			return GetIdReply{id, OK}
+		}
+	}
+	return c.Sybil.GetId(ws, layer)
+}
+
+// Fill successor tables that would hold Victim with keys of our own
+// from the gap between key and Victim, so they still pass for key's
+// successors, and never Victim. A table for Victim itself or past it
+// has no such gap, and gets what any Sybil gives.
+func (c Clustering) SampleSuccessors(ws *WhanauServer,
+	key KeyType) SampleSuccessorsReply {
+	if key >= c.Victim {
+		return c.Sybil.SampleSuccessors(ws, key)
+	}
+	records := make([]Record, ws.t)
+	for i := range records {
+		id, ok := clusterID(c.Victim, ws.myaddr+"/"+strconv.Itoa(i))
+		if !ok || id <= key {
+			return c.Sybil.SampleSuccessors(ws, key)
+		}
+		records[i] = Record{id, ValueType{}}
+	}
+	By(RecordKey).Sort(records)
+	return SampleSuccessorsReply{records, OK}
+}
+
+// Mix like any Sybil, with our ids around Victim.
+func (c Clustering) Setup(ws *WhanauServer) {
+	ids := make([]KeyType, 0)
+	for i := 0; i < ws.nlayers; i++ {
+		ids = append(ids, c.ChooseID(ws, i))
+	}
+	ws.setupSybil(ids)
+}
+
+// The value-forging attack: the Sybils answer every key with Servers,
+// a Paxos cluster of their own, in place of the key's real one.
+type Forging struct {
+	Sybil
+	Servers []string
+}
+
+func (f Forging) Query(ws *WhanauServer, key KeyType, layer int) QueryReply {
+	return QueryReply{ValueType{f.Servers}, OK}
+}
+
+func (f Forging) Try(ws *WhanauServer, key KeyType) TryReply {
+	return TryReply{ValueType{f.Servers}, OK}
+}
+
+func (f Forging) Lookup(ws *WhanauServer, key KeyType, steps int) LookupReply {
+	return LookupReply{OK, ValueType{f.Servers}}
+}
+
+// The eclipse attack: the Sybils hand their honest neighbors nothing
+// but Sybil addresses while mixing, and end every random walk at a
+// Sybil, to fill honest random-walk pools with Sybils.
+type Eclipse struct {
+	Sybil
+	Sybils []string // addresses to hand out; just ours if empty
+}
+
+func (e Eclipse) sybil(ws *WhanauServer) string {
+	if len(e.Sybils) == 0 {
+		return ws.myaddr
+	}
+	return e.Sybils[randIntn(len(e.Sybils))]
+}
+
+func (e Eclipse) Forward(ws *WhanauServer, servers []string) []string {
+	forward := make([]string, len(servers))
+	for i := range forward {
+		forward[i] = e.sybil(ws)
+	}
+	return forward
+}
+
+func (e Eclipse) RandomWalk(ws *WhanauServer, steps int) RandomWalkReply {
+	return RandomWalkReply{e.sybil(ws), OK}
+}
+
+// The fraction of the entries left in the random-walk pools of the
+// honest servers among servers that are Sybils among them: how much
+// the attack edges poisoned the pools.
+func PoisonedFraction(servers []*WhanauServer) float64 {
+	sybils := make(map[string]bool)
+	for _, ws := range servers {
+		if ws.is_sybil {
+			sybils[ws.myaddr] = true
+		}
+	}
+
+	npoisoned, ntotal := 0, 0
+	for _, ws := range servers {
+		if ws.is_sybil {
+			continue
+		}
+		ws.rw_mu.Lock()
+		for _, srv := range ws.rw_servers {
+			if sybils[srv] {
+				npoisoned++
+			}
+		}
+		ntotal += len(ws.rw_servers)
+		ws.rw_mu.Unlock()
+	}
+	if ntotal == 0 {
+		return 0
+	}
+	return float64(npoisoned) / float64(ntotal)
+}
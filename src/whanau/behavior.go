@@ -0,0 +1,132 @@
+package whanau
+
+/*
+   How a server takes part in Whanau.
+
+   Every server is started with a Behavior, and its RPC handlers and
+   setup hand the work to it. Honest follows the protocol; Sybil is
+   the adversary the tests have always used. Other attacks implement
+   Behavior too, usually by embedding Honest or Sybil and overriding
+   the methods they change, so strategies combine without touching
+   the server.
+*/
+
+type Behavior interface {
+	// answer Query from our successor table at layer
+	Query(ws *WhanauServer, key KeyType, layer int) QueryReply
+	// find key's value by querying our fingers
+	Try(ws *WhanauServer, key KeyType) TryReply
+	// find key's value, trying from random servers
+	Lookup(ws *WhanauServer, key KeyType, steps int) LookupReply
+	// a record from our kvstore, for another server's db
+	SampleRecord(ws *WhanauServer) SampleRecordReply
+	// our id for layer
+	ChooseID(ws *WhanauServer, layer int) KeyType
+	// answer GetId: the id we tell others we have at layer
+	GetId(ws *WhanauServer, layer int) GetIdReply
+	// answer SampleSuccessors: the records from key on, for another
+	// server's successor table
+	SampleSuccessors(ws *WhanauServer, key KeyType) SampleSuccessorsReply
+	// the end of a random walk of steps from us
+	RandomWalk(ws *WhanauServer, steps int) RandomWalkReply
+	// the addresses we pass on to a neighbor in a step of systolic
+	// mixing, given the ones from our pool
+	Forward(ws *WhanauServer, servers []string) []string
+	// a Get on the cluster that stores args.Key
+	PaxosGet(ws *WhanauServer, args *ClientGetArgs, reply *ClientGetReply)
+	// build our routing tables
+	Setup(ws *WhanauServer)
+}
+
+// Follows the protocol.
+type Honest struct{}
+
+func (Honest) Query(ws *WhanauServer, key KeyType, layer int) QueryReply {
+	return ws.HonestQuery(key, layer)
+}
+
+func (Honest) Try(ws *WhanauServer, key KeyType) TryReply {
+	return ws.HonestTry(key)
+}
+
+func (Honest) Lookup(ws *WhanauServer, key KeyType, steps int) LookupReply {
+	return ws.HonestLookup(key, steps)
+}
+
+func (Honest) SampleRecord(ws *WhanauServer) SampleRecordReply {
+	return ws.HonestSampleRecord()
+}
+
+func (Honest) ChooseID(ws *WhanauServer, layer int) KeyType {
+	return ws.HonestChooseID(layer)
+}
+
+func (Honest) GetId(ws *WhanauServer, layer int) GetIdReply {
+	return ws.HonestGetId(layer)
+}
+
+func (Honest) SampleSuccessors(ws *WhanauServer,
+	key KeyType) SampleSuccessorsReply {
+	return ws.HonestSampleSuccessors(key)
+}
+
+func (Honest) RandomWalk(ws *WhanauServer, steps int) RandomWalkReply {
+	if server, ok := ws.GetNextRWServer(); ok {
+		return RandomWalkReply{server, OK}
+	}
+	// Ran out of servers!!
+	// Just go ahead and do a regular random walk
+	return ws.HonestRandomWalk(steps)
+}
+
+func (Honest) Forward(ws *WhanauServer, servers []string) []string {
+	return servers
+}
+
+func (Honest) PaxosGet(ws *WhanauServer, args *ClientGetArgs,
+	reply *ClientGetReply) {
+	ws.HonestPaxosGetRPC(args, reply)
+}
+
+func (Honest) Setup(ws *WhanauServer) {
+	ws.SetupHonest()
+}
+
+// Takes part in mixing so that honest nodes route to it, and then
+// knows nothing.
+type Sybil struct {
+	Honest
+}
+
+func (Sybil) Query(ws *WhanauServer, key KeyType, layer int) QueryReply {
+	return ws.SybilQuery()
+}
+
+func (Sybil) Try(ws *WhanauServer, key KeyType) TryReply {
+	return ws.SybilTry()
+}
+
+func (Sybil) Lookup(ws *WhanauServer, key KeyType, steps int) LookupReply {
+	return ws.SybilLookup()
+}
+
+func (Sybil) SampleRecord(ws *WhanauServer) SampleRecordReply {
+	return ws.SybilSampleRecord()
+}
+
+func (Sybil) ChooseID(ws *WhanauServer, layer int) KeyType {
+	return ws.SybilChooseID(layer)
+}
+
+func (Sybil) RandomWalk(ws *WhanauServer, steps int) RandomWalkReply {
+	return ws.SybilRandomWalk()
+}
+
+func (Sybil) PaxosGet(ws *WhanauServer, args *ClientGetArgs,
+	reply *ClientGetReply) {
+	ws.SybilPaxosGetRPC(args, reply)
+}
+
+func (Sybil) Setup(ws *WhanauServer) {
+	ws.SetupSybil()
+}
@@ -6,15 +6,25 @@
 package whanau
 
 import "net/rpc"
+import "time"
+import "transport"
+
 //import "fmt"
 
 type Clerk struct {
-	server string // the "host" server
+	server string              // the "host" server
+	tr     transport.Transport // how to reach the host server
 }
 
-func MakeClerk(server string) *Clerk {
+// tr should match the transport the host server was started
+// with; nil means unix sockets.
+func MakeClerk(server string, tr transport.Transport) *Clerk {
 	ck := new(Clerk)
 	ck.server = server
+	if tr == nil {
+		tr = transport.Unix{}
+	}
+	ck.tr = tr
 	return ck
 }
 
@@ -27,6 +37,7 @@ func MakeClerk(server string) *Clerk {
 // the return value is true if the server responded, and false
 // if call() was not able to contact the server. in particular,
 // the reply's contents are only valid if call() returned true.
+// a transport.Simulated delivers the RPC itself.
 //
 // you should assume that call() will time out and return an
 // error after a while if it doesn't get a reply from the server.
@@ -34,12 +45,16 @@ func MakeClerk(server string) *Clerk {
 // please use call() to send all RPCs, in client.go and server.go.
 // please don't change this function.
 //
-func call(srv string, rpcname string,
+func call(tr transport.Transport, srv string, rpcname string,
 	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
+	if sim, ok := tr.(transport.Simulated); ok {
+		return sim.Call(srv, rpcname, args, reply)
+	}
+	conn, errx := tr.Dial(srv)
 	if errx != nil {
 		return false
 	}
+	c := rpc.NewClient(conn)
 	defer c.Close()
 
 	err := c.Call(rpcname, args, reply)
@@ -51,12 +66,42 @@ func call(srv string, rpcname string,
 	return false
 }
 
+// Wait d, on tr's clock if it keeps one.
+func sleep(tr transport.Transport, d time.Duration) {
+	if sim, ok := tr.(transport.Simulated); ok {
+		sim.Sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// Like call(), but gives up on srv after timeout: a server can take
+// an RPC and then never answer, say if its cluster has lost a
+// majority. reply is only valid if callTimeout returned true, and
+// should not be reused if it returned false.
+func callTimeout(tr transport.Transport, srv string, rpcname string,
+	args interface{}, reply interface{}, timeout time.Duration) bool {
+	done := make(chan bool, 1)
+	go func() {
+		done <- call(tr, srv, rpcname, args, reply)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-done:
+		return ok
+	case <-timer.C:
+		return false
+	}
+}
+
 // TODO change to TrueValueType later
 func (ck *Clerk) Lookup(key KeyType) ValueType {
 	args := &LookupArgs{}
 	args.Key = key
 	var reply LookupReply
-	ok := call(ck.server, "WhanauServer.Lookup", args, &reply)
+	ok := call(ck.tr, ck.server, "WhanauServer.Lookup", args, &reply)
 	if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
 		return reply.Value
 	}
@@ -65,13 +110,15 @@ func (ck *Clerk) Lookup(key KeyType) ValueType {
 }
 
 // Perform Lookup to figure out which servers to Put to or Get from.
+// The host server takes the cluster most of its LookupPaths lookup
+// paths agree on.
 func (ck *Clerk) FindServers(key KeyType) ([]string, Err) {
 	lookup_args := &LookupArgs{}
 	lookup_reply := &LookupReply{}
 
 	lookup_args.Key = key
 
-	ok := call(ck.server, "WhanauServer.Lookup", lookup_args, &lookup_reply)
+	ok := call(ck.tr, ck.server, "WhanauServer.Lookup", lookup_args, &lookup_reply)
 
 	if ok && (lookup_reply.Err != ErrNoKey) {
 		return lookup_reply.Value.Servers, OK
@@ -90,13 +137,18 @@ func (ck *Clerk) Get(key KeyType, server_list []string) string {
 	get_args.Key = key
 	get_args.RequestID = NRand()
 
+	if replication == Byzantine {
+		return ck.getAgreed(get_args, server_list)
+	}
+
   
 	for _, server := range server_list {
 		//fmt.Printf("Get(): calling server %s\n", server)
-		ok := call(server, "WhanauServer.PaxosGetRPC", get_args,
+		ok := call(ck.tr, server, "WhanauServer.PaxosGetRPC", get_args,
 			&get_reply)
 		if ok && (get_reply.Err != ErrNoKey) &&
-			(get_reply.Err != ErrFailVerify) {
+			(get_reply.Err != ErrFailVerify) &&
+			(get_reply.Err != ErrWrongGroup) {
 			// TODO check data integrity
 			return get_reply.Value
 		}
@@ -107,6 +159,23 @@ func (ck *Clerk) Get(key KeyType, server_list []string) string {
 	return ErrNoKey
 }
 
+// Get from a Byzantine cluster: up to MaxFaulty members may lie, so
+// only take a value that MaxFaulty+1 members agree on.
+func (ck *Clerk) getAgreed(args *ClientGetArgs, server_list []string) string {
+	votes := make(map[string]int)
+	for _, server := range server_list {
+		var reply ClientGetReply
+		ok := call(ck.tr, server, "WhanauServer.PaxosGetRPC", args, &reply)
+		if ok && reply.Err == OK {
+			votes[reply.Value]++
+			if votes[reply.Value] > MaxFaulty {
+				return reply.Value
+			}
+		}
+	}
+	return ErrNoKey
+}
+
 // Client wrapper for Get.
 func (ck *Clerk) ClientGet(key KeyType) string {
 	server_list, err := ck.FindServers(key)
@@ -119,14 +188,52 @@ func (ck *Clerk) ClientGet(key KeyType) string {
 	return ErrNoKey
 }
 
+// How far a pending write made through the host server has got.
+func (ck *Clerk) PendingStatus(key KeyType) PendingStatusReply {
+	args := &PendingStatusArgs{key}
+	var reply PendingStatusReply
+	ok := call(ck.tr, ck.server, "WhanauServer.PendingStatusRPC", args, &reply)
+	if !ok {
+		reply.Err = ErrRPCCall
+	}
+	return reply
+}
+
+// Wait up to timeout for a pending write made through the host server
+// to be committed. Returns OK once it is, ErrLost if another server's
+// write to the key was taken instead, ErrNoKey if the host server made
+// no such write, and ErrPending if it is still on its way.
+func (ck *Clerk) WaitCommitted(key KeyType, timeout time.Duration) Err {
+	deadline := time.Now().Add(timeout)
+	for {
+		status := ck.PendingStatus(key)
+		if status.Err == ErrNoKey {
+			return ErrNoKey
+		}
+		if status.Err == OK && status.State == Committed {
+			return OK
+		}
+		if status.Err == OK && status.State == Lost {
+			return ErrLost
+		}
+		if !time.Now().Before(deadline) {
+			return ErrPending
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 // Client wrapper for Put.
 // If the key doesn't yet exist on the network, add it to pending
-// requests.
+// requests, and return ErrPending, ErrLost if another server's write
+// to the key was taken first, or ErrNoMaster if no master took it in
+// time. Returns ErrInSetup while the servers are in a setup
+// round; the Put should be tried again once the round is over.
 func (ck *Clerk) ClientPut(key KeyType, value string) Err {
 	args := &WhanauPutRPCArgs{key, value}
 	reply := &WhanauPutRPCReply{}
 
-	ok := call(ck.server, "WhanauServer.WhanauPutRPC", args, reply)
+	ok := call(ck.tr, ck.server, "WhanauServer.WhanauPutRPC", args, reply)
 
 	if ok {
 		return reply.Err
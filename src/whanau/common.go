@@ -3,6 +3,7 @@ package whanau
 import "math/big"
 import "crypto/rand"
 import "crypto/rsa"
+import "time"
 
 func NRand() int64 {
 	max := big.NewInt(int64(1) << 62)
@@ -18,7 +19,14 @@ const (
 	ErrWrongGroup = "ErrWrongGroup"
 	ErrPending    = "ErrPending"
 	ErrFailVerify = "ErrFailVerify"
-	ErrRPCCall    = "ErrRPCCall" // equivalent to "!ok" in call()
+	ErrRPCCall    = "ErrRPCCall"    // equivalent to "!ok" in call()
+	ErrBehind     = "ErrBehind"     // replica has not caught up that far
+	ErrNoReconfig = "ErrNoReconfig" // Byzantine clusters keep their members
+	ErrInSetup    = "ErrInSetup"    // a setup round is under way; retry the Put once it is over
+	ErrNoMaster   = "ErrNoMaster"   // no master (or coordinator) took a pending write
+	ErrPersist    = "ErrPersist"    // the replica could not make the change durable; retry
+	ErrLost       = "ErrLost"       // another server's pending write to the key was taken first
+	ErrWrongView  = "ErrWrongView"  // a coordinator is more than a view away from the write's server
 )
 
 // for 2PC
@@ -48,12 +56,27 @@ const (
 
 type Err string
 
+// How far a pending write has got into the DHT.
+type PendingState string
+
+const (
+	Queued    = "Queued"    // waiting for a setup round
+	Assigned  = "Assigned"  // its server has it, and is putting it in a cluster
+	Committed = "Committed" // in a cluster; lookups find it once the round is over
+	Lost      = "Lost"      // another server's write to the key was taken in its view
+)
+
 // for Paxos
 
 const (
-	GET     = "Get"
-	PUT     = "Put"
-	PENDING = "PendingWrite"
+	GET      = "Get"
+	PUT      = "Put"
+	PENDING  = "PendingWrite"
+	NOOP     = "NoOp"     // fills a log slot; changes nothing
+	RECONFIG = "Reconfig" // changes the cluster's members
+	EPOCH    = "Epoch"    // schedules the next setup round
+	HANDOFF  = "Handoff"  // pending writes made it into their clusters
+	COLLECT  = "Collect"  // reads the pending writes that go to a server
 )
 
 type Operation string
@@ -88,12 +111,102 @@ type Finger struct {
 // Global Parameters
 
 const (
-	PaxosSize = 5
 	PaxosWalk = 3
-	TIMEOUT   = 10 // number of retries in everything
+	TIMEOUT   = 10  // number of retries in everything
+	LogTail   = 100 // decided Paxos instances a replica keeps for lagging peers
+)
+
+// How many independent Try paths a lookup asks before it takes the
+// value most of them agree on. Sybils can answer with a forged value,
+// but only on the paths they are on.
+var LookupPaths = 3
+
+// The fewest paths that must find a value before a lookup takes the
+// one most of them agree on: a single answer is a single path's
+// word, and that path may be a Sybil's.
+var MinLookupAnswers = 2
+
+// Every node runs setup again once an epoch, so that new keys and
+// changes to the graph are picked up. The masters schedule each
+// epoch EpochLead ahead of its start, so word of it reaches every
+// node in time.
+var EpochLength = 30 * time.Minute
+
+const EpochLead = 2 * time.Second
+
+// How long a server keeps trying the masters with a pending write,
+// and how long it first waits before going round them again; the
+// wait doubles each round.
+var PendingTimeout = 10 * time.Second
+
+const PendingBackoff = 50 * time.Millisecond
+
+// The setup rounds a master holds on to a pending write for, in case
+// its server misses one.
+const PendingViews = 2
+
+// How key clusters keep their replicas in agreement.
+type Replication int
+
+const (
+	CrashFault Replication = iota // Paxos; members may crash
+	Byzantine                     // PBFT; members may also lie
+)
+
+// The number of faulty members a key cluster survives.
+const MaxFaulty = 2
+
+var (
+	replication = CrashFault
+	PaxosSize   = ClusterSize(CrashFault) // members of a key cluster
+)
+
+// The members a cluster needs to survive MaxFaulty faults of kind r.
+func ClusterSize(r Replication) int {
+	if r == Byzantine {
+		return 3*MaxFaulty + 1
+	}
+	return 2*MaxFaulty + 1
+}
+
+// Choose how the deployment replicates key clusters, before any
+// server starts. The master cluster always uses Paxos.
+func SetReplication(r Replication) {
+	replication = r
+	PaxosSize = ClusterSize(r)
+}
+
+// Where servers send writes to keys that are not in the DHT yet.
+type PendingRouting int
+
+const (
+	ViaMasters      PendingRouting = iota // the master cluster's log assigns them
+	ViaCoordinators                       // nodes the routing tables pick for each key
 )
 
+// The coordinators a pending write goes to, so that a few of them may
+// fail or lie.
+const NCoordinators = 2*MaxFaulty + 1
+
+var pendingRouting = ViaMasters
+
+// Choose where the deployment sends pending writes, before any
+// server starts.
+func SetPendingRouting(r PendingRouting) {
+	pendingRouting = r
+}
+
+// A write to a key that is not in the DHT yet. The masters' view is
+// the latest setup round they agreed on, and a coordinator's the
+// round it is in; a write made in view v is folded in by setup round
+// v+1.
 type PendingInsertsKey struct {
 	Key  KeyType
 	View int
 }
+
+// A pending write, and the server it goes to.
+type PendingWrite struct {
+	Value  TrueValueType
+	Server string
+}
@@ -0,0 +1,260 @@
+package whanau
+
+/*
+   Pending writes without the master cluster: each write goes to a
+   few coordinators that the routing tables pick for its key, and its
+   server collects it from them in the next setup round.
+
+   Up to MaxFaulty of the NCoordinators coordinators may fail or lie,
+   and each one decides by itself which server was first to write a
+   key. So a write is pending only once a majority of them took it
+   from its server, and the server puts in only the writes that a
+   majority sends it back the same. The write belongs to the view its
+   server is in, so that coordinators that have got to different
+   views still agree on it; a coordinator only turns it away if the
+   two are more than a view apart.
+*/
+
+import "fmt"
+import "math/rand"
+import "sort"
+
+// The coordinators for key: the nodes whose layer ids most closely
+// precede it, as far as our fingers know. Those are the nodes Try
+// would ask about the key, so they are much the same whichever
+// honest node asks. Fingers whose ids we could not get in setup are
+// missing, and if there are too few, the servers of the records in
+// our successor tables and db that most closely precede key make up
+// the rest.
+func (ws *WhanauServer) Coordinators(key KeyType) []string {
+	rt := ws.tables()
+
+	coords := make([]string, 0, NCoordinators)
+	seen := make(map[string]bool)
+	coords = precede(key, rt.fingers, coords, seen)
+	if len(coords) < NCoordinators {
+		records := append(append([][]Record{}, rt.succ...), rt.db)
+		coords = precede(key, recordFingers(records), coords, seen)
+	}
+	return coords
+}
+
+// Add to coords the addresses in tables, each sorted by id, that
+// most closely precede key, going round the layers in turn, until
+// there are NCoordinators.
+func precede(key KeyType, tables [][]Finger, coords []string,
+	seen map[string]bool) []string {
+	for d := 1; len(coords) < NCoordinators; d++ {
+		more := false
+		for _, layer := range tables {
+			if d > len(layer) {
+				continue
+			}
+			more = true
+			j := sort.Search(len(layer), func(i int) bool {
+				return layer[i].Id >= key
+			})
+			f := layer[(j-d+len(layer))%len(layer)]
+			if !seen[f.Address] && len(coords) < NCoordinators {
+				seen[f.Address] = true
+				coords = append(coords, f.Address)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return coords
+}
+
+// Tables of records, each sorted by key, as fingers to the servers
+// that hold them.
+func recordFingers(tables [][]Record) [][]Finger {
+	fingers := make([][]Finger, 0, len(tables))
+	for _, records := range tables {
+		layer := make([]Finger, 0, len(records))
+		for _, r := range records {
+			for _, srv := range r.Value.Servers {
+				layer = append(layer, Finger{r.Key, srv})
+			}
+		}
+		fingers = append(fingers, layer)
+	}
+	return fingers
+}
+
+// Hand a pending write to the coordinators of its key. It is pending
+// once a majority of NCoordinators gave the key to the same server in
+// the same view; if that is another server, the write lost to it.
+func (ws *WhanauServer) addPendingCoordinated(args *PendingArgs,
+	reply *PendingReply) {
+	coords := ws.Coordinators(args.Key)
+	ws.mu.Lock()
+	coord_args := &CoordinateArgs{args.Key, args.Value, args.Server, ws.epoch}
+	ws.mu.Unlock()
+
+	reply.Err = ErrNoMaster
+	type assignment struct {
+		server string
+		view   int
+	}
+	votes := make(map[assignment]int)
+	for _, srv := range coords {
+		var rpc_reply PendingReply
+		ok := call(ws.tr, srv, "WhanauServer.CoordinatePendingRPC",
+			coord_args, &rpc_reply)
+		if !ok || rpc_reply.Err != OK {
+			continue
+		}
+		if rpc_reply.Server == args.Server {
+			// we collect it from them in the next setup round.
+			ws.mu.Lock()
+			ws.coordinators[srv] = true
+			ws.mu.Unlock()
+		}
+
+		a := assignment{rpc_reply.Server, rpc_reply.View}
+		votes[a]++
+		if votes[a] > NCoordinators/2 {
+			reply.Err = ErrPending
+			reply.Server = a.server
+			reply.View = a.view
+		}
+	}
+}
+
+// Coordinator function
+// Hold on to a pending write until its server collects it. The first
+// server to write a key in a view gets it, as far as we know; the
+// other coordinators may have seen another server first. The view is
+// the server's, unless we are more than one away from it: a server
+// can only claim a view that the network is about to be in or has
+// just left.
+func (ws *WhanauServer) CoordinatePendingRPC(args *CoordinateArgs,
+	reply *PendingReply) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if args.View < ws.epoch-1 || args.View > ws.epoch+1 {
+		reply.View = ws.epoch
+		reply.Err = ErrWrongView
+		return nil
+	}
+	k := PendingInsertsKey{args.Key, args.View}
+	w, found := ws.coordinated[k]
+	if !found {
+		w = PendingWrite{args.Value, args.Server}
+		ws.coordinated[k] = w
+	}
+	reply.Server = w.Server
+	reply.View = k.View
+	reply.Err = OK
+	return nil
+}
+
+// Coordinator function
+// Like ReceiveNewPaxosCluster: send a server the pending writes it
+// got from the views before the setup round it is in. We hold on to
+// them until the server says they are in.
+func (ws *WhanauServer) CollectPendingRPC(args *ReceiveNewPaxosClusterArgs,
+	reply *ReceiveNewPaxosClusterReply) error {
+	send_keys := make(map[KeyType]TrueValueType)
+	views := make(map[KeyType]int)
+
+	// the latest view's, if a key was written in several, like
+	// LogCollect, so that the coordinators send the same.
+	ws.mu.Lock()
+	for k, w := range ws.coordinated {
+		if w.Server != args.Server || k.View >= args.Epoch {
+			continue
+		}
+		if view, ok := views[k.Key]; !ok || k.View > view {
+			send_keys[k.Key] = w.Value
+			views[k.Key] = k.View
+		}
+	}
+	ws.mu.Unlock()
+
+	reply.KV = send_keys
+	reply.Err = OK
+	return nil
+}
+
+// Let go of the pending writes a server says are in its cluster.
+func (ws *WhanauServer) ackCoordinated(args *AckPendingArgs) {
+	done := make(map[KeyType]bool)
+	for _, key := range args.Keys {
+		done[key] = true
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for k, w := range ws.coordinated {
+		if w.Server == args.Server && k.View < args.Epoch && done[k.Key] {
+			delete(ws.coordinated, k)
+		}
+	}
+}
+
+// The servers to collect our pending writes from in setup round
+// epoch, and the RPC that does it. Forget the writes we hold for
+// servers that never came for them.
+func (ws *WhanauServer) pendingSources(epoch int) ([]string, string) {
+	if pendingRouting == ViaMasters {
+		// any of them will do; setup stops at the first that answers.
+		sources := make([]string, 0, len(ws.masters))
+		for _, i := range rand.Perm(len(ws.masters)) {
+			sources = append(sources, ws.masters[i])
+		}
+		return sources, "WhanauServer.ReceiveNewPaxosCluster"
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for k := range ws.coordinated {
+		if k.View < epoch-PendingViews {
+			delete(ws.coordinated, k)
+		}
+	}
+	sources := make([]string, 0, len(ws.coordinators))
+	for srv := range ws.coordinators {
+		sources = append(sources, srv)
+	}
+	return sources, "WhanauServer.CollectPendingRPC"
+}
+
+// The pending writes to put in our cluster, given what each source
+// sent us. Any one master will do, since their log agrees; but only
+// writes that a majority of NCoordinators coordinators sent the same
+// can be trusted, since up to MaxFaulty of them may lie.
+func agreedPending(kvs map[string]map[KeyType]TrueValueType) map[KeyType]TrueValueType {
+	if pendingRouting == ViaMasters {
+		for _, kv := range kvs {
+			return kv
+		}
+		return make(map[KeyType]TrueValueType)
+	}
+
+	agreed := make(map[KeyType]TrueValueType)
+	votes := make(map[KeyType]map[string]int)
+	for _, kv := range kvs {
+		for k, v := range kv {
+			if votes[k] == nil {
+				votes[k] = make(map[string]int)
+			}
+			d := fmt.Sprint(v.TrueValue, v.Originator, v.Sign)
+			votes[k][d]++
+			if votes[k][d] > NCoordinators/2 {
+				agreed[k] = v
+			}
+		}
+	}
+	return agreed
+}
+
+// We have collected our pending writes from srv.
+func (ws *WhanauServer) collectedPending(srv string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	delete(ws.coordinators, srv)
+}
@@ -6,44 +6,59 @@ package whanau
 
 import "fmt"
 import "math/rand"
-import "strings"
-import "os"
-import "strconv"
 
 // Master node function
 // When a server tells the master node what paxos cluster it's a part
 // of, the master node sends it any pending writes that were assigned
-// to that server so the server can put it in the paxos cluster.
+// to that server so the server can put it in the paxos cluster: the
+// ones from the views before the setup round the server is in. The
+// writes stay in the masters' log until the server says they are in,
+// and any master can hand them out.
 func (ws *WhanauServer) ReceiveNewPaxosCluster(
 	args *ReceiveNewPaxosClusterArgs,
 	reply *ReceiveNewPaxosClusterReply) error {
-	ws.new_paxos_clusters = append(ws.new_paxos_clusters, args.Cluster)
-
-	// go through the dictionary to see if the master already
-	// has some keys for it
-	send_keys := make(map[KeyType]TrueValueType)
 	//fmt.Printf("looking for server %v\n", args.Server)
 	ws.mu.Lock()
-	for k, v := range ws.master_paxos_cluster.pending_writes {
-		if v == args.Server {
-			if value, found := ws.all_pending_writes[k]; found {
-				//fmt.Printf("found in pending writes %v\n", value)
-				send_keys[k.Key] = value
-				// deletes should be safe
-				//delete(ws.key_to_server, k)
-				delete(ws.all_pending_writes, k)
-				//fmt.Printf("send keys is now %v\n", send_keys)
-			}
-		}
-	}
+	ws.new_paxos_clusters = append(ws.new_paxos_clusters, args.Cluster)
 	ws.mu.Unlock()
 
-	reply.KV = send_keys
-	reply.Err = OK
+	// read them through the log: our replica need not have applied
+	// every write if the leader took it.
+	rpc_args := &PaxosCollectArgs{args.Server, args.Epoch, NRand(), false}
+	var rpc_reply PaxosCollectReply
+	ws.master_paxos_cluster.PaxosCollect(rpc_args, &rpc_reply)
+
+	reply.KV = rpc_reply.KV
+	reply.Err = rpc_reply.Err
 
 	return nil
 }
 
+// Master node function
+// A server has put the pending writes to args.Keys in its cluster.
+// Record it in the masters' log, so that no master hands them out
+// again. Any master can take this, in case the one that handed them
+// out has gone down.
+func (ws *WhanauServer) AckPendingRPC(args *AckPendingArgs,
+	reply *AckPendingReply) error {
+	if pendingRouting == ViaCoordinators {
+		ws.ackCoordinated(args)
+		reply.Err = OK
+		return nil
+	}
+	if ws.master_paxos_cluster == nil {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+
+	rpc_args := &PaxosHandoffArgs{args.Server, args.Epoch, args.Keys,
+		args.RequestID, false}
+	var rpc_reply PaxosHandoffReply
+	ws.master_paxos_cluster.PaxosHandoff(rpc_args, &rpc_reply)
+	reply.Err = rpc_reply.Err
+	return nil
+}
+
 // Join the cluster and add the new keys that this cluster is
 // responsible for.
 func (ws *WhanauServer) JoinClusterRPC(args *JoinClusterArgs,
@@ -53,37 +68,30 @@ func (ws *WhanauServer) JoinClusterRPC(args *JoinClusterArgs,
 
 	for k, _ := range args.KV {
 
-		if p, ok := ws.paxosInstances[k]; ok {
-			// WHEEEE :(
-			wp = &p
-		} else {
-			var index int
-			for idx, s := range args.NewCluster {
-				if s == ws.myaddr {
-					index = idx
-				}
+		ws.mu.Lock()
+		// we may hold k in the cluster an earlier round put it in;
+		// it moves to the new one.
+		var index int
+		for idx, s := range args.NewCluster {
+			if s == ws.myaddr {
+				index = idx
 			}
+		}
 
-			uid := ""
-			for _, srv := range args.NewCluster {
-				uid += strings.Join(strings.Split(srv, "/var/tmp/824-"+strconv.Itoa(os.Getuid())+"/"), "")
-			}
-			uid = getShaHash(uid)
-			if new_wp, found := ws.FindWPInstanceIfCreated(uid); !found {
-				wp = StartWhanauPaxos(args.NewCluster, index, uid, ws.rpc)
-			} else {
-				wp = &new_wp
-			}
+		uid := ClusterUID(args.NewCluster)
+		if new_wp, found := ws.FindWPInstanceIfCreated(uid); !found {
+			wp = startKeyCluster(args.NewCluster, index, uid, ws.rpc, ws.tr, ws.dir)
+		} else {
+			wp = new_wp
 		}
 
 		// initiate paxos call for all of these keys
 
 		// put into one's own kvstore
-		ws.mu.Lock()
 		if ws.myaddr == args.Server {
 			ws.kvstore[k] = ValueType{args.NewCluster}
 		}
-		ws.paxosInstances[k] = *wp
+		ws.paxosInstances[k] = wp
 		ws.mu.Unlock()
 	}
 
@@ -111,20 +119,16 @@ func (ws *WhanauServer) InitPaxosCluster(args *InitPaxosClusterArgs, reply *Init
 				ws.kvstore[k] = ValueType{servers}
 				fmt.Printf("\ninitiating wp in server %v ... \n\n", ws.me)
 				// create new paxos cluster
-				uid := ""
-				for _, srv := range servers {
-					uid += strings.Join(strings.Split(srv, "/var/tmp/824-"+strconv.Itoa(os.Getuid())+"/"), "")
-				}
-				uid = getShaHash(uid)
+				uid := ClusterUID(servers)
 
 				var wp *WhanauPaxos
 				if new_wp, found := ws.FindWPInstanceIfCreated(uid); !found {
-					wp = StartWhanauPaxos(servers, index, uid, ws.rpc)
+					wp = startKeyCluster(servers, index, uid, ws.rpc, ws.tr, ws.dir)
 				} else {
-					wp = &new_wp
+					wp = new_wp
 				}
-				ws.paxosInstances[k] = *wp
-				ws.paxosInstances[k].db[k] = v
+				ws.paxosInstances[k] = wp
+				wp.Preload(k, v)
 				ws.mu.Unlock()
 			}
 		} else {
@@ -147,7 +151,7 @@ func (ws *WhanauServer) ConstructPaxosCluster() []string {
 		args := &RandomWalkArgs{}
 		args.Steps = PaxosWalk
 		var reply RandomWalkReply
-		ok := call(neighbor, "WhanauServer.RandomWalk", args, &reply)
+		ok := call(ws.tr, neighbor, "WhanauServer.RandomWalk", args, &reply)
 		if ok && (reply.Err == OK) {
 
 			if _, found := cluster[reply.Server]; found || reply.Server == ws.myaddr {
@@ -170,7 +174,7 @@ func (ws *WhanauServer) ConstructPaxosCluster() []string {
 		args.RequestServer = ws.myaddr
 		args.Phase = PhaseOne
 		args.Action = ""
-		ok := call(c, "WhanauServer.InitPaxosCluster", args, &reply)
+		ok := call(ws.tr, c, "WhanauServer.InitPaxosCluster", args, &reply)
 		if ok && (reply.Err == OK) {
 			if reply.Reply == Reject {
 				if_commit = false
@@ -192,7 +196,7 @@ func (ws *WhanauServer) ConstructPaxosCluster() []string {
 			args.Action = Abort
 		}
 
-		ok := call(c, "WhanauServer.InitPaxosCluster", args, &reply)
+		ok := call(ws.tr, c, "WhanauServer.InitPaxosCluster", args, &reply)
 		if ok && (reply.Err == OK) {
 		}
 	}
@@ -206,3 +210,145 @@ func (ws *WhanauServer) ConstructPaxosCluster() []string {
 
 	return ret
 }
+
+// Replace member old of the cluster that stores key with
+// replacement. The change goes through the cluster's log, and
+// replacement then fetches the cluster's state from the others, so
+// nothing stored is lost.
+func (ws *WhanauServer) ReplaceReplica(key KeyType, old string,
+	replacement string) Err {
+	ws.mu.Lock()
+	wp, ok := ws.paxosInstances[key]
+	ws.mu.Unlock()
+	if !ok {
+		return ErrNoKey
+	}
+
+	servers := wp.Servers()
+	found := false
+	for i, srv := range servers {
+		if srv == replacement {
+			return OK // already a member
+		}
+		if srv == old {
+			servers[i] = replacement
+			found = true
+		}
+	}
+	if !found {
+		return ErrWrongGroup
+	}
+
+	args := &PaxosReconfigArgs{servers, NRand(), false}
+	var reply PaxosReconfigReply
+	wp.PaxosReconfig(args, &reply)
+	if reply.Err != OK {
+		return reply.Err
+	}
+
+	ws.mu.Lock()
+	keys := make([]KeyType, 0)
+	for k, p := range ws.paxosInstances {
+		if p == wp {
+			keys = append(keys, k)
+			if _, routed := ws.kvstore[k]; routed {
+				ws.kvstore[k] = ValueType{servers}
+			}
+			if old == ws.myaddr {
+				delete(ws.paxosInstances, k)
+			}
+		}
+	}
+	ws.mu.Unlock()
+
+	jargs := &JoinReplicaArgs{wp.uid, servers, reply.From, keys}
+	var jreply JoinReplicaReply
+	if !call(ws.tr, replacement, "WhanauServer.JoinReplicaRPC", jargs, &jreply) {
+		return ErrRPCCall
+	}
+	return jreply.Err
+}
+
+// Start our replica of a cluster we were added to by ReplaceReplica.
+func (ws *WhanauServer) JoinReplicaRPC(args *JoinReplicaArgs,
+	reply *JoinReplicaReply) error {
+	index := IndexOf(ws.myaddr, args.Servers)
+	if index < 0 {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+
+	ws.mu.Lock()
+	wp, found := ws.FindWPInstanceIfCreated(args.Uid)
+	ws.mu.Unlock()
+	if !found {
+		wp = JoinWhanauPaxos(args.Servers, index, args.Uid, args.From,
+			ws.rpc, ws.tr, ws.dir)
+	}
+
+	ws.mu.Lock()
+	for _, k := range args.Keys {
+		ws.paxosInstances[k] = wp
+	}
+	ws.mu.Unlock()
+
+	reply.Err = OK
+	return nil
+}
+
+// Replace the members of the clusters we lead that are dead, or in
+// suspects (say, because they look like Sybils), with neighbors that
+// are neither.
+func (ws *WhanauServer) RepairClusters(suspects map[string]bool) {
+	ws.mu.Lock()
+	clusters := make(map[*WhanauPaxos]KeyType)
+	for k, wp := range ws.paxosInstances {
+		clusters[wp] = k
+	}
+	ws.mu.Unlock()
+
+	for wp, key := range clusters {
+		if wp.bft {
+			// its members are fixed, and it survives liars anyway.
+			continue
+		}
+		// one member repairs the cluster, not all of them at once.
+		if leader, ok := wp.px.Leader(); !ok || leader != ws.myaddr {
+			continue
+		}
+		for _, member := range wp.Servers() {
+			if member == ws.myaddr ||
+				(!suspects[member] && ws.isAlive(member)) {
+				continue
+			}
+			replacement, ok := ws.chooseReplacement(wp.Servers(), suspects)
+			if !ok {
+				break
+			}
+			DPrintf("server %v replacing %v with %v", ws.myaddr, member,
+				replacement)
+			ws.ReplaceReplica(key, member, replacement)
+		}
+	}
+}
+
+// A live neighbor that is neither in servers nor in suspects.
+func (ws *WhanauServer) chooseReplacement(servers []string,
+	suspects map[string]bool) (string, bool) {
+	for _, i := range rand.Perm(len(ws.neighbors)) {
+		candidate := ws.neighbors[i]
+		if candidate == ws.myaddr || suspects[candidate] ||
+			IndexOf(candidate, servers) >= 0 {
+			continue
+		}
+		if ws.isAlive(candidate) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+func (ws *WhanauServer) isAlive(srv string) bool {
+	var reply GetIdReply
+	return call(ws.tr, srv, "WhanauServer.GetId", &GetIdArgs{0}, &reply)
+}
@@ -2,14 +2,15 @@
 
 package whanau
 
-import "math/rand"
 import "sort"
 
 //import "time"
-//import "fmt"
+import "fmt"
 
 // Returns randomly chosen finger and randomly chosen layer as part of lookup
 func (ws *WhanauServer) ChooseFinger(x0 KeyType, key KeyType, nlayers int) (Finger, int) {
+	fingers := ws.tables().fingers
+
 	// find all fingers from all layers such that the key falls
 	// between x0 and the finger id
 	candidateFingers := make([][]Finger, 0)
@@ -17,11 +18,11 @@ func (ws *WhanauServer) ChooseFinger(x0 KeyType, key KeyType, nlayers int) (Fing
 	layerMap := make([]int, 0)
 	counter := 0
 	for i := 0; i < nlayers; i++ {
-		DPrintf("ws.fingers[%d]: %s", i, ws.fingers[i])
-		for j := 0; j < len(ws.fingers[i]); j++ {
+		DPrintf("ws.fingers[%d]: %s", i, fingers[i])
+		for j := 0; j < len(fingers[i]); j++ {
 
 			// compare x0 <= id <= key on a circle
-			id := ws.fingers[i][j].Id
+			id := fingers[i][j].Id
 			if x0 <= key {
 				if x0 <= id && id <= key {
 					if len(candidateFingers) <= counter {
@@ -29,12 +30,12 @@ func (ws *WhanauServer) ChooseFinger(x0 KeyType, key KeyType, nlayers int) (Fing
 						newLayer := make([]Finger, 0)
 						candidateFingers = append(candidateFingers, newLayer)
 						candidateFingers[counter] = append(
-							candidateFingers[counter], ws.fingers[i][j])
+							candidateFingers[counter], fingers[i][j])
 						layerMap = append(layerMap, i)
 						counter++
 					} else {
 						candidateFingers[counter] = append(
-							candidateFingers[counter], ws.fingers[i][j])
+							candidateFingers[counter], fingers[i][j])
 					}
 				}
 			} else {
@@ -45,12 +46,12 @@ func (ws *WhanauServer) ChooseFinger(x0 KeyType, key KeyType, nlayers int) (Fing
 						newLayer := make([]Finger, 0)
 						candidateFingers = append(candidateFingers, newLayer)
 						candidateFingers[counter] = append(
-							candidateFingers[counter], ws.fingers[i][j])
+							candidateFingers[counter], fingers[i][j])
 						layerMap = append(layerMap, i)
 						counter++
 					} else {
 						candidateFingers[counter] = append(
-							candidateFingers[counter], ws.fingers[i][j])
+							candidateFingers[counter], fingers[i][j])
 					}
 				}
 			}
@@ -60,28 +61,21 @@ func (ws *WhanauServer) ChooseFinger(x0 KeyType, key KeyType, nlayers int) (Fing
 	DPrintf("len(candidateFingers): %d, len(layerMap): %d", len(candidateFingers), len(layerMap))
 	// pick random layer out of nonempty candidate fingers
 	if len(candidateFingers) > 0 {
-		randIndex := rand.Intn(len(candidateFingers))
-		finger := candidateFingers[randIndex][rand.Intn(len(candidateFingers[randIndex]))]
+		randIndex := randIntn(len(candidateFingers))
+		finger := candidateFingers[randIndex][randIntn(len(candidateFingers[randIndex]))]
 		return finger, layerMap[randIndex]
 	}
 
 	// if can't find any, randomly choose layer and randomly return finger
 	// TODO probably shouldn't get here?
-	randLayer := rand.Intn(len(ws.fingers))
-	randfinger := ws.fingers[randLayer][rand.Intn(len(ws.fingers[randLayer]))]
+	randLayer := randIntn(len(fingers))
+	randfinger := fingers[randLayer][randIntn(len(fingers[randLayer]))]
 	return randfinger, randLayer
 }
 
 // Query for a key in the successor table
 func (ws *WhanauServer) Query(args *QueryArgs, reply *QueryReply) error {
-	var queryReply QueryReply
-	if !ws.is_sybil {
-		layer := args.Layer
-		key := args.Key
-		queryReply = ws.HonestQuery(key, layer)
-	} else {
-		queryReply = ws.SybilQuery()
-	}
+	queryReply := ws.behavior.Query(ws, args.Key, args.Layer)
 	reply.Value = queryReply.Value
 	reply.Err = queryReply.Err
 	//fmt.Printf("Ending query search: %s", ws.myaddr)
@@ -90,20 +84,21 @@ func (ws *WhanauServer) Query(args *QueryArgs, reply *QueryReply) error {
 
 // Honest query
 func (ws *WhanauServer) HonestQuery(key KeyType, layer int) QueryReply {
+	succ := ws.tables().succ
 	var reply QueryReply
 	//fmt.Printf("Starting binary search: %s", ws.myaddr)
 	var valueIndex int
-	if layer < len(ws.succ) {
-		valueIndex = sort.Search(len(ws.succ[layer]), func(valueIndex int) bool {
-			return ws.succ[layer][valueIndex].Key >= key
+	if layer < len(succ) {
+		valueIndex = sort.Search(len(succ[layer]), func(valueIndex int) bool {
+			return succ[layer][valueIndex].Key >= key
 		})
 	} else {
 		valueIndex = -1
 	}
 	//fmt.Printf("Ending binary search: %s", ws.myaddr)
-	if valueIndex != -1 && valueIndex < len(ws.succ[layer]) && valueIndex < len(ws.succ[layer]) && ws.succ[layer][valueIndex].Key == key {
+	if valueIndex != -1 && valueIndex < len(succ[layer]) && succ[layer][valueIndex].Key == key {
 		DPrintf("In Query: found the key!!!! %v\n", key)
-		reply.Value = ws.succ[layer][valueIndex].Value
+		reply.Value = succ[layer][valueIndex].Value
 		DPrintf("reply.Value: %s\n", reply.Value)
 		reply.Err = OK
 	} else {
@@ -123,13 +118,7 @@ func (ws *WhanauServer) SybilQuery() QueryReply {
 
 // Try finds the value associated with the key
 func (ws *WhanauServer) Try(args *TryArgs, reply *TryReply) error {
-	var tryReply TryReply
-	if !ws.is_sybil {
-		key := args.Key
-		tryReply = ws.HonestTry(key)
-	} else {
-		tryReply = ws.SybilTry()
-	}
+	tryReply := ws.behavior.Try(ws, args.Key)
 	reply.Value = tryReply.Value
 	reply.Err = tryReply.Err
 	return nil
@@ -151,11 +140,12 @@ func (ws *WhanauServer) HonestTry(key KeyType) TryReply {
 	}
 
 	var fingerLength int
-  DPrintf("ws.fingers: %s", ws.fingers)
-	if len(ws.fingers) > 0 {
-		fingerLength = len(ws.fingers[0])
+	fingers := ws.tables().fingers
+  DPrintf("ws.fingers: %s", fingers)
+	if len(fingers) > 0 && len(fingers[0]) > 0 {
+		fingerLength = len(fingers[0])
 		j := sort.Search(fingerLength, func(i int) bool {
-			return ws.fingers[0][i].Id >= key
+			return fingers[0][i].Id >= key
 		})
 		j = j % fingerLength
 		if j < 0 {
@@ -166,10 +156,10 @@ func (ws *WhanauServer) HonestTry(key KeyType) TryReply {
 		queryArgs := &QueryArgs{}
 		queryReply := &QueryReply{}
 		for queryReply.Err != OK && count < TIMEOUT {
-			f, i := ws.ChooseFinger(ws.fingers[0][j].Id, key, nlayers)
+			f, i := ws.ChooseFinger(fingers[0][j].Id, key, nlayers)
 			queryArgs.Key = key
 			queryArgs.Layer = i
-			call(f.Address, "WhanauServer.Query", queryArgs, queryReply)
+			call(ws.tr, f.Address, "WhanauServer.Query", queryArgs, queryReply)
 			j = j - 1
 			j = j % fingerLength
 			if j < 0 {
@@ -205,14 +195,9 @@ func (ws *WhanauServer) SybilTry() TryReply {
 // Called by servers to figure out which paxos cluster
 // to get the true value from.
 func (ws *WhanauServer) Lookup(args *LookupArgs, reply *LookupReply) error {
-	var lookupReply LookupReply
-	if !ws.is_sybil {
-		key := args.Key
-		steps := ws.w
-		lookupReply = ws.HonestLookup(key, steps)
-	} else {
-		lookupReply = ws.SybilLookup()
-	}
+	defer ws.finishRequest(ws.startRequest())
+
+	lookupReply := ws.behavior.Lookup(ws, args.Key, ws.w)
 	reply.Value = lookupReply.Value
 	reply.Err = lookupReply.Err
 	//fmt.Printf("Lookup returned %v\n", reply.Value)
@@ -220,35 +205,64 @@ func (ws *WhanauServer) Lookup(args *LookupArgs, reply *LookupReply) error {
 }
 
 // Helper method for honest lookup
+// Try key from LookupPaths different servers, and take the value
+// more than half of the paths that found anything found, so that a
+// Sybil on one path cannot forge it. Paths that found nothing, say
+// because their servers are gone, don't count against it. ErrNoKey
+// if no value has that many, or fewer than MinLookupAnswers paths
+// found anything.
 func (ws *WhanauServer) HonestLookup(key KeyType, steps int) LookupReply {
 	DPrintf("In Lookup key: %s server %s", key, ws.myaddr)
 	reply := LookupReply{}
 
+	// our own keys need no checking.
+	if val, ok := ws.kvstore[key]; ok {
+		reply.Value = val
+		reply.Err = OK
+		return reply
+	}
+
 	addr := ws.myaddr
 	count := 0
 
 	tryArgs := &TryArgs{key}
-	tryReply := &TryReply{}
-
-	for tryReply.Err != OK && count < TIMEOUT {
-		call(addr, "WhanauServer.Try", tryArgs, tryReply)
+	votes := make(map[string]int)
+	npaths := 0
+	best := 0
+
+	for npaths < LookupPaths && count < TIMEOUT {
+		tryReply := &TryReply{}
+		call(ws.tr, addr, "WhanauServer.Try", tryArgs, tryReply)
+		if tryReply.Err == OK {
+			npaths++
+			v := fmt.Sprint(tryReply.Value.Servers)
+			votes[v]++
+			if votes[v] > best {
+				best = votes[v]
+				reply.Value = tryReply.Value
+			}
+		}
 		/*randomWalkArgs := &RandomWalkArgs{steps}
 		randomWalkReply := &RandomWalkReply{}
-		call(ws.myaddr, "WhanauServer.RandomWalk", randomWalkArgs, randomWalkReply)
+		call(ws.tr, ws.myaddr, "WhanauServer.RandomWalk", randomWalkArgs, randomWalkReply)
 		if randomWalkReply.Err == OK {
 			addr = randomWalkReply.Server
 		}*/
 
 		// Get a server from the lookup cache reserve
-		addr, _ = ws.GetLookupServer()
+		var ok bool
+		if addr, ok = ws.GetLookupServer(); !ok {
+			// no other servers to try from yet
+			break
+		}
 		count++
 	}
 
-	if tryReply.Err == OK {
-		value := tryReply.Value
-		reply.Value = value
+	// a value that only ties another may as well be the forged one.
+	if npaths >= MinLookupAnswers && best > npaths/2 {
 		reply.Err = OK
 	} else {
+		reply.Value = ValueType{}
 		reply.Err = ErrNoKey
 	}
 	return reply
@@ -263,12 +277,7 @@ func (ws *WhanauServer) SybilLookup() LookupReply {
 
 // return random Key/value record from local storage
 func (ws *WhanauServer) SampleRecord(args *SampleRecordArgs, reply *SampleRecordReply) error {
-	var samplereply SampleRecordReply
-	if ws.is_sybil {
-		samplereply = ws.SybilSampleRecord()
-	} else {
-		samplereply = ws.HonestSampleRecord()
-	}
+	samplereply := ws.behavior.SampleRecord(ws)
 	reply.Record = samplereply.Record
 	reply.Err = samplereply.Err
 	return nil
@@ -281,11 +290,13 @@ func (ws *WhanauServer) HonestSampleRecord() SampleRecordReply {
     sampleRecordReply.Err = ErrNoKey
     return sampleRecordReply
   }
-	randIndex := rand.Intn(len(ws.kvstore))
+	randIndex := randIntn(len(ws.kvstore))
 	keys := make([]KeyType, 0)
 	for k, _ := range ws.kvstore {
 		keys = append(keys, k)
 	}
+	// in order, so that a seeded run picks the same.
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
 	key := keys[randIndex]
 	value := ws.kvstore[key]
 	record := Record{key, value}
@@ -331,7 +342,7 @@ func (ws *WhanauServer) SampleRecords(rd int, steps int) []Record {
 		srreply := &SampleRecordReply{}
 		counter = 0
 		for srreply.Err != OK && counter < TIMEOUT {
-			call(server, "WhanauServer.SampleRecord", srargs, srreply)
+			call(ws.tr, server, "WhanauServer.SampleRecord", srargs, srreply)
       counter++
 		}
 
@@ -372,7 +383,7 @@ func (ws *WhanauServer) ConstructFingers(layer int) []Finger {
     counter = 0
 		for (!ok || (getIdReply.Err != OK)) && counter < TIMEOUT {
 			DPrintf("rpc to getid of %s from ConstructFingers %s layer %d", server, ws.myaddr, layer)
-			ok = call(server, "WhanauServer.GetId", getIdArg, getIdReply)
+			ok = call(ws.tr, server, "WhanauServer.GetId", getIdArg, getIdReply)
 			counter++
 		}
 
@@ -388,33 +399,30 @@ func (ws *WhanauServer) ConstructFingers(layer int) []Finger {
 // Choose id for specified layer
 func (ws *WhanauServer) ChooseID(layer int) KeyType {
 	//fmt.Printf("Currently choosing id: %s \n", ws.myaddr)
-	if ws.is_sybil {
-		return ws.SybilChooseID(layer)
-	} else {
-		return ws.HonestChooseID(layer)
-	}
+	return ws.behavior.ChooseID(ws, layer)
 }
 
 // Honest choose id
 func (ws *WhanauServer) HonestChooseID(layer int) KeyType {
+	rt := ws.setupTables()
 	//fmt.Printf("In ChooseID of honest %s, layer %d \n", ws.myaddr, layer)
-  if len(ws.db) < 1 {
+  if len(rt.db) < 1 {
     return ErrNoKey
   }
 
 	if layer == 0 {
 		// choose randomly from db
-		randIndex := rand.Intn(len(ws.db))
-		record := ws.db[randIndex]
-		DPrintf("record.Key", record.Key)
+		randIndex := randIntn(len(rt.db))
+		record := rt.db[randIndex]
+		DPrintf("record.Key %v", record.Key)
 		return record.Key
 
 	} else {
 		// choose finger randomly from layer - 1, use id of that finger
-    if len(ws.fingers[layer-1]) == 0 {
+    if len(rt.fingers[layer-1]) == 0 {
       return ErrNoKey
     }
-		randFinger := ws.fingers[layer-1][rand.Intn(len(ws.fingers[layer-1]))]
+		randFinger := rt.fingers[layer-1][randIntn(len(rt.fingers[layer-1]))]
 		return randFinger.Id
 	}
 }
@@ -435,25 +443,34 @@ func (ws *WhanauServer) SampleSuccessors(args *SampleSuccessorsArgs, reply *Samp
 	//defer fmt.Printf("SAMPLESUCCESSORS in server %v took %v\n",
 	//	ws.myaddr, time.Since(start))
 
-	key := args.Key
+	successorsReply := ws.behavior.SampleSuccessors(ws, args.Key)
+	reply.Successors = successorsReply.Successors
+	reply.Err = successorsReply.Err
+	return nil
+}
+
+// Honest sample successors: the records in our db from key on
+func (ws *WhanauServer) HonestSampleSuccessors(key KeyType) SampleSuccessorsReply {
+	var reply SampleSuccessorsReply
+	db := ws.setupTables().db
 	records := make([]Record, ws.t*2)
 	//fmt.Printf("Sampling successors: %s \n", ws.myaddr)
-	if ws.t <= len(ws.db) {
-		firstRecord := PositionOf(key, ws.db)
-		remaining := len(ws.db) - firstRecord
+	if ws.t <= len(db) {
+		firstRecord := PositionOf(key, db)
+		remaining := len(db) - firstRecord
 		if remaining >= ws.t {
-			copy(records, ws.db[firstRecord:firstRecord+ws.t])
+			copy(records, db[firstRecord:firstRecord+ws.t])
 		} else {
 			headIdx := ws.t - remaining
-			copy(records, ws.db[firstRecord:])
-			copy(records, ws.db[:headIdx])
+			copy(records, db[firstRecord:])
+			copy(records, db[:headIdx])
 		}
 		reply.Successors = records
 		reply.Err = OK
 	} else {
 		reply.Err = ErrNoKey
 	}
-	return nil
+	return reply
 }
 
 func (ws *WhanauServer) Successors(layer int) []Record {
@@ -462,7 +479,8 @@ func (ws *WhanauServer) Successors(layer int) []Record {
 	//	ws.myaddr, time.Since(start))
 
 	//fmt.Printf("In Sucessors of %s, layer %d \n", ws.myaddr, layer)
-  if layer >= len(ws.ids) || len(ws.ids[layer]) < 1 {
+	ids := ws.setupTables().ids
+  if layer >= len(ids) || len(ids[layer]) < 1 {
     return make([]Record, 0)
   }
 
@@ -480,11 +498,11 @@ func (ws *WhanauServer) Successors(layer int) []Record {
 			vj := reply.Server
 
 			//fmt.Printf("random walk reply: %s \n", vj)
-			sampleSuccessorsArgs := &SampleSuccessorsArgs{ws.ids[layer]}
+			sampleSuccessorsArgs := &SampleSuccessorsArgs{ids[layer]}
 			sampleSuccessorsReply := &SampleSuccessorsReply{}
 			for sampleSuccessorsReply.Err != OK && counter < maxIteration {
 				counter++
-				call(vj, "WhanauServer.SampleSuccessors",
+				call(ws.tr, vj, "WhanauServer.SampleSuccessors",
 					sampleSuccessorsArgs, sampleSuccessorsReply)
 			}
 
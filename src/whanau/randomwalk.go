@@ -2,31 +2,11 @@
 
 package whanau
 
-import "math/rand"
-
 // Random walk
 func (ws *WhanauServer) RandomWalk(args *RandomWalkArgs, reply *RandomWalkReply) error {
-	var randomWalkReply RandomWalkReply
-	if ws.is_sybil {
-		randomWalkReply = ws.SybilRandomWalk()
-		reply.Server = randomWalkReply.Server
-		reply.Err = randomWalkReply.Err
-	} else {
-		//fmt.Printf("Doing an honest random walk\n")
-		//randomWalkReply = ws.HonestRandomWalk(steps)
-		nextServer, ok := ws.GetNextRWServer()
-		if !ok {
-			// Ran out of servers!!
-			// Just go ahead and do a regular random walk
-			steps := args.Steps
-			randomWalkReply = ws.HonestRandomWalk(steps)
-			reply.Server = randomWalkReply.Server
-			reply.Err = randomWalkReply.Err
-		} else {
-			reply.Server = nextServer
-			reply.Err = OK
-		}
-	}
+	randomWalkReply := ws.behavior.RandomWalk(ws, args.Steps)
+	reply.Server = randomWalkReply.Server
+	reply.Err = randomWalkReply.Err
 	//fmt.Printf("Random walk reply: %s", randomWalkReply)
 	return nil
 }
@@ -36,7 +16,7 @@ func (ws *WhanauServer) HonestRandomWalk(steps int) RandomWalkReply {
 	//fmt.Printf("In honest node random walk: %s", ws.myaddr)
 	var reply RandomWalkReply
 	// pick a random neighbor
-	randIndex := rand.Intn(len(ws.neighbors))
+	randIndex := randIntn(len(ws.neighbors))
 	neighbor := ws.neighbors[randIndex]
 	if steps == 1 {
 		reply.Server = neighbor
@@ -45,7 +25,7 @@ func (ws *WhanauServer) HonestRandomWalk(steps int) RandomWalkReply {
 		args := RandomWalkArgs{}
 		args.Steps = steps - 1
 		var rpc_reply RandomWalkReply
-		ok := call(neighbor, "WhanauServer.RandomWalk", args, &rpc_reply)
+		ok := call(ws.tr, neighbor, "WhanauServer.RandomWalk", args, &rpc_reply)
 		if ok && (rpc_reply.Err == OK) {
 			reply.Server = rpc_reply.Server
 			reply.Err = OK
@@ -62,7 +42,7 @@ func (ws *WhanauServer) SybilRandomWalk() RandomWalkReply {
 	// testing assumption for breaking cluster attacks
 
 	if len(ws.neighbors) > 0 {
-		randIndex := rand.Intn(len(ws.neighbors))
+		randIndex := randIntn(len(ws.neighbors))
 		neighbor := ws.neighbors[randIndex]
 		return RandomWalkReply{neighbor, OK}
 	} else {
@@ -72,13 +52,22 @@ func (ws *WhanauServer) SybilRandomWalk() RandomWalkReply {
 
 // Gets the ID from node's local id table
 func (ws *WhanauServer) GetId(args *GetIdArgs, reply *GetIdReply) error {
-	layer := args.Layer
+	getIdReply := ws.behavior.GetId(ws, args.Layer)
+	reply.Key = getIdReply.Key
+	reply.Err = getIdReply.Err
+	return nil
+}
+
+// Honest get id
+func (ws *WhanauServer) HonestGetId(layer int) GetIdReply {
+	var reply GetIdReply
 	//DPrintf("In getid, len(ws.ids): %d layer: %d", len(ws.ids), layer)
 	// gets the id associated with a layer
-	if 0 <= layer && layer < len(ws.ids) {
-		id := ws.ids[layer]
+	ids := ws.setupTables().ids
+	if 0 <= layer && layer < len(ids) {
+		id := ids[layer]
 		reply.Key = id
 		reply.Err = OK
 	}
-	return nil
+	return reply
 }
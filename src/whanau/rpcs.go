@@ -1,5 +1,7 @@
 package whanau
 
+import "time"
+
 type LookupArgs struct {
 	Key        KeyType
 	RoutedFrom []string // servers that have already tried to serve this key
@@ -17,8 +19,32 @@ type PendingArgs struct {
 	Server string
 }
 
+// A pending write handed to a coordinator, in the view its server is
+// in.
+type CoordinateArgs struct {
+	Key    KeyType
+	Value  TrueValueType
+	Server string
+	View   int
+}
+
 type PendingReply struct {
-	Err Err
+	Err    Err
+	Server string // the server the write goes to
+	View   int    // the view the write belongs to
+}
+
+type PendingStatusArgs struct {
+	Key KeyType
+}
+
+// View is the view the write belongs to while it is Queued, and the
+// setup round that took it in after.
+type PendingStatusReply struct {
+	State  PendingState
+	Server string
+	View   int
+	Err    Err
 }
 
 type PutReply struct {
@@ -108,6 +134,7 @@ type PutIdReply struct {
 type PaxosGetArgs struct {
 	Key       KeyType
 	RequestID int64
+	Forwarded bool // already sent on to the leader once
 }
 
 type PaxosGetReply struct {
@@ -119,6 +146,7 @@ type PaxosPutArgs struct {
 	Key       KeyType
 	Value     TrueValueType
 	RequestID int64
+	Forwarded bool
 }
 
 type PaxosPutReply struct {
@@ -127,16 +155,99 @@ type PaxosPutReply struct {
 
 type PaxosPendingInsertsArgs struct {
 	Key       KeyType
-	View      int
+	Value     TrueValueType
 	Server    string
 	RequestID int64
+	Forwarded bool
 }
 
 type PaxosPendingInsertsReply struct {
-	Server string
+	Server string // the server the write goes to
+	View   int    // the view the write belongs to
 	Err    Err
 }
 
+// Agree on when the next setup round starts.
+type PaxosEpochArgs struct {
+	Epoch     int       // the epoch to start
+	Start     time.Time // when, unless another start was agreed first
+	RequestID int64
+	Forwarded bool
+}
+
+type PaxosEpochReply struct {
+	Epoch int // the latest epoch agreed on
+	Start time.Time
+	Err   Err
+}
+
+// Record that Server has put its pending writes to Keys, from the
+// views before Epoch, in its cluster.
+type PaxosHandoffArgs struct {
+	Server    string
+	Epoch     int
+	Keys      []KeyType
+	RequestID int64
+	Forwarded bool
+}
+
+type PaxosHandoffReply struct {
+	Err Err
+}
+
+// Read the pending writes that go to Server, from the views before
+// Epoch.
+type PaxosCollectArgs struct {
+	Server    string
+	Epoch     int
+	RequestID int64
+	Forwarded bool
+}
+
+type PaxosCollectReply struct {
+	KV  map[KeyType]TrueValueType
+	Err Err
+}
+
+// Change the members of a cluster through its log.
+type PaxosReconfigArgs struct {
+	Servers   []string // the members from now on
+	RequestID int64
+	Forwarded bool
+}
+
+type PaxosReconfigReply struct {
+	From int // the first instance the new members agree on
+	Err  Err
+}
+
+// Ask a replica to apply the log up to a change of members.
+type PaxosApplyArgs struct {
+	Seq int
+}
+
+type PaxosApplyReply struct {
+	Err Err
+}
+
+// Ask a replica for its state, to catch up past compacted instances.
+type FetchSnapshotArgs struct {
+	Seq        int // the first instance the caller is missing
+	Checkpoint int // bft only: the checkpoint wanted, or 0 for the latest
+}
+
+type FetchSnapshotReply struct {
+	Err             Err
+	Seq             int // the state covers every instance < Seq
+	View            int
+	EpochStart      time.Time
+	Servers         []string // the members as of Seq
+	ServersFrom     int      // the instance they took over at
+	DB              map[KeyType]TrueValueType
+	HandledRequests map[int64]interface{}
+	PendingWrites   map[PendingInsertsKey]PendingWrite
+}
+
 type ClientGetArgs struct {
 	Key       KeyType
 	RequestID int64
@@ -160,6 +271,8 @@ type ClientPutReply struct {
 
 type StartSetupArgs struct {
 	MasterServer string
+	Epoch        int
+	Start        time.Time // when every node should start setup
 }
 
 type StartSetupReply struct {
@@ -178,6 +291,7 @@ type ReceivePendingWritesReply struct {
 type ReceiveNewPaxosClusterArgs struct {
 	Server  string
 	Cluster []string
+	Epoch   int // the setup round the server is in
 }
 
 type ReceiveNewPaxosClusterReply struct {
@@ -185,6 +299,19 @@ type ReceiveNewPaxosClusterReply struct {
 	Err Err
 }
 
+// Server has put the pending writes to Keys it collected in setup
+// round Epoch in its cluster.
+type AckPendingArgs struct {
+	Server    string
+	Epoch     int
+	Keys      []KeyType
+	RequestID int64
+}
+
+type AckPendingReply struct {
+	Err Err
+}
+
 type WhanauPutRPCArgs struct {
 	Key   KeyType
 	Value string
@@ -204,8 +331,21 @@ type JoinClusterReply struct {
 	Err Err
 }
 
+// Join a cluster whose members were changed to Servers at From.
+type JoinReplicaArgs struct {
+	Uid     string
+	Servers []string
+	From    int
+	Keys    []KeyType // the keys the cluster stores
+}
+
+type JoinReplicaReply struct {
+	Err Err
+}
+
 type SystolicMixingArgs struct {
 	Servers    []string
+	Epoch      int
 	Timestep   int
 	SenderAddr string
 }
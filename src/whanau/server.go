@@ -12,10 +12,9 @@ import (
 	"math/rand"
 	"net"
 	"net/rpc"
-	"os"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
+	"transport"
 )
 
 //import "encoding/gob"
@@ -38,39 +37,45 @@ type WhanauServer struct {
 	dead   bool // for testing
 	reqID  int64
 	rpc    *rpc.Server
+	tr     transport.Transport // how this server listens and reaches others
+	dir    string              // where cluster replicas keep their state; "" for none
 
 	//// Paxos variables ////
 	// map of key -> local WhanauPaxos instance handling the key
 	// WhanauPaxos instance handles communication with other replicas
-	paxosInstances map[KeyType]WhanauPaxos
+	paxosInstances map[KeyType]*WhanauPaxos
 
 	//// Routing variables ////
 	neighbors []string              // list of servers this server can talk to
 	kvstore   map[KeyType]ValueType // k/v table used for routing
-	ids       []KeyType             // contains id of each layer
-	fingers   [][]Finger            // (id, server name) pairs
-	succ      [][]Record            // contains successor records for each layer
-	db        []Record              // sample of records used for constructing struct, according to the paper, the union of all dbs in all nodes cover all the keys =)
+	tables_mu sync.Mutex
+	routing   *routingTables // the tables lookups use
+	building  *routingTables // the tables a setup in progress has built so far, or nil
 
 	rw_servers []string // list of random walk servers from systolic mixing
 	rw_idx     int64
 	rw_mu      sync.Mutex
 	rec_mu     sync.Mutex
-	recv_chan  chan *SystolicMixingArgs
-	doneMixing bool
 
 	masters []string // list of servers for the master cluster; these servers are also trusted
 
-	is_master bool                      // whether the server itself is a master server
-	is_sybil  bool                      // whether the server is a sybil server
-	state     State                     // what phase the server is in
-	pending   map[KeyType]TrueValueType // this is a list of pending writes
+	is_master bool                           // whether the server itself is a master server
+	is_sybil  bool                           // whether the server is a sybil server
+	behavior  Behavior                       // how the server takes part in Whanau
+	state     State                          // what phase the server is in
+	epoch     int                            // the setup round we are in, or last ran
+	next      StartSetupArgs                 // the latest setup round we heard of
+	running   bool                           // whether runSetups is going
+	inflight  map[State]int                  // client requests under way, by the state they started in
+	pending   map[KeyType]PendingStatusReply // where our pending writes are
 
 	// for master server only
-	master_paxos_cluster WhanauPaxos                         // the paxos cluster for master servers
-	all_pending_writes   map[PendingInsertsKey]TrueValueType // all of the current pending writes that it has
-	key_to_server        map[PendingInsertsKey]string        // the server for a particular key
-	new_paxos_clusters   [][]string                          // all of the new paxos clusters constructed in the current view
+	master_paxos_cluster *WhanauPaxos // the paxos cluster for master servers
+	new_paxos_clusters   [][]string   // all of the new paxos clusters constructed in the current view
+
+	// when pending writes go to coordinators
+	coordinated  map[PendingInsertsKey]PendingWrite // the pending writes we coordinate
+	coordinators map[string]bool                    // the coordinators holding our pending writes
 
 	//// DATA INTEGRITY FIELDS ////
 	secretKey *rsa.PrivateKey
@@ -88,11 +93,40 @@ type WhanauServer struct {
 	t       int // t = number of successors returned from sample per node, less than rs
 
 	// Systolic mixing variables
-	received_servers map[int][][]string // timestep -> neighbor name -> values
-	nreserved        int                // num in pool reserved for Lookups
+	received_servers map[mixStep][][]string // (epoch, timestep) -> neighbor name -> values
+	nreserved        int                    // num in pool reserved for Lookups
 	lookup_idx       int
 }
 
+// The tables a setup round builds for routing. Setup builds new ones
+// on the side and swaps them in whole once they are done, so lookups
+// meanwhile keep using the last round's.
+type routingTables struct {
+	ids     []KeyType  // contains id of each layer
+	fingers [][]Finger // (id, server name) pairs
+	succ    [][]Record // contains successor records for each layer
+	db      []Record   // sample of records used for constructing struct, according to the paper, the union of all dbs in all nodes cover all the keys =)
+}
+
+// The tables lookups should use.
+func (ws *WhanauServer) tables() routingTables {
+	ws.tables_mu.Lock()
+	defer ws.tables_mu.Unlock()
+	return *ws.routing
+}
+
+// The tables other servers' setup should see: the ones we are
+// building, if we are in a setup round too. Only ever appended to
+// while we build them, so the copy stays good.
+func (ws *WhanauServer) setupTables() routingTables {
+	ws.tables_mu.Lock()
+	defer ws.tables_mu.Unlock()
+	if ws.building != nil {
+		return *ws.building
+	}
+	return *ws.routing
+}
+
 type WhanauSybilServer struct {
 	WhanauServer
 	sybilNeighbors []string // List of all other sybil servers
@@ -106,11 +140,11 @@ func (ws *WhanauServer) AddToKvstore(key KeyType, value ValueType) {
 }
 
 func (ws *WhanauServer) GetDB() []Record {
-	return ws.db
+	return ws.tables().db
 }
 
 func (ws *WhanauServer) GetSucc() [][]Record {
-	return ws.succ
+	return ws.tables().succ
 }
 
 // RPC to actually do a Get on the server's WhanauPaxos cluster.
@@ -121,9 +155,10 @@ func (ws *WhanauServer) PaxosGetRPC(args *ClientGetArgs,
 
 	if _, ok := ws.paxosInstances[args.Key]; !ok {
 		reply.Err = ErrNoKey
+		return nil
 	}
 
-	get_args := PaxosGetArgs{args.Key, args.RequestID}
+	get_args := PaxosGetArgs{args.Key, args.RequestID, false}
 	var get_reply PaxosGetReply
 
 	instance := ws.paxosInstances[args.Key]
@@ -142,12 +177,9 @@ func (ws *WhanauServer) PaxosGetRPC(args *ClientGetArgs,
 
 func (ws *WhanauServer) PaxosGetRPC(args *ClientGetArgs,
 	reply *ClientGetReply) error {
-	if !ws.is_sybil {
-		ws.HonestPaxosGetRPC(args, reply)
-	} else {
-		ws.SybilPaxosGetRPC(args, reply)
-	}
+	defer ws.finishRequest(ws.startRequest())
 
+	ws.behavior.PaxosGet(ws, args, reply)
 	return nil
 }
 
@@ -156,17 +188,23 @@ func (ws *WhanauServer) PaxosGetRPC(args *ClientGetArgs,
 func (ws *WhanauServer) HonestPaxosGetRPC(args *ClientGetArgs,
 	reply *ClientGetReply) error {
 
-	if _, ok := ws.paxosInstances[args.Key]; !ok {
+	ws.mu.Lock()
+	instance, ok := ws.paxosInstances[args.Key]
+	ws.mu.Unlock()
+	if !ok {
 		reply.Err = ErrNoKey
+		return nil
 	}
 
-	get_args := PaxosGetArgs{args.Key, args.RequestID}
+	get_args := PaxosGetArgs{args.Key, args.RequestID, false}
 	var get_reply PaxosGetReply
 
-	instance := ws.paxosInstances[args.Key]
 	instance.PaxosGet(&get_args, &get_reply)
 
-	if VerifyTrueValue(get_reply.Value) {
+	if get_reply.Err == ErrWrongGroup {
+		// we were replaced; the client should ask another member.
+		reply.Err = ErrWrongGroup
+	} else if VerifyTrueValue(get_reply.Value) {
 		reply.Value = get_reply.Value.TrueValue
 		reply.Err = OK
 	} else {
@@ -193,21 +231,85 @@ func (ws *WhanauServer) SybilPaxosGetRPC(args *ClientGetArgs,
 // Essentially just passes the call on to the WhanauPaxos servers.
 func (ws *WhanauServer) PaxosPutRPC(args *ClientPutArgs,
 	reply *ClientPutReply) error {
+	state, ok := ws.startPut()
+	if !ok {
+		reply.Err = ErrInSetup
+		return nil
+	}
+	defer ws.finishRequest(state)
+
+	ws.paxosPut(args, reply)
+	return nil
+}
+
+// Like PaxosPutRPC, for setup itself to store the keys it hands
+// to clusters.
+func (ws *WhanauServer) paxosPut(args *ClientPutArgs, reply *ClientPutReply) {
 	// this will initiate a new paxos call its paxos cluster
-	if _, ok := ws.paxosInstances[args.Key]; !ok {
+	ws.mu.Lock()
+	instance, ok := ws.paxosInstances[args.Key]
+	ws.mu.Unlock()
+	if !ok {
 		reply.Err = ErrNoKey
-		return nil
+		return
 	}
 
-	put_args := PaxosPutArgs{args.Key, args.Value, args.RequestID}
+	put_args := PaxosPutArgs{args.Key, args.Value, args.RequestID, false}
 	var put_reply PaxosPutReply
 
-	instance := ws.paxosInstances[args.Key]
 	instance.PaxosPut(&put_args, &put_reply)
 
 	reply.Err = put_reply.Err
+}
 
-	return nil
+// Note that a Put is under way, unless a setup round is: setup
+// changes which clusters keys belong to, so Puts are turned away
+// until it is over. Returns the state the Put started in.
+func (ws *WhanauServer) startPut() (State, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.state != Normal {
+		return ws.state, false
+	}
+	ws.inflight[ws.state]++
+	return ws.state, true
+}
+
+// Note that a client request other than a Put is under way. These
+// are served in every state, but read the tables, clusters and
+// pending writes that setup replaces, so setup waits for them too.
+// Returns the state the request started in.
+func (ws *WhanauServer) startRequest() State {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.inflight[ws.state]++
+	return ws.state
+}
+
+// Note that a request started with startPut or startRequest is done.
+func (ws *WhanauServer) finishRequest(state State) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.inflight[state]--
+}
+
+// Move on to state next, once the client requests that started in
+// the state we are leaving are done.
+func (ws *WhanauServer) enterState(next State) {
+	ws.mu.Lock()
+	prev := ws.state
+	ws.state = next
+	ws.mu.Unlock()
+
+	for !ws.dead {
+		ws.mu.Lock()
+		n := ws.inflight[prev]
+		ws.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
 func (ws *WhanauServer) AddPendingRPCMaster(args *PendingArgs, reply *PendingReply) error {
@@ -216,44 +318,106 @@ func (ws *WhanauServer) AddPendingRPCMaster(args *PendingArgs, reply *PendingRep
 
 	//fmt.Printf("master cluster is %v\n", ws.master_paxos_cluster)
 
-	var current_view int
-
-	ws.mu.Lock()
-	ws.all_pending_writes[PendingInsertsKey{args.Key, ws.master_paxos_cluster.currView}] = args.Value
-	ws.mu.Unlock()
-
-	rpc_args := &PaxosPendingInsertsArgs{args.Key, current_view, args.Server, NRand()}
+	// the masters' log holds the write, and decides which server it
+	// goes to and which view it belongs to, so any master can hand
+	// it out.
+	rpc_args := &PaxosPendingInsertsArgs{args.Key, args.Value, args.Server,
+		NRand(), false}
 	rpc_reply := &PaxosPendingInsertsReply{}
 	ws.master_paxos_cluster.PaxosPendingInsert(rpc_args, rpc_reply)
+	if rpc_reply.Err != OK {
+		reply.Err = rpc_reply.Err
+		return nil
+	}
 
-	ws.mu.Lock()
-	ws.key_to_server[PendingInsertsKey{args.Key, ws.master_paxos_cluster.currView}] = rpc_reply.Server
-	ws.mu.Unlock()
-
+	reply.Server = rpc_reply.Server
+	reply.View = rpc_reply.View
 	reply.Err = OK
 	return nil
 }
 
 func (ws *WhanauServer) AddPendingRPC(args *PendingArgs,
 	reply *PendingReply) error {
+	defer ws.finishRequest(ws.startRequest())
+
+	ws.addPending(args, reply)
+	if reply.Err == ErrPending && reply.Server != args.Server {
+		// another server's write to the key got there first, and
+		// ours will never be put in.
+		reply.Err = ErrLost
+		ws.setPending(args.Key, Lost, reply.Server, reply.View)
+	} else if reply.Err == ErrPending {
+		ws.setPending(args.Key, Queued, reply.Server, reply.View)
+	}
+	return nil
+}
+
+func (ws *WhanauServer) addPending(args *PendingArgs, reply *PendingReply) {
+	if pendingRouting == ViaCoordinators {
+		ws.addPendingCoordinated(args, reply)
+		return
+	}
 
-	// this will add a pending write to one of the master nodes
+	// this will add a pending write to one of the master nodes,
+	// going round them until one takes it or PendingTimeout is up.
+	reply.Err = ErrNoMaster
+	if len(ws.masters) == 0 {
+		return
+	}
 
+	deadline := time.Now().Add(PendingTimeout)
+	backoff := PendingBackoff
 	for {
-		randIdx := rand.Intn(len(ws.masters))
-		server := ws.masters[randIdx]
-		rpc_reply := &PendingReply{}
-		ok := call(server, "WhanauServer.AddPendingRPCMaster", args, rpc_reply)
-		if ok {
-			if rpc_reply.Err == OK {
-				reply.Err = ErrPending
-				break
-			} else {
+		for _, i := range rand.Perm(len(ws.masters)) {
+			left := deadline.Sub(time.Now())
+			if left <= 0 {
+				return
+			}
+			rpc_reply := &PendingReply{}
+			ok := callTimeout(ws.tr, ws.masters[i],
+				"WhanauServer.AddPendingRPCMaster", args, rpc_reply, left)
+			if ok {
+				if rpc_reply.Err == OK {
+					reply.Err = ErrPending
+					reply.Server = rpc_reply.Server
+					reply.View = rpc_reply.View
+					return
+				}
 				reply.Err = rpc_reply.Err
 			}
 		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Record how far our pending write to key has got.
+func (ws *WhanauServer) setPending(key KeyType, state PendingState,
+	server string, view int) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.pending[key] = PendingStatusReply{state, server, view, OK}
+}
+
+// How far the pending write to args.Key made here has got. A write
+// that lost to another server's stays Lost, with that server.
+func (ws *WhanauServer) PendingStatusRPC(args *PendingStatusArgs,
+	reply *PendingStatusReply) error {
+	defer ws.finishRequest(ws.startRequest())
+
+	ws.mu.Lock()
+	status, ok := ws.pending[args.Key]
+	ws.mu.Unlock()
+	if !ok {
+		reply.Err = ErrNoKey
+		return nil
 	}
 
+	*reply = status
 	return nil
 }
 
@@ -261,27 +425,103 @@ func (ws *WhanauServer) AddPendingRPC(args *PendingArgs,
 func (ws *WhanauServer) Kill() {
 	ws.dead = true
 	ws.l.Close()
-	//	ws.px.Kill()
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	killed := make(map[*WhanauPaxos]bool)
+	for _, wp := range ws.paxosInstances {
+		if !killed[wp] {
+			wp.Kill()
+			killed[wp] = true
+		}
+	}
+	if ws.master_paxos_cluster != nil && !killed[ws.master_paxos_cluster] {
+		ws.master_paxos_cluster.Kill()
+	}
 }
 
 // TODO servers is for a paxos cluster
+// tr is the transport for every server in the network; nil means
+// unix sockets.
+// dir is where the server's cluster replicas keep their state, so
+// that a server restarted with the same dir rejoins its clusters
+// with their data; "" keeps everything in memory.
+// is_sybil starts it as a Sybil rather than an honest server.
 func StartServer(servers []string, me int, myaddr string,
 	neighbors []string, masters []string, newservers []string,
 	is_master bool, is_sybil bool, is_px_server bool,
-	nlayers int, rf int, w int, rd int, rs int, t int) *WhanauServer {
+	nlayers int, rf int, w int, rd int, rs int, t int,
+	tr transport.Transport, dir string) *WhanauServer {
+	var behavior Behavior = Honest{}
+	if is_sybil {
+		behavior = Sybil{}
+	}
+	return StartServerBehavior(servers, me, myaddr, neighbors, masters,
+		newservers, is_master, behavior, is_px_server, nlayers, rf, w, rd,
+		rs, t, tr, dir)
+}
 
+// A server that only takes part in Whanau's setup and lookups, the
+// way behavior does, over tr: it does not listen or have a key pair,
+// and runs no Paxos. The simulator in package sim runs these, and
+// StartServerBehavior starts from one.
+func MakeNode(myaddr string, neighbors []string, behavior Behavior,
+	nlayers int, rf int, w int, rd int, rs int, t int,
+	tr transport.Transport) *WhanauServer {
 	ws := new(WhanauServer)
-	ws.me = me
 	ws.myaddr = myaddr
 	ws.neighbors = neighbors
+	ws.tr = tr
 
 	ws.kvstore = make(map[KeyType]ValueType)
+	ws.routing = &routingTables{}
 	ws.state = Normal
+	ws.inflight = make(map[State]int)
+	ws.pending = make(map[KeyType]PendingStatusReply)
+	ws.coordinated = make(map[PendingInsertsKey]PendingWrite)
+	ws.coordinators = make(map[string]bool)
 	ws.reqID = 0
 
+	ws.behavior = behavior
+	_, honest := behavior.(Honest)
+	ws.is_sybil = !honest
+
+	// whanau routing parameters
+	ws.nlayers = nlayers
+	ws.rf = rf
+	ws.w = w
+	ws.rd = rd
+	ws.rs = rs
+	ws.t = t
+
+	ws.received_servers = make(map[mixStep][][]string, ws.w+1)
+	ws.rw_servers = make([]string, 0)
+	ws.rw_idx = 0
+	ws.nreserved = int(math.Pow(float64(ws.rd), 2))
+	ws.lookup_idx = 0
+
+	ws.paxosInstances = make(map[KeyType]*WhanauPaxos)
+	return ws
+}
+
+// Like StartServer, for a server that takes part in Whanau the way
+// behavior does. Any behavior but Honest counts as a Sybil.
+func StartServerBehavior(servers []string, me int, myaddr string,
+	neighbors []string, masters []string, newservers []string,
+	is_master bool, behavior Behavior, is_px_server bool,
+	nlayers int, rf int, w int, rd int, rs int, t int,
+	tr transport.Transport, dir string) *WhanauServer {
+
+	if tr == nil {
+		tr = transport.Unix{}
+	}
+	ws := MakeNode(myaddr, neighbors, behavior, nlayers, rf, w, rd, rs, t,
+		tr)
+	ws.me = me
+	ws.dir = dir
+
 	ws.masters = masters
 	ws.is_master = is_master
-	ws.is_sybil = is_sybil
 
 	ws.rpc = rpc.NewServer()
 	ws.rpc.Register(ws)
@@ -299,12 +539,8 @@ func StartServer(servers []string, me int, myaddr string,
 			}
 		}
 
-		uid := ""
-		for _, srv := range newservers {
-			uid += strings.Join(strings.Split(srv, "/var/tmp/824-"+strconv.Itoa(os.Getuid())+"/"), "")
-		}
-		uid = getShaHash(uid)
-		StartWhanauPaxos(newservers, idx, uid, ws.rpc)
+		uid := MasterClusterUID(newservers)
+		StartWhanauPaxos(newservers, idx, uid, ws.rpc, ws.tr, ws.dir)
 	}
 
 	if is_master {
@@ -319,35 +555,15 @@ func StartServer(servers []string, me int, myaddr string,
 
 		// start the whanaupaxos using precreated paxos servers
 		// which exist exclusively for the purpose of being paxos handlers
-		uid := ""
-		for _, srv := range newservers {
-			uid += strings.Join(strings.Split(srv, "/var/tmp/824-"+strconv.Itoa(os.Getuid())+"/"), "")
-		}
-		uid = getShaHash(uid)
-		wp_m := StartWhanauPaxos(newservers, idx, uid, ws.rpc)
-		ws.master_paxos_cluster = *wp_m
-		ws.all_pending_writes = make(map[PendingInsertsKey]TrueValueType)
-		ws.key_to_server = make(map[PendingInsertsKey]string)
+		uid := MasterClusterUID(newservers)
+		wp_m := StartWhanauPaxos(newservers, idx, uid, ws.rpc, ws.tr, ws.dir)
+		ws.master_paxos_cluster = wp_m
 		ws.new_paxos_clusters = make([][]string, 0)
 	}
 
-	// whanau routing parameters
-	ws.nlayers = nlayers
-	ws.rf = rf
-	ws.w = w
-	ws.rd = rd
-	ws.rs = rs
-	ws.t = t
-
-	ws.received_servers = make(map[int][][]string, ws.w+1)
-	ws.rw_servers = make([]string, 0)
-	ws.rw_idx = 0
-	ws.recv_chan = make(chan *SystolicMixingArgs)
-	ws.doneMixing = true
-	ws.nreserved = int(math.Pow(float64(ws.rd), 2))
-	ws.lookup_idx = 0
-
-	ws.paxosInstances = make(map[KeyType]WhanauPaxos)
+	if ws.dir != "" {
+		ws.restoreClusters(MasterClusterUID(newservers))
+	}
 
 	gob.Register(LookupArgs{})
 	gob.Register(LookupReply{})
@@ -362,8 +578,11 @@ func StartServer(servers []string, me int, myaddr string,
 	gob.Register(SystolicMixingArgs{})
 	gob.Register(SystolicMixingReply{})
 
-	os.Remove(servers[me])
-	l, e := net.Listen("unix", servers[me])
+	if _, e := ws.tr.ParseAddr(myaddr); e != nil {
+		log.Fatal("bad server address: ", myaddr, ": ", e)
+	}
+
+	l, e := ws.tr.Listen(servers[me])
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -405,12 +624,20 @@ func StartServer(servers []string, me int, myaddr string,
 // for testing purposes
 func (ws *WhanauServer) PutId(args *PutIdArgs, reply *PutIdReply) error {
 	//ws.ids[args.Layer] = args.Key
-	ws.ids = append(ws.ids, args.Key)
+	ws.tables_mu.Lock()
+	ws.routing.ids = append(ws.routing.ids, args.Key)
+	ws.tables_mu.Unlock()
 	reply.Err = OK
 	return nil
 }
 
 func (ws *WhanauServer) WhanauPutRPC(args *WhanauPutRPCArgs, reply *WhanauPutRPCReply) error {
+	state, ok := ws.startPut()
+	if !ok {
+		reply.Err = ErrInSetup
+		return nil
+	}
+	defer ws.finishRequest(state)
 
 	key := args.Key
 	v := args.Value
@@ -442,15 +669,21 @@ func (ws *WhanauServer) WhanauPutRPC(args *WhanauPutRPCArgs, reply *WhanauPutRPC
 		pending_reply := &PendingReply{}
 
 		ws.AddPendingRPC(pending_args, pending_reply)
+		reply.Err = pending_reply.Err
 
 	} else {
 
 		cpargs := &ClientPutArgs{key, value, NRand(), ws.myaddr}
 		cpreply := &ClientPutReply{}
 
+		if replication == Byzantine {
+			reply.Err = ws.putAgreed(cpargs, servers)
+			return nil
+		}
+
 		randIdx := rand.Intn(len(servers))
 
-		ok := call(servers[randIdx], "WhanauServer.PaxosPutRPC", cpargs, cpreply)
+		ok := call(ws.tr, servers[randIdx], "WhanauServer.PaxosPutRPC", cpargs, cpreply)
 		if ok {
 			reply.Err = cpreply.Err
 		}
@@ -458,3 +691,24 @@ func (ws *WhanauServer) WhanauPutRPC(args *WhanauPutRPCArgs, reply *WhanauPutRPC
 
 	return nil
 }
+
+// Put to a Byzantine cluster: a lying member could say it stored the
+// value when it didn't, so hand the put (under one request ID) to
+// members until MaxFaulty+1 of them say it is done.
+func (ws *WhanauServer) putAgreed(args *ClientPutArgs, servers []string) Err {
+	done := 0
+	var err Err = ErrRPCCall
+	for _, i := range rand.Perm(len(servers)) {
+		var reply ClientPutReply
+		ok := call(ws.tr, servers[i], "WhanauServer.PaxosPutRPC", args, &reply)
+		if ok && reply.Err == OK {
+			done++
+			if done > MaxFaulty {
+				return OK
+			}
+		} else if ok && reply.Err == ErrInSetup {
+			err = ErrInSetup
+		}
+	}
+	return err
+}
@@ -4,18 +4,12 @@ package whanau
  Functions related to Whanau setup.
 */
 
-//import "time"
+import "time"
 import "fmt"
-//import "math/rand"
+import "math/rand"
 
 func (ws *WhanauServer) Setup() {
-	//fmt.Printf("In setup of honest node: %s", ws.is_sybil)
-	if ws.is_sybil {
-		ws.SetupSybil()
-	} else {
-		//fmt.Printf("Setting up honest server: %s", "honest server REALLY")
-		ws.SetupHonest()
-	}
+	ws.behavior.Setup(ws)
 }
 
 // Setup for honest nodes
@@ -27,116 +21,162 @@ func (ws *WhanauServer) SetupHonest() {
 	numToSample := ws.rd*(ws.nlayers*(1+ws.rf+ws.rs)) + ws.nreserved
   //fmt.Printf("numToSample: %d\n", numToSample)
 	ws.PerformSystolicMixing(numToSample)
-	ws.doneMixing = true // turn off server handler
 	//fmt.Printf("server %v done with performsystolic\n", ws.me)
 
 	// fill up db by randomly sampling records from random walks
 	// "The db table has the good property that each honest node’s stored records are frequently represented in other honest nodes’db tables"
-	ws.db = ws.SampleRecords(ws.rd, ws.w)
-	// TODO probably don't need lock?
-	By(RecordKey).Sort(ws.db)
+	db := ws.SampleRecords(ws.rd, ws.w)
+	By(RecordKey).Sort(db)
 
 	//fmt.Printf("server %v has moved on\n", ws.me)
 
-	// reset ids, fingers, succ
-	ws.ids = make([]KeyType, 0)
-	ws.fingers = make([][]Finger, 0)
-	ws.succ = make([][]Record, 0)
+	// build new ids, fingers, succ; lookups use the old ones until
+	// we are done.
+	next := &routingTables{make([]KeyType, 0), make([][]Finger, 0),
+		make([][]Record, 0), db}
+	ws.tables_mu.Lock()
+	ws.building = next
+	ws.tables_mu.Unlock()
 	for i := 0; i < ws.nlayers; i++ {
 		// populate tables in layers
     chosenid := ws.ChooseID(i)
     if chosenid != ErrNoKey {
-		  ws.ids = append(ws.ids, chosenid)
+			ws.tables_mu.Lock()
+			next.ids = append(next.ids, chosenid)
+			ws.tables_mu.Unlock()
     }
 
 		curFingerTable := ws.ConstructFingers(i)
 
 		//fmt.Printf("Choosing Fingers: %s\n", curFingerTable)
 		ByFinger(FingerId).Sort(curFingerTable)
-		ws.fingers = append(ws.fingers, curFingerTable)
+		ws.tables_mu.Lock()
+		next.fingers = append(next.fingers, curFingerTable)
+		ws.tables_mu.Unlock()
 		//fmt.Printf("Finished choosing fingers\n")
 		curSuccessorTable := ws.Successors(i)
 		//fmt.Printf("Choosing successors: %s\n", curSuccessorTable)
 		By(RecordKey).Sort(curSuccessorTable)
-		ws.succ = append(ws.succ, curSuccessorTable)
+		ws.tables_mu.Lock()
+		next.succ = append(next.succ, curSuccessorTable)
+		ws.tables_mu.Unlock()
 	}
   /*
-	fmt.Printf("Server ids: %s\n", ws.ids)
-	fmt.Printf("Server fingers: %s\n", ws.fingers)
-	fmt.Printf("Server successors: %s\n", ws.succ)
+	fmt.Printf("Server ids: %s\n", next.ids)
+	fmt.Printf("Server fingers: %s\n", next.fingers)
+	fmt.Printf("Server successors: %s\n", next.succ)
   */
+
+	ws.swapTables(next)
+}
+
+// Make next the tables lookups use.
+func (ws *WhanauServer) swapTables(next *routingTables) {
+	ws.tables_mu.Lock()
+	ws.routing = next
+	ws.building = nil
+	ws.tables_mu.Unlock()
 }
 
 // Server for Sybil nodes
 func (ws *WhanauServer) SetupSybil() {
 	//fmt.Printf("In Setup of Sybil server %s \n", ws.myaddr)
 
-	// Sybil nodes should participate in mixing so that other nodes
-	// will try to route to them
-	numToSample := ws.rd*(ws.nlayers*(1+ws.rf+ws.rs)) + ws.nreserved
-	ws.PerformSystolicMixing(numToSample)
-	ws.doneMixing = true // turn off server handler
-
-	// reset ids, fingers, succ...etc.
-	ws.db = make([]Record, 0)
-	ws.ids = make([]KeyType, 0)
-	ws.fingers = make([][]Finger, 0)
-	ws.succ = make([][]Record, 0)
-
+	// new ids, fingers, succ...etc.
+	ids := make([]KeyType, 0)
 	for k := range ws.kvstore {
-		if len(ws.ids) < ws.nlayers {
-			ws.ids = append(ws.ids, k)
+		if len(ids) < ws.nlayers {
+			ids = append(ids, k)
 		}
 	}
 
-	last_val := ws.ids[len(ws.ids)-1]
+	if len(ids) == 0 {
+		// no keys of our own
+		ids = append(ids, ws.SybilChooseID(0))
+	}
+	last_val := ids[len(ids)-1]
 
-	for len(ws.ids) < ws.nlayers {
-		ws.ids = append(ws.ids, last_val)
+	for len(ids) < ws.nlayers {
+		ids = append(ids, last_val)
 	}
+
+	ws.setupSybil(ids)
 }
 
-// this function shoud be run in a separate thread
-// by each master server
-func (ws *WhanauServer) InitiateSetup() {
-	for {
-		if ws.state == Normal {
-			// send a start setup message to each one of its neighbors
-			for _, srv := range ws.neighbors {
-				args := &StartSetupArgs{ws.myaddr}
-				reply := &StartSetupReply{}
-				ok := call(srv, "WhanauServer.StartSetup", args, reply)
-				if ok {
+// Set a Sybil up with ids for its layers, and no fingers or
+// successors of its own.
+func (ws *WhanauServer) setupSybil(ids []KeyType) {
+	// Sybil nodes should participate in mixing so that other nodes
+	// will try to route to them
+	numToSample := ws.rd*(ws.nlayers*(1+ws.rf+ws.rs)) + ws.nreserved
+	ws.PerformSystolicMixing(numToSample)
 
-				}
+	next := &routingTables{ids, make([][]Finger, 0),
+		make([][]Record, 0), make([]Record, 0)}
+	ws.swapTables(next)
+}
+
+// Schedule a setup round every EpochLength, until the server is
+// killed. Every master runs this, in a separate thread: the masters
+// agree on each round's number and start through their Paxos log,
+// so whichever of them gets there first picks the start, and each
+// then tells the network about it.
+func (ws *WhanauServer) InitiateSetup() {
+	// our replica is behind when the leader handles our proposals,
+	// so keep track of what they tell us instead.
+	epoch, start := ws.master_paxos_cluster.Epoch()
+	announced := 0
+	for !ws.dead {
+		if !time.Now().Before(start.Add(EpochLength)) {
+			args := &PaxosEpochArgs{epoch + 1, time.Now().Add(EpochLead),
+				NRand(), false}
+			var reply PaxosEpochReply
+			ws.master_paxos_cluster.PaxosEpoch(args, &reply)
+			if reply.Err == OK {
+				epoch, start = reply.Epoch, reply.Start
 			}
 		}
 
-		//time.Sleep(1800 * time.Second)
-    break
+		if epoch > announced {
+			ws.mu.Lock()
+			ws.new_paxos_clusters = make([][]string, 0)
+			ws.mu.Unlock()
+
+			// we are a node too; StartSetup passes it on from here.
+			args := &StartSetupArgs{ws.myaddr, epoch, start}
+			var reply StartSetupReply
+			ws.StartSetup(args, &reply)
+			announced = epoch
+		}
+
+		time.Sleep(100 * time.Millisecond)
 	}
 }
 
-// each server changes its current state, and sends the setup messages
-// to all of its neighbors
+// Each server learns of a setup round from a master or a neighbor,
+// passes it on to all of its neighbors, and runs setup when the
+// round starts.
 func (ws *WhanauServer) StartSetup(args *StartSetupArgs, reply *StartSetupReply) error {
 
 	ws.mu.Lock()
-	if ws.state == Normal {
-		ws.state = PreSetup
-		go ws.StartSetupStage2()
-	} else {
+	if args.Epoch <= ws.next.Epoch {
+		// heard it already.
 		ws.mu.Unlock()
 		reply.Err = OK
 		return nil
 	}
+	ws.next = *args
+	if !ws.running {
+		ws.running = true
+		go ws.runSetups()
+	}
 	ws.mu.Unlock()
 
 	// forward this msg to all of its neighbors
 	for _, srv := range ws.neighbors {
-		rpc_args := &StartSetupArgs{args.MasterServer}
+		rpc_args := &StartSetupArgs{args.MasterServer, args.Epoch, args.Start}
 		rpc_reply := &StartSetupReply{}
-		ok := call(srv, "WhanauServer.StartSetup", rpc_args, rpc_reply)
+		ok := call(ws.tr, srv, "WhanauServer.StartSetup", rpc_args, rpc_reply)
 		if ok {
 		}
 	}
@@ -146,69 +186,160 @@ func (ws *WhanauServer) StartSetup(args *StartSetupArgs, reply *StartSetupReply)
 	return nil
 }
 
+// Run setup for the latest round we heard of, once it starts, until
+// we have caught up with the rounds. Neighbors wait for each other
+// while mixing, so every node has to take part in every round.
+func (ws *WhanauServer) runSetups() {
+	for !ws.dead {
+		ws.mu.Lock()
+		if ws.epoch >= ws.next.Epoch {
+			ws.running = false
+			ws.mu.Unlock()
+			return
+		}
+		next := ws.next
+		ws.mu.Unlock()
+
+		time.Sleep(next.Start.Sub(time.Now()))
+
+		ws.mu.Lock()
+		ws.epoch = next.Epoch
+		ws.mu.Unlock()
+
+		ws.StartSetupStage2()
+	}
+}
+
+// Tell source, which handed us pending writes in setup round epoch,
+// that the ones to keys are in our cluster. If source is a master
+// that has gone down, another master records it instead.
+func (ws *WhanauServer) ackPending(source string, epoch int,
+	keys []KeyType) bool {
+	if len(keys) == 0 {
+		return true
+	}
+
+	targets := []string{source}
+	if pendingRouting == ViaMasters {
+		for _, i := range rand.Perm(len(ws.masters)) {
+			if ws.masters[i] != source {
+				targets = append(targets, ws.masters[i])
+			}
+		}
+	}
+
+	args := &AckPendingArgs{ws.myaddr, epoch, keys, NRand()}
+	for try := 0; try < TIMEOUT && !ws.dead; try++ {
+		for _, srv := range targets {
+			reply := &AckPendingReply{}
+			ok := callTimeout(ws.tr, srv, "WhanauServer.AckPendingRPC", args,
+				reply, PendingTimeout)
+			if ok && reply.Err == OK {
+				return true
+			}
+		}
+		time.Sleep(PendingBackoff)
+	}
+	return false
+}
+
 func (ws *WhanauServer) StartSetupStage2() {
 
-	// wait until all of its current outstanding requests are done processing
-	// TODO: should keep a counter of all of the outstanding requests
+	// turn new Puts away, and wait until the client requests
+	// already under way are done
+	ws.enterState(PreSetup)
 
 	fmt.Printf("StartSetupStage2()\n")
 
+	ws.mu.Lock()
+	epoch := ws.epoch
+	ws.mu.Unlock()
+
 	// try to construct a new paxos cluster
 	new_cluster := ws.ConstructPaxosCluster()
 	// send this new cluster to a random master cluster
 	//fmt.Printf("Server %v DONE constructing new paxos clusters, new cluster is %v\n", ws.myaddr, new_cluster)
 
 	// enter the SETUP stage
-	ws.mu.Lock()
-	ws.state = Setup
-	ws.mu.Unlock()
+	ws.enterState(Setup)
 
 	fmt.Printf("%v construct cluster done\n", ws.myaddr)
 
 	// TODO: for every key value in the current kv store, replace with the newest paxos cluster
 
-	for _, master_server := range ws.masters {
-
-		receive_paxos_args := &ReceiveNewPaxosClusterArgs{ws.myaddr, new_cluster}
+	// collect our pending writes: from the first master that
+	// answers, since every master has every write, or from every
+	// coordinator we left one with.
+	sources, rpcname := ws.pendingSources(epoch)
+	kvs := make(map[string]map[KeyType]TrueValueType)
+	for _, master_server := range sources {
+		receive_paxos_args := &ReceiveNewPaxosClusterArgs{ws.myaddr, new_cluster,
+			epoch}
 		receive_paxos_reply := &ReceiveNewPaxosClusterReply{}
-		
-		ok := call(master_server, "WhanauServer.ReceiveNewPaxosCluster",
-			receive_paxos_args, receive_paxos_reply)
-		if ok {
-			if receive_paxos_reply.Err == OK {
-				
-				//fmt.Printf("Server %v received pending write %v\n", ws.myaddr, receive_paxos_reply.KV)
-				
-				join_args := JoinClusterArgs{new_cluster, receive_paxos_reply.KV, ws.myaddr}
-				var join_reply JoinClusterReply
-				
-				for _, srv := range new_cluster {
-					if srv == ws.myaddr {
-						ws.JoinClusterRPC(&join_args, &join_reply)
-					} else {
-						ok := call(srv, "WhanauServer.JoinClusterRPC",
-							join_args, &join_reply)
-						if !ok {
-							// TODO error
-						}
-					}
+
+		// a master whose cluster has lost a majority never answers.
+		ok := callTimeout(ws.tr, master_server, rpcname,
+			receive_paxos_args, receive_paxos_reply, PendingTimeout)
+		if ok && receive_paxos_reply.Err == OK {
+			kvs[master_server] = receive_paxos_reply.KV
+			if pendingRouting == ViaMasters {
+				break
+			}
+		}
+	}
+
+	if len(kvs) > 0 {
+		kv := agreedPending(kvs)
+		//fmt.Printf("Server %v received pending write %v\n", ws.myaddr, kv)
+
+		join_args := JoinClusterArgs{new_cluster, kv, ws.myaddr}
+		var join_reply JoinClusterReply
+
+		for _, srv := range new_cluster {
+			if srv == ws.myaddr {
+				ws.JoinClusterRPC(&join_args, &join_reply)
+			} else {
+				ok := call(ws.tr, srv, "WhanauServer.JoinClusterRPC",
+					join_args, &join_reply)
+				if !ok {
+					// TODO error
 				}
-				
-				for k, v := range receive_paxos_reply.KV {
-					cpargs := &ClientPutArgs{k, v, NRand(), ws.myaddr}
-					cpreply := &ClientPutReply{}
-					ws.PaxosPutRPC(cpargs, cpreply)
-					
-					//fmt.Printf("Server %v processed %v\n", ws.myaddr, k)
+			}
+		}
+
+		done := make(map[KeyType]bool)
+		for k, v := range kv {
+			ws.setPending(k, Assigned, ws.myaddr, epoch)
+			cpargs := &ClientPutArgs{k, v, NRand(), ws.myaddr}
+			cpreply := &ClientPutReply{}
+			for i := 0; i < TIMEOUT && cpreply.Err != OK; i++ {
+				ws.paxosPut(cpargs, cpreply)
+			}
+			if cpreply.Err == OK {
+				ws.setPending(k, Committed, ws.myaddr, epoch)
+				done[k] = true
+			}
+
+			//fmt.Printf("Server %v processed %v\n", ws.myaddr, k)
+		}
+
+		// the writes we could not put, or that too few coordinators
+		// agreed on, stay where they are for the next round.
+		for src, skv := range kvs {
+			keys := make([]KeyType, 0, len(skv))
+			for k := range skv {
+				if done[k] {
+					keys = append(keys, k)
 				}
 			}
+			if ws.ackPending(src, epoch, keys) && len(keys) == len(skv) {
+				ws.collectedPending(src)
+			}
 		}
 	}
 
 	// move on to the next stage
-	ws.mu.Lock()
-	ws.state = WhanauSetup
-	ws.mu.Unlock()
+	ws.enterState(WhanauSetup)
 
 	c := make(chan bool) // writes true of done
 	go func() {
@@ -218,9 +349,7 @@ func (ws *WhanauServer) StartSetupStage2() {
 
 	<-c
 
-	ws.mu.Lock()
-	ws.state = Normal
-	ws.mu.Unlock()
+	ws.enterState(Normal)
 
 	fmt.Printf("Server %v finished entire setup stage\n", ws.myaddr)
 }
@@ -0,0 +1,609 @@
+package whanau
+
+/*
+   Durable WhanauPaxos state.
+
+   Every change LogUpdates applies, the decided op and the instance
+   it was decided at, is appended to <dir>/WhanauPaxos-<uid>.log and
+   fsync()ed before the replica tells Paxos it is Done with the
+   instances, and so is every Preload. Once the log has LogTail
+   entries, the replica writes its whole state, db, handled
+   requests, pending writes, members and log position, to
+   <dir>/WhanauPaxos-<uid>.snap and starts the log afresh. On
+   restart the snapshot is loaded, the log entries past it are
+   applied again, Paxos replays its own log, and any instance decided
+   after that is applied too. Snapshots are written to a temporary
+   file and renamed into place, so a crash leaves either the old or
+   the new one; a log entry torn by a crash is cut off, and so is one
+   whose length is over paxos.MaxRecord.
+
+   Once the changes are durable, Paxos may also compact instances
+   older than the last LogTail ones, even if some replica has not
+   seen them. A replica that finds such an instance missing fetches
+   the state of another replica with FetchSnapshot and installs it.
+   The state includes the cluster's members, so a replica that missed
+   a change of members learns about it that way too.
+
+   A replica of a Byzantine (pbft) cluster can't take one member's
+   word for the state. Every replica keeps a copy of its state at
+   each multiple of LogTail instead, a checkpoint, and the honest
+   ones have the same state there; a replica that is missing
+   instances installs a checkpoint only once f+1 members have sent
+   it the same one.
+*/
+
+import "bytes"
+import "crypto/sha256"
+import "encoding/binary"
+import "encoding/gob"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "hash/crc32"
+import "io"
+import "sort"
+import "io/ioutil"
+import "os"
+import "paxos"
+import "path/filepath"
+import "log"
+import "time"
+
+type wpSnapshot struct {
+	Uid         string
+	Servers     []string
+	ServersFrom int
+	Me          int
+	BFT         bool
+
+	LogIndex        int // log entries before this one are in the snapshot
+	CurrSeq         int
+	CurrView        int
+	EpochStart      time.Time
+	DB              map[KeyType]TrueValueType
+	HandledRequests map[int64]interface{}
+	PendingWrites   map[PendingInsertsKey]PendingWrite
+}
+
+// One change to the replica's state: the op decided at instance Seq,
+// or, if Seq is -1, a key that Preload stored.
+type wpLogEntry struct {
+	Index int
+	Seq   int
+	Op    Op
+	Key   KeyType
+	Value TrueValueType
+}
+
+var errTorn = errors.New("whanau: torn log entry")
+var errTooBig = errors.New("whanau: log entry too big")
+
+// How long catchUp waits for one replica's state. A replica that is
+// catching up itself holds on to FetchSnapshot until it is done.
+const FetchTimeout = 2 * time.Second
+
+func snapshotPath(dir string, uid string) string {
+	return filepath.Join(dir, "WhanauPaxos-"+uid+".snap")
+}
+
+func logPath(dir string, uid string) string {
+	return filepath.Join(dir, "WhanauPaxos-"+uid+".log")
+}
+
+// Copy the replica's state, as of instance currSeq.
+func (wp *WhanauPaxos) capture() wpSnapshot {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.dbLock.Lock()
+	defer wp.dbLock.Unlock()
+	wp.pwLock.Lock()
+	defer wp.pwLock.Unlock()
+
+	snap := wpSnapshot{wp.uid, wp.servers, wp.servers_from, wp.me, wp.bft,
+		wp.logIndex, wp.currSeq, wp.currView, wp.epoch_start,
+		make(map[KeyType]TrueValueType), make(map[int64]interface{}),
+		make(map[PendingInsertsKey]PendingWrite)}
+	for k, v := range wp.db {
+		snap.DB[k] = v
+	}
+	for k, v := range wp.handledRequests {
+		snap.HandledRequests[k] = v
+	}
+	for k, v := range wp.pending_writes {
+		snap.PendingWrites[k] = v
+	}
+	return snap
+}
+
+// Write the replica's state to disk. Called with logLock held.
+func (wp *WhanauPaxos) saveSnapshot() error {
+	if wp.dir == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(wp.capture()); err != nil {
+		return err
+	}
+
+	path := snapshotPath(wp.dir, wp.uid)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// make the rename itself durable.
+	if d, err := os.Open(wp.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	// the snapshot has every change so far; start the log afresh.
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.unlogged = nil
+	if wp.oplog == nil {
+		return os.ErrClosed
+	}
+	if err := wp.oplog.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := wp.oplog.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	wp.logSize = 0
+	wp.logged = 0
+	return wp.oplog.Sync()
+}
+
+// Note a change to append to the log. Called with mu held.
+func (wp *WhanauPaxos) record(e wpLogEntry) {
+	if wp.dir == "" {
+		return
+	}
+	e.Index = wp.logIndex
+	wp.logIndex++
+	wp.unlogged = append(wp.unlogged, e)
+}
+
+// Make the changes applied so far durable: append them to the log,
+// or, once it has LogTail entries, write a snapshot instead. Called
+// with logLock held.
+func (wp *WhanauPaxos) persist() error {
+	if wp.dir == "" {
+		return nil
+	}
+
+	wp.mu.Lock()
+	compact := wp.logged+len(wp.unlogged) >= LogTail
+	wp.mu.Unlock()
+	if compact {
+		return wp.saveSnapshot()
+	}
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.oplog == nil {
+		return os.ErrClosed
+	}
+	if len(wp.unlogged) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range wp.unlogged {
+		if err := encodeEntry(&buf, e); err != nil {
+			return err
+		}
+	}
+	if _, err := wp.oplog.Write(buf.Bytes()); err != nil {
+		// don't leave half an entry for the next ones to follow.
+		wp.oplog.Truncate(wp.logSize)
+		wp.oplog.Seek(wp.logSize, io.SeekStart)
+		return err
+	}
+	if err := wp.oplog.Sync(); err != nil {
+		return err
+	}
+	wp.logSize += int64(buf.Len())
+	wp.logged += len(wp.unlogged)
+	wp.unlogged = nil
+	return nil
+}
+
+// Each entry is framed like a record of the Paxos log (see
+// paxos/wal.go), so a torn one is found and cut off.
+func encodeEntry(buf *bytes.Buffer, e wpLogEntry) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(e); err != nil {
+		return err
+	}
+	if payload.Len() > paxos.MaxRecord {
+		return errTooBig
+	}
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	buf.Write(hdr[:])
+	buf.Write(payload.Bytes())
+	return nil
+}
+
+func readEntry(r io.Reader) (wpLogEntry, int64, error) {
+	var e wpLogEntry
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return e, 0, err
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	sum := binary.BigEndian.Uint32(hdr[4:8])
+	if n > paxos.MaxRecord {
+		return e, 0, errTorn
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return e, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return e, 0, errTorn
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&e); err != nil {
+		return e, 0, err
+	}
+	return e, int64(len(hdr)) + int64(n), nil
+}
+
+// Open the log, apply the entries past the snapshot, and cut off
+// whatever a crash left half-written.
+func (wp *WhanauPaxos) openLog() error {
+	f, err := os.OpenFile(logPath(wp.dir, wp.uid), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	var good int64 = 0
+	for {
+		e, n, err := readEntry(f)
+		if err != nil {
+			break
+		}
+		good += n
+		wp.logged++
+		if e.Index < wp.logIndex {
+			// already in the snapshot.
+			continue
+		}
+		wp.logIndex = e.Index + 1
+		if e.Seq < 0 {
+			wp.db[e.Key] = e.Value
+		} else {
+			wp.applyOp(e.Op, e.Seq)
+			wp.currSeq = e.Seq + 1
+		}
+	}
+
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	wp.oplog = f
+	wp.logSize = good
+	return nil
+}
+
+func readSnapshot(path string) (wpSnapshot, error) {
+	var snap wpSnapshot
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return snap, err
+	}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&snap)
+	return snap, err
+}
+
+// Restore the replica's state from its snapshot, if it has one, and
+// its log.
+func (wp *WhanauPaxos) loadSnapshot() error {
+	snap, err := readSnapshot(snapshotPath(wp.dir, wp.uid))
+	if os.IsNotExist(err) {
+		return wp.openLog()
+	} else if err != nil {
+		return err
+	}
+
+	if snap.Servers != nil {
+		// the members may have changed since we were started.
+		wp.servers = snap.Servers
+		wp.me = IndexOf(wp.myaddr, snap.Servers)
+	}
+	wp.logIndex = snap.LogIndex
+	wp.currSeq = snap.CurrSeq
+	wp.currView = snap.CurrView
+	wp.epoch_start = snap.EpochStart
+	wp.servers_from = snap.ServersFrom
+	if snap.DB != nil {
+		wp.db = snap.DB
+	}
+	if snap.HandledRequests != nil {
+		wp.handledRequests = snap.HandledRequests
+	}
+	if snap.PendingWrites != nil {
+		wp.pending_writes = snap.PendingWrites
+	}
+	return wp.openLog()
+}
+
+// Apply the instances this replica already knows to be decided past
+// the snapshot. Instances it missed are picked up by LogUpdates the
+// next time it handles a request.
+func (wp *WhanauPaxos) replayDecided() {
+	wp.logLock.Lock()
+	defer wp.logLock.Unlock()
+
+	for {
+		decided, value := wp.px.Status(wp.currSeq)
+		if !decided || value == nil {
+			break
+		}
+		if op, ok := value.(Op); ok {
+			wp.applyOp(op, wp.currSeq)
+		}
+		wp.currSeq++
+	}
+}
+
+// Keep our state as of currSeq, for replicas that are behind.
+// Called with logLock held.
+func (wp *WhanauPaxos) checkpoint() {
+	snap := wp.capture()
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.checkpoints[snap.CurrSeq] = snap
+	for seq := range wp.checkpoints {
+		// others may be a little behind in asking.
+		if seq < snap.CurrSeq-2*LogTail {
+			delete(wp.checkpoints, seq)
+		}
+	}
+}
+
+// The checkpoint at seq, or if seq is 0 the latest one past after.
+func (wp *WhanauPaxos) findCheckpoint(seq int, after int) (wpSnapshot, bool) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	if seq != 0 {
+		snap, ok := wp.checkpoints[seq]
+		return snap, ok
+	}
+	var latest wpSnapshot
+	found := false
+	for s, snap := range wp.checkpoints {
+		if s > after && (!found || s > latest.CurrSeq) {
+			latest = snap
+			found = true
+		}
+	}
+	return latest, found
+}
+
+// Hand our state to a replica that is missing instance args.Seq,
+// which we may already have compacted.
+func (wp *WhanauPaxos) FetchSnapshot(args *FetchSnapshotArgs,
+	reply *FetchSnapshotReply) error {
+	var snap wpSnapshot
+	if wp.bft {
+		var ok bool
+		snap, ok = wp.findCheckpoint(args.Checkpoint, args.Seq)
+		if !ok {
+			reply.Err = ErrBehind
+			return nil
+		}
+	} else {
+		// so the db is not caught between an op and its seq.
+		wp.logLock.Lock()
+		snap = wp.capture()
+		wp.logLock.Unlock()
+	}
+	if snap.CurrSeq <= args.Seq {
+		reply.Err = ErrBehind
+		return nil
+	}
+
+	reply.Err = OK
+	reply.Seq = snap.CurrSeq
+	reply.View = snap.CurrView
+	reply.EpochStart = snap.EpochStart
+	reply.Servers = snap.Servers
+	reply.ServersFrom = snap.ServersFrom
+	reply.DB = snap.DB
+	reply.HandledRequests = snap.HandledRequests
+	reply.PendingWrites = snap.PendingWrites
+	return nil
+}
+
+// Replace our state with a snapshot from another replica that
+// covers instance seq, which the others have forgotten. Called
+// with logLock held.
+func (wp *WhanauPaxos) catchUp(seq int) {
+	if wp.bft {
+		wp.catchUpBFT(seq)
+		return
+	}
+	for !wp.dead {
+		for i, srv := range wp.servers {
+			if i == wp.me {
+				continue
+			}
+			args := &FetchSnapshotArgs{seq, 0}
+			var reply FetchSnapshotReply
+			ok := callTimeout(wp.tr, srv, "WhanauPaxos-"+wp.uid+".FetchSnapshot",
+				args, &reply, FetchTimeout)
+			if ok && reply.Err == OK {
+				wp.installSnapshot(&reply)
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Like catchUp, for a replica of a Byzantine cluster: install a
+// checkpoint past seq that f+1 members agree on. Asks first for the
+// latest ones, then for each of those from everybody, since the
+// members need not all have got as far.
+func (wp *WhanauPaxos) catchUpBFT(seq int) {
+	f := (len(wp.servers) - 1) / 3
+	for !wp.dead {
+		latest := wp.fetchCheckpoints(seq, 0)
+		seqs := make([]int, 0)
+		for _, snap := range latest {
+			seqs = append(seqs, snap.Seq)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(seqs)))
+
+		for i, cp := range seqs {
+			if i > 0 && cp == seqs[i-1] {
+				continue
+			}
+			votes := make(map[string]int)
+			for _, snap := range wp.fetchCheckpoints(seq, cp) {
+				d := snap.digest()
+				votes[d]++
+				if votes[d] > f {
+					wp.installSnapshot(snap)
+					return
+				}
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Ask every other member for its checkpoint at cp, or its latest
+// one past seq if cp is 0.
+func (wp *WhanauPaxos) fetchCheckpoints(seq int,
+	cp int) []*FetchSnapshotReply {
+	snaps := make([]*FetchSnapshotReply, 0)
+	for i, srv := range wp.servers {
+		if i == wp.me {
+			continue
+		}
+		args := &FetchSnapshotArgs{seq, cp}
+		reply := new(FetchSnapshotReply)
+		ok := call(wp.tr, srv, "WhanauPaxos-"+wp.uid+".FetchSnapshot",
+			args, reply)
+		if ok && reply.Err == OK && reply.Seq > seq &&
+			(cp == 0 || reply.Seq == cp) {
+			snaps = append(snaps, reply)
+		}
+	}
+	return snaps
+}
+
+// A digest of the state in snap that is the same at every replica
+// with the same state, whatever order its maps come in.
+func (snap *FetchSnapshotReply) digest() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d %d %d %v\n", snap.Seq, snap.View,
+		snap.EpochStart.UnixNano(), snap.ServersFrom, snap.Servers)
+
+	enc := func(v interface{}) string {
+		var buf bytes.Buffer
+		gob.NewEncoder(&buf).Encode(&v)
+		return hex.EncodeToString(buf.Bytes())
+	}
+	lines := make([]string, 0)
+	for k, v := range snap.DB {
+		lines = append(lines, fmt.Sprintf("db %q %s", k, enc(v)))
+	}
+	for k, v := range snap.HandledRequests {
+		lines = append(lines, fmt.Sprintf("req %d %s", k, enc(v)))
+	}
+	for k, v := range snap.PendingWrites {
+		lines = append(lines, fmt.Sprintf("pw %q %d %s %q", k.Key, k.View,
+			enc(v.Value), v.Server))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (wp *WhanauPaxos) installSnapshot(snap *FetchSnapshotReply) {
+	wp.mu.Lock()
+	wp.dbLock.Lock()
+	wp.pwLock.Lock()
+	if snap.Seq > wp.currSeq {
+		wp.currSeq = snap.Seq
+		wp.currView = snap.View
+		wp.epoch_start = snap.EpochStart
+		wp.db = snap.DB
+		wp.handledRequests = snap.HandledRequests
+		wp.pending_writes = snap.PendingWrites
+		if snap.ServersFrom > wp.servers_from {
+			// we missed a change of members.
+			wp.setServers(snap.Servers, snap.ServersFrom)
+		}
+	}
+	wp.pwLock.Unlock()
+	wp.dbLock.Unlock()
+	wp.mu.Unlock()
+
+	// the snapshot now stands in for everything before it.
+	if err := wp.saveSnapshot(); err != nil {
+		log.Printf("WhanauPaxos(%v) snapshot: %v", wp.me, err)
+		return
+	}
+	wp.px.Done(snap.Seq - 1)
+	wp.px.Compact(snap.Seq - 1)
+	if wp.bft && snap.Seq%LogTail == 0 {
+		wp.checkpoint()
+	}
+}
+
+// Restart every cluster replica this server had snapshotted in its
+// dir, except the master cluster skip, and hand each replica back
+// the keys it stores.
+func (ws *WhanauServer) restoreClusters(skip string) {
+	names, _ := filepath.Glob(filepath.Join(ws.dir, "WhanauPaxos-*.snap"))
+	for _, name := range names {
+		snap, err := readSnapshot(name)
+		if err != nil {
+			continue
+		}
+		if snap.Uid == skip || snap.Me < 0 {
+			// a master replica, or one we are no longer a member of.
+			continue
+		}
+		if _, found := ws.FindWPInstanceIfCreated(snap.Uid); found {
+			continue
+		}
+
+		wp := startWhanauPaxos(snap.Servers, snap.Me, snap.Uid, 0, snap.BFT,
+			ws.rpc, ws.tr, ws.dir)
+		for key := range wp.db {
+			ws.paxosInstances[key] = wp
+			ws.kvstore[key] = ValueType{wp.servers}
+		}
+	}
+}
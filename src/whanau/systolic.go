@@ -4,33 +4,25 @@ import "time"
 import "log"
 import "fmt"
 
-func (ws *WhanauServer) ServerHandler() {
-	for !ws.doneMixing {
-		args := <-ws.recv_chan
-
-		ws.rec_mu.Lock()
-
-		if _, ok := ws.received_servers[args.Timestep]; ok {
-			ws.received_servers[args.Timestep] =
-				append(ws.received_servers[args.Timestep], args.Servers)
-		} else {
-			ws.received_servers[args.Timestep] = make([][]string, 0)
-			ws.received_servers[args.Timestep] =
-				append(ws.received_servers[args.Timestep], args.Servers)
-		}
-
-		ws.rec_mu.Unlock()
-	}
+// Neighbors may already be mixing for the next setup round while we
+// finish this one, so what they send is kept apart by round.
+type mixStep struct {
+	Epoch    int
+	Timestep int
 }
 
-// RPC to receive random list of servers from neighbors
+// RPC to receive random list of servers from neighbors. Kept until
+// our own mixing gets to that step, which may not have started yet.
 func (ws *WhanauServer) GetRandomServers(args *SystolicMixingArgs,
 	reply *SystolicMixingReply) error {
-	// send over the servers to the systolic mixing process
 	//fmt.Printf("server %v got getrandom from server %v at ts %d\n",
 	//	ws.me, args.SenderAddr, args.Timestep)
 
-	ws.recv_chan <- args
+	ws.rec_mu.Lock()
+	step := mixStep{args.Epoch, args.Timestep}
+	ws.received_servers[step] = append(ws.received_servers[step],
+		args.Servers)
+	ws.rec_mu.Unlock()
 
 	reply.Err = OK
 	return nil
@@ -39,8 +31,9 @@ func (ws *WhanauServer) GetRandomServers(args *SystolicMixingArgs,
 // Perform systolic mixing, cf section 9.2 of thesis
 func (ws *WhanauServer) PerformSystolicMixing(numWalks int) {
 	fmt.Printf("")
-	ws.doneMixing = false
-	go ws.ServerHandler()
+	ws.mu.Lock()
+	epoch := ws.epoch
+	ws.mu.Unlock()
 
 	server_pool := make([]string, numWalks)
 	for i := 0; i < len(server_pool); i++ {
@@ -71,11 +64,12 @@ func (ws *WhanauServer) PerformSystolicMixing(numWalks int) {
 				end = len(server_pool)
 			}
 			DPrintf("server %v using bounds %d %d with len %d neighbors %v addresses %d\n", ws.me, start, end, len(server_pool), len(ws.neighbors), naddresses)
-			srv_args := &SystolicMixingArgs{server_pool[start:end], iter + 1,
+			forward := ws.behavior.Forward(ws, server_pool[start:end])
+			srv_args := &SystolicMixingArgs{forward, epoch, iter + 1,
 				ws.myaddr}
 			var srv_reply SystolicMixingReply
 
-			ok := call(srv, "WhanauServer.GetRandomServers",
+			ok := call(ws.tr, srv, "WhanauServer.GetRandomServers",
 				srv_args, &srv_reply)
 			if !ok || srv_reply.Err != OK {
 				log.Fatalf("call to server %s failed\n", srv)
@@ -84,13 +78,18 @@ func (ws *WhanauServer) PerformSystolicMixing(numWalks int) {
 		}
 
 		// when can we move on? need replies from all neighbors
-		val := ws.received_servers[iter+1]
+		step := mixStep{epoch, iter + 1}
+		ws.rec_mu.Lock()
+		val := ws.received_servers[step]
+		ws.rec_mu.Unlock()
 
 		// val is a list of lists of servers. how long is it?
 		// should be as long as the neighbors set.
 		for val == nil || len(val) < len(ws.neighbors) {
-			time.Sleep(time.Millisecond * 100)
-			val = ws.received_servers[iter+1]
+			sleep(ws.tr, time.Millisecond*100)
+			ws.rec_mu.Lock()
+			val = ws.received_servers[step]
+			ws.rec_mu.Unlock()
 		}
 
 		if iter+1 == ws.w {
@@ -100,7 +99,9 @@ func (ws *WhanauServer) PerformSystolicMixing(numWalks int) {
 		}
 
 		// free up memory!!
-		delete(ws.received_servers, iter)
+		ws.rec_mu.Lock()
+		delete(ws.received_servers, mixStep{epoch, iter})
+		ws.rec_mu.Unlock()
 
 		// create server pool by concatenating new vals
 		server_pool = make([]string, 0)
@@ -118,6 +119,16 @@ func (ws *WhanauServer) PerformSystolicMixing(numWalks int) {
 	ws.rw_servers = make([]string, len(server_pool))
 	copy(ws.rw_servers, server_pool)
 	ws.rw_idx = 0
+	ws.lookup_idx = 0
 
 	ws.rw_mu.Unlock()
+
+	// the rest of this round's steps are of no more use.
+	ws.rec_mu.Lock()
+	for step := range ws.received_servers {
+		if step.Epoch <= epoch {
+			delete(ws.received_servers, step)
+		}
+	}
+	ws.rec_mu.Unlock()
 }
@@ -11,6 +11,12 @@ import "time"
 import crand "crypto/rand"
 import "crypto/rsa"
 import "sync"
+import "transport"
+import "pbft"
+import "net"
+import "sort"
+import "graph"
+import "strings"
 
 func port(tag string, host int) string {
 	s := "/var/tmp/824-"
@@ -36,7 +42,7 @@ func testRandomWalk(server string, steps int) string {
 	args := &RandomWalkArgs{}
 	args.Steps = steps
 	var reply RandomWalkReply
-	ok := call(server, "WhanauServer.RandomWalk", args, &reply)
+	ok := call(transport.Unix{}, server, "WhanauServer.RandomWalk", args, &reply)
 	if ok && (reply.Err == OK) {
 		return reply.Server
 	}
@@ -49,7 +55,7 @@ func testGetId(server string, layer int) KeyType {
 	args := &GetIdArgs{}
 	args.Layer = layer
 	var reply GetIdReply
-	ok := call(server, "WhanauServer.GetId", args, &reply)
+	ok := call(transport.Unix{}, server, "WhanauServer.GetId", args, &reply)
 	if ok && (reply.Err == OK) {
 		return reply.Key
 	}
@@ -108,12 +114,12 @@ func TestLookup(t *testing.T) {
 	for k := 0; k < nservers; k++ {
 		ws[k] = StartServer(kvh, k, kvh[k], neighbors[k],
 			make([]string, 0), nil, false, false, false,
-			nlayers, nfingers, w, rd, rs, ts)
+			nlayers, nfingers, w, rd, rs, ts, nil, "")
 	}
 
 	var cka [nservers]*Clerk
 	for i := 0; i < nservers; i++ {
-		cka[i] = MakeClerk(kvh[i])
+		cka[i] = MakeClerk(kvh[i], nil)
 	}
 
 	fmt.Printf("\033[95m%s\033[0m\n", "Test: Lookup")
@@ -154,7 +160,7 @@ func TestLookup(t *testing.T) {
 	// wait for all setups to finish
 	for i := 0; i < nservers; i++ {
 		done := <-c
-		DPrintf("ws[%d] setup done: %b", i, done)
+		DPrintf("ws[%d] setup done: %t", i, done)
 	}
 
 	elapsed := time.Since(start)
@@ -169,8 +175,8 @@ func TestLookup(t *testing.T) {
 
 	for i := 0; i < nservers; i++ {
 		srv := ws[i]
-		for j := 0; j < len(srv.db); j++ {
-			keyset[srv.db[j].Key] = true
+		for j := 0; j < len(srv.routing.db); j++ {
+			keyset[srv.routing.db[j].Key] = true
 		}
 	}
 
@@ -191,9 +197,9 @@ func TestLookup(t *testing.T) {
 
 	for i := 0; i < nservers; i++ {
 		srv := ws[i]
-		for j := 0; j < len(srv.succ); j++ {
-			for k := 0; k < len(srv.succ[j]); k++ {
-				keyset[srv.succ[j][k].Key] = true
+		for j := 0; j < len(srv.routing.succ); j++ {
+			for k := 0; k < len(srv.routing.succ[j]); k++ {
+				keyset[srv.routing.succ[j][k].Key] = true
 			}
 		}
 	}
@@ -262,12 +268,12 @@ func TestDataIntegrityBasic(t *testing.T) {
 	sk, err := rsa.GenerateKey(crand.Reader, 2014)
 
 	if err != nil {
-		t.Fatalf("key gen err", err)
+		t.Fatalf("key gen err: %v", err)
 	}
 
 	err = sk.Validate()
 	if err != nil {
-		t.Fatalf("Validation failed.", err)
+		t.Fatalf("Validation failed: %v", err)
 	}
 
 	fmt.Println("Testing verification on true value type")
@@ -342,16 +348,16 @@ func TestRealGetAndPut(t *testing.T) {
 
 		if i < 3 {
 			ws[i] = StartServer(kvh, i, kvh[i], neighbors, master_servers, master_servers, true, false, false,
-				nlayers, nfingers, w, rd, rs, ts)
+				nlayers, nfingers, w, rd, rs, ts, nil, "")
 		} else {
 			ws[i] = StartServer(kvh, i, kvh[i], neighbors, master_servers, nil, false, false, false,
-				nlayers, nfingers, w, rd, rs, ts)
+				nlayers, nfingers, w, rd, rs, ts, nil, "")
 		}
 	}
 
 	var cka [nservers]*Clerk
 	for i := 0; i < nservers; i++ {
-		cka[i] = MakeClerk(kvh[i])
+		cka[i] = MakeClerk(kvh[i], nil)
 	}
 
 	fmt.Printf("\033[95m%s\033[0m\n", "Test: Real Lookup")
@@ -363,9 +369,9 @@ func TestRealGetAndPut(t *testing.T) {
 	for i := 0; i < nservers; i++ {
 
 		paxos_cluster := []string{kvh[i], kvh[(i+1)%nservers], kvh[(i+2)%nservers]}
-		wp0 := StartWhanauPaxos(paxos_cluster, 0, "", ws[i].rpc)
-		wp1 := StartWhanauPaxos(paxos_cluster, 1, "", ws[(i+1)%nservers].rpc)
-		wp2 := StartWhanauPaxos(paxos_cluster, 2, "", ws[(i+2)%nservers].rpc)
+		wp0 := StartWhanauPaxos(paxos_cluster, 0, ClusterUID(paxos_cluster), ws[i].rpc, nil, "")
+		wp1 := StartWhanauPaxos(paxos_cluster, 1, ClusterUID(paxos_cluster), ws[(i+1)%nservers].rpc, nil, "")
+		wp2 := StartWhanauPaxos(paxos_cluster, 2, ClusterUID(paxos_cluster), ws[(i+2)%nservers].rpc, nil, "")
 
 		for j := 0; j < nkeys/nservers; j++ {
 			//var key KeyType = testKeys[counter]
@@ -378,9 +384,9 @@ func TestRealGetAndPut(t *testing.T) {
 			records[key] = val
 			ws[i].kvstore[key] = val
 
-			ws[i].paxosInstances[key] = *wp0
-			ws[(i+1)%nservers].paxosInstances[key] = *wp1
-			ws[(i+2)%nservers].paxosInstances[key] = *wp2
+			ws[i].paxosInstances[key] = wp0
+			ws[(i+1)%nservers].paxosInstances[key] = wp1
+			ws[(i+2)%nservers].paxosInstances[key] = wp2
 
 			val0 := TrueValueType{"hello", wp0.myaddr, nil, &ws[i].secretKey.PublicKey}
 			sig0, _ := SignTrueValue(val0, ws[i].secretKey)
@@ -413,7 +419,7 @@ func TestRealGetAndPut(t *testing.T) {
 	// wait for all setups to finish
 	for i := 0; i < nservers; i++ {
 		done := <-c
-		DPrintf("ws[%d] setup done: %b", i, done)
+		DPrintf("ws[%d] setup done: %t", i, done)
 	}
 
 	elapsed := time.Since(start)
@@ -426,7 +432,7 @@ func TestRealGetAndPut(t *testing.T) {
 	ws[3].Lookup(largs, lreply)
 	//fmt.Printf("lreply.value is %v\n", lreply.Value.Servers)
 
-	cl := MakeClerk(kvh[0])
+	cl := MakeClerk(kvh[0], nil)
 
 	fmt.Printf("Try to do a lookup from client\n")
 
@@ -480,16 +486,16 @@ func TestEndToEnd(t *testing.T) {
 
 		if i < 3 {
 			ws[i] = StartServer(kvh, i, kvh[i], neighbors, master_servers, master_servers, true, false, false,
-				nlayers, nfingers, w, rd, rs, ts)
+				nlayers, nfingers, w, rd, rs, ts, nil, "")
 		} else {
 			ws[i] = StartServer(kvh, i, kvh[i], neighbors, master_servers, nil, false, false, false,
-				nlayers, nfingers, w, rd, rs, ts)
+				nlayers, nfingers, w, rd, rs, ts, nil, "")
 		}
 	}
 
 	var cka [nservers]*Clerk
 	for i := 0; i < nservers; i++ {
-		cka[i] = MakeClerk(kvh[i])
+		cka[i] = MakeClerk(kvh[i], nil)
 	}
 
 	fmt.Printf("\033[95m%s\033[0m\n", "Test: End to End")
@@ -536,16 +542,16 @@ func TestPendingWrites(t *testing.T) {
 
 		if i < 3 {
 			ws[i] = StartServer(kvh, i, kvh[i], neighbors, master_servers, master_servers, true, false, false,
-				nlayers, nfingers, w, rd, rs, ts)
+				nlayers, nfingers, w, rd, rs, ts, nil, "")
 		} else {
 			ws[i] = StartServer(kvh, i, kvh[i], neighbors, master_servers, nil, false, false, false,
-				nlayers, nfingers, w, rd, rs, ts)
+				nlayers, nfingers, w, rd, rs, ts, nil, "")
 		}
 	}
 
 	var cka [nservers]*Clerk
 	for i := 0; i < nservers; i++ {
-		cka[i] = MakeClerk(kvh[i])
+		cka[i] = MakeClerk(kvh[i], nil)
 	}
 
 	fmt.Printf("\033[95m%s\033[0m\n", "Test: Real Lookup")
@@ -557,9 +563,9 @@ func TestPendingWrites(t *testing.T) {
 	for i := 0; i < nservers; i++ {
 
 		paxos_cluster := []string{kvh[i], kvh[(i+1)%nservers], kvh[(i+2)%nservers]}
-		wp0 := StartWhanauPaxos(paxos_cluster, 0, "", ws[i].rpc)
-		wp1 := StartWhanauPaxos(paxos_cluster, 1, "", ws[(i+1)%nservers].rpc)
-		wp2 := StartWhanauPaxos(paxos_cluster, 2, "", ws[(i+2)%nservers].rpc)
+		wp0 := StartWhanauPaxos(paxos_cluster, 0, ClusterUID(paxos_cluster), ws[i].rpc, nil, "")
+		wp1 := StartWhanauPaxos(paxos_cluster, 1, ClusterUID(paxos_cluster), ws[(i+1)%nservers].rpc, nil, "")
+		wp2 := StartWhanauPaxos(paxos_cluster, 2, ClusterUID(paxos_cluster), ws[(i+2)%nservers].rpc, nil, "")
 
 		for j := 0; j < nkeys/nservers; j++ {
 			//var key KeyType = testKeys[counter]
@@ -572,9 +578,9 @@ func TestPendingWrites(t *testing.T) {
 			records[key] = val
 			ws[i].kvstore[key] = val
 
-			ws[i].paxosInstances[key] = *wp0
-			ws[(i+1)%nservers].paxosInstances[key] = *wp1
-			ws[(i+2)%nservers].paxosInstances[key] = *wp2
+			ws[i].paxosInstances[key] = wp0
+			ws[(i+1)%nservers].paxosInstances[key] = wp1
+			ws[(i+2)%nservers].paxosInstances[key] = wp2
 
 			val0 := TrueValueType{"hello", wp0.myaddr, nil, &ws[i].secretKey.PublicKey}
 			sig0, _ := SignTrueValue(val0, ws[i].secretKey)
@@ -607,7 +613,7 @@ func TestPendingWrites(t *testing.T) {
 	// wait for all setups to finish
 	for i := 0; i < nservers; i++ {
 		done := <-c
-		DPrintf("ws[%d] setup done: %b", i, done)
+		DPrintf("ws[%d] setup done: %t", i, done)
 	}
 
 	elapsed := time.Since(start)
@@ -620,7 +626,7 @@ func TestPendingWrites(t *testing.T) {
 	ws[3].Lookup(largs, lreply)
 	//fmt.Printf("lreply.value is %v\n", lreply.Value.Servers)
 
-	cl := MakeClerk(kvh[0])
+	cl := MakeClerk(kvh[0], nil)
 
 	fmt.Printf("Try to do a lookup from client\n")
 
@@ -708,7 +714,7 @@ func TestDemo(t *testing.T) {
 
 		StartServer(newservers, j, srv, nil,
 			master_servers, newservers, false, false, true, nlayers, nfingers,
-			w, rd, rs, ts)
+			w, rd, rs, ts, nil, "")
 	}
 
 	for i := 0; i < nservers; i++ {
@@ -722,16 +728,16 @@ func TestDemo(t *testing.T) {
 
 		if i < 3 {
 			ws[i] = StartServer(kvh, i, kvh[i], neighbors, master_servers, newservers, true, false, false,
-				nlayers, nfingers, w, rd, rs, ts)
+				nlayers, nfingers, w, rd, rs, ts, nil, "")
 		} else {
 			ws[i] = StartServer(kvh, i, kvh[i], neighbors, master_servers, nil, false, false, false,
-				nlayers, nfingers, w, rd, rs, ts)
+				nlayers, nfingers, w, rd, rs, ts, nil, "")
 		}
 	}
 
 	var cka [nservers]*Clerk
 	for i := 0; i < nservers; i++ {
-		cka[i] = MakeClerk(kvh[i])
+		cka[i] = MakeClerk(kvh[i], nil)
 	}
 
 	fmt.Printf("\033[95m%s\033[0m\n", "Demo")
@@ -743,13 +749,13 @@ func TestDemo(t *testing.T) {
 	for i := 0; i < nservers; i++ {
 
 		paxos_cluster := []string{kvh[i], kvh[(i+1)%nservers], kvh[(i+2)%nservers], kvh[(i+3)%nservers], kvh[(i+4)%nservers], kvh[(i+5)%nservers], kvh[(i+6)%nservers]}
-		wp0 := StartWhanauPaxos(paxos_cluster, 0, "", ws[i].rpc)
-		wp1 := StartWhanauPaxos(paxos_cluster, 1, "", ws[(i+1)%nservers].rpc)
-		wp2 := StartWhanauPaxos(paxos_cluster, 2, "", ws[(i+2)%nservers].rpc)
-		wp3 := StartWhanauPaxos(paxos_cluster, 3, "", ws[(i+3)%nservers].rpc)
-		wp4 := StartWhanauPaxos(paxos_cluster, 4, "", ws[(i+4)%nservers].rpc)
-		wp5 := StartWhanauPaxos(paxos_cluster, 5, "", ws[(i+5)%nservers].rpc)
-		wp6 := StartWhanauPaxos(paxos_cluster, 6, "", ws[(i+6)%nservers].rpc)
+		wp0 := StartWhanauPaxos(paxos_cluster, 0, ClusterUID(paxos_cluster), ws[i].rpc, nil, "")
+		wp1 := StartWhanauPaxos(paxos_cluster, 1, ClusterUID(paxos_cluster), ws[(i+1)%nservers].rpc, nil, "")
+		wp2 := StartWhanauPaxos(paxos_cluster, 2, ClusterUID(paxos_cluster), ws[(i+2)%nservers].rpc, nil, "")
+		wp3 := StartWhanauPaxos(paxos_cluster, 3, ClusterUID(paxos_cluster), ws[(i+3)%nservers].rpc, nil, "")
+		wp4 := StartWhanauPaxos(paxos_cluster, 4, ClusterUID(paxos_cluster), ws[(i+4)%nservers].rpc, nil, "")
+		wp5 := StartWhanauPaxos(paxos_cluster, 5, ClusterUID(paxos_cluster), ws[(i+5)%nservers].rpc, nil, "")
+		wp6 := StartWhanauPaxos(paxos_cluster, 6, ClusterUID(paxos_cluster), ws[(i+6)%nservers].rpc, nil, "")
 
 		for j := 0; j < nkeys/nservers; j++ {
 			//var key KeyType = testKeys[counter]
@@ -762,13 +768,13 @@ func TestDemo(t *testing.T) {
 			records[key] = val
 			ws[i].kvstore[key] = val
 
-			ws[i].paxosInstances[key] = *wp0
-			ws[(i+1)%nservers].paxosInstances[key] = *wp1
-			ws[(i+2)%nservers].paxosInstances[key] = *wp2
-			ws[(i+3)%nservers].paxosInstances[key] = *wp3
-			ws[(i+4)%nservers].paxosInstances[key] = *wp4
-			ws[(i+5)%nservers].paxosInstances[key] = *wp5
-			ws[(i+6)%nservers].paxosInstances[key] = *wp6
+			ws[i].paxosInstances[key] = wp0
+			ws[(i+1)%nservers].paxosInstances[key] = wp1
+			ws[(i+2)%nservers].paxosInstances[key] = wp2
+			ws[(i+3)%nservers].paxosInstances[key] = wp3
+			ws[(i+4)%nservers].paxosInstances[key] = wp4
+			ws[(i+5)%nservers].paxosInstances[key] = wp5
+			ws[(i+6)%nservers].paxosInstances[key] = wp6
 
 			val0 := TrueValueType{"hello", wp0.myaddr, nil, &ws[i].secretKey.PublicKey}
 			sig0, _ := SignTrueValue(val0, ws[i].secretKey)
@@ -822,7 +828,7 @@ func TestDemo(t *testing.T) {
 	// wait for all setups to finish
 	for i := 0; i < nservers; i++ {
 		done := <-c
-		DPrintf("ws[%d] setup done: %b", i, done)
+		DPrintf("ws[%d] setup done: %t", i, done)
 	}
 
 	elapsed := time.Since(start)
@@ -834,7 +840,7 @@ func TestDemo(t *testing.T) {
 	lreply := &LookupReply{}
 	ws[3].Lookup(largs, lreply)
 
-	cl := MakeClerk(kvh[0])
+	cl := MakeClerk(kvh[0], nil)
 
 	fmt.Printf("Client lookup of existing key 0...\n")
 
@@ -904,16 +910,12 @@ func TestLookupWithSybilsMalicious(t *testing.T) {
 	runtime.GOMAXPROCS(8)
 	iterations := 1
 	for z := 0; z < iterations; z++ {
-		fmt.Println("Iteration: %d \n \n", z)
+		fmt.Printf("Iteration: %d \n \n", z)
 		const nservers = 20
 		const nkeys = 100          // keys are strings from 0 to 99
 		const k = nkeys / nservers // keys per node
 		const sybilProb = 0.49
-<<<<<<< HEAD
-        attackEdgeProb :=  0.5 // float32(z%10)/10 + 0.1
-=======
 		attackEdgeProb := float32(z%10)/10 + 0.1
->>>>>>> 40adc9f4072d58facc490348589e8a0e019cf235
 		// run setup in parallel
 		// parameters
 		constant := 5
@@ -926,11 +928,7 @@ func TestLookupWithSybilsMalicious(t *testing.T) {
 		attackCounter := 0
 		numSybilServers := 10
 		sybilServerCounter := 0
-<<<<<<< HEAD
-        var edgeProb float32 = 1
-=======
 		var edgeProb float32 = 0.8
->>>>>>> 40adc9f4072d58facc490348589e8a0e019cf235
 
 		var ws []*WhanauServer = make([]*WhanauServer, nservers)
 		var kvh []string = make([]string, nservers)
@@ -990,22 +988,22 @@ func TestLookupWithSybilsMalicious(t *testing.T) {
 		}
 
 		fmt.Printf("Actual number of attack edges: %d \n", attackCounter)
-		fmt.Printf("Edge probability: %d \n", edgeProb)
-		fmt.Printf("Attack edge probability: %d \n", attackEdgeProb)
+		fmt.Printf("Edge probability: %v \n", edgeProb)
+		fmt.Printf("Attack edge probability: %v \n", attackEdgeProb)
 
 		for k := 0; k < nservers; k++ {
 			if _, ok := ksvh[k]; ok {
 				ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], make([]string, 0), nil, false, true, false,
-					nlayers, nfingers, w, rd, rs, ts)
+					nlayers, nfingers, w, rd, rs, ts, nil, "")
 			} else {
 				ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], make([]string, 0), nil, false, false, false,
-					nlayers, nfingers, w, rd, rs, ts)
+					nlayers, nfingers, w, rd, rs, ts, nil, "")
 			}
 		}
 
 		var cka [nservers]*Clerk
 		for i := 0; i < nservers; i++ {
-			cka[i] = MakeClerk(kvh[i])
+			cka[i] = MakeClerk(kvh[i], nil)
 		}
 
 		fmt.Printf("\033[95m%s\033[0m\n", "Test: Lookup With Sybils")
@@ -1050,7 +1048,7 @@ func TestLookupWithSybilsMalicious(t *testing.T) {
 		// wait for all setups to finish
 		for i := 0; i < nservers; i++ {
 			done := <-c
-			DPrintf("ws[%d] setup done: %b", i, done)
+			DPrintf("ws[%d] setup done: %t", i, done)
 		}
 
 		elapsed := time.Since(start)
@@ -1130,12 +1128,12 @@ func TestSystolic(t *testing.T) {
 
 		ws[i] = StartServer(kvh, i, kvh[i], neighbors, make([]string, 0),
 			nil, false, false, false,
-			nlayers, nfingers, w, rd, rs, ts)
+			nlayers, nfingers, w, rd, rs, ts, nil, "")
 	}
 
 	var cka [nservers]*Clerk
 	for i := 0; i < nservers; i++ {
-		cka[i] = MakeClerk(kvh[i])
+		cka[i] = MakeClerk(kvh[i], nil)
 	}
 
 	fmt.Printf("\033[95m%s\033[0m\n", "Test: Systolic mixing")
@@ -1151,7 +1149,7 @@ func TestSystolic(t *testing.T) {
 	// wait for mixing to finish
 	for i := 0; i < nservers; i++ {
 		done := <-c
-		DPrintf("ws[%d] mixing done: %b", i, done)
+		DPrintf("ws[%d] mixing done: %t", i, done)
 	}
 
 }
@@ -1269,7 +1267,7 @@ func TestRealLookupSybil(t *testing.T) {
 			// No routing should happen here!
 			StartServer(newservers, j, srv, nil,
 				master_servers, newservers, false, false, true, nlayers, nfingers,
-				w, rd, rs, ts)
+				w, rd, rs, ts, nil, "")
 		}
 
 		fmt.Printf("newservers is %v\n", newservers)
@@ -1280,27 +1278,27 @@ func TestRealLookupSybil(t *testing.T) {
 			if _, ok := ksvh[k]; ok {
 				if k < PaxosSize {
 					// malicious master -- doesn't do anything
-					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, newservers, true, true, false, nlayers, nfingers, w, rd, rs, ts)
+					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, newservers, true, true, false, nlayers, nfingers, w, rd, rs, ts, nil, "")
 
 				} else {
 					// malicious nonmaster
-					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, nil, false, true, false, nlayers, nfingers, w, rd, rs, ts)
+					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, nil, false, true, false, nlayers, nfingers, w, rd, rs, ts, nil, "")
 				}
 			} else {
 				// not malicious
 				if k < PaxosSize {
 					// non malicious master
-					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, newservers, true, false, false, nlayers, nfingers, w, rd, rs, ts)
+					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, newservers, true, false, false, nlayers, nfingers, w, rd, rs, ts, nil, "")
 				} else {
 					// normal villager
-					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, nil, false, false, false, nlayers, nfingers, w, rd, rs, ts)
+					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, nil, false, false, false, nlayers, nfingers, w, rd, rs, ts, nil, "")
 				}
 			}
 		}
 
 		var cka [nservers]*Clerk
 		for i := 0; i < nservers; i++ {
-			cka[i] = MakeClerk(kvh[i])
+			cka[i] = MakeClerk(kvh[i], nil)
 		}
 
 		fmt.Printf("\033[95m%s\033[0m\n", "Test: Real Lookup With Sybils")
@@ -1359,7 +1357,7 @@ func TestRealLookupSybil(t *testing.T) {
 		elapsed := time.Since(start)
 		fmt.Printf("Finished setup from initiate setup, time: %s\n", elapsed)
 		for i := 0; i < nservers; i++ {
-			fmt.Printf("ws[%d].kvstore length: %s\n", i, len(ws[i].kvstore))
+			fmt.Printf("ws[%d].kvstore length: %d\n", i, len(ws[i].kvstore))
 
 			for key, val := range ws[i].kvstore {
 				fmt.Printf("Paxos cluster for key %s: %s\n", key, val)
@@ -1378,8 +1376,8 @@ func TestRealLookupSybil(t *testing.T) {
 
 			for i := 0; i < nservers; i++ {
 				srv := ws[i]
-				for j := 0; j < len(srv.db); j++ {
-					keyset[srv.db[j].Key] = true
+				for j := 0; j < len(srv.routing.db); j++ {
+					keyset[srv.routing.db[j].Key] = true
 				}
 			}
 
@@ -1400,9 +1398,9 @@ func TestRealLookupSybil(t *testing.T) {
 
 			for i := 0; i < nservers; i++ {
 				srv := ws[i]
-				for j := 0; j < len(srv.succ); j++ {
-					for k := 0; k < len(srv.succ[j]); k++ {
-						keyset[srv.succ[j][k].Key] = true
+				for j := 0; j < len(srv.routing.succ); j++ {
+					for k := 0; k < len(srv.routing.succ[j]); k++ {
+						keyset[srv.routing.succ[j][k].Key] = true
 					}
 				}
 			}
@@ -1447,7 +1445,7 @@ func TestRealLookupSybil(t *testing.T) {
 						myNumFound++
 					} else {
 						if val != ErrNoKey && val != trueRecords[key] {
-							t.Fatalf("Wrong true value for key %s, returned %s expected: %s\n", key, val, trueRecords[key])
+							t.Errorf("Wrong true value for key %s, returned %s expected: %s\n", key, val, trueRecords[key])
 						}
 						fmt.Printf("Key %s not found D: \n", key)
 					}
@@ -1583,7 +1581,7 @@ func TestClusterComp(t *testing.T) {
 			// No routing should happen here!
 			StartServer(newservers, j, srv, nil,
 				master_servers, newservers, false, false, true, nlayers, nfingers,
-				w, rd, rs, ts)
+				w, rd, rs, ts, nil, "")
 		}
 
 		fmt.Printf("newservers is %v\n", newservers)
@@ -1594,27 +1592,27 @@ func TestClusterComp(t *testing.T) {
 			if _, ok := ksvh[k]; ok {
 				if k < PaxosSize {
 					// malicious master -- doesn't do anything
-					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, newservers, true, true, false, nlayers, nfingers, w, rd, rs, ts)
+					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, newservers, true, true, false, nlayers, nfingers, w, rd, rs, ts, nil, "")
 
 				} else {
 					// malicious nonmaster
-					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, nil, false, true, false, nlayers, nfingers, w, rd, rs, ts)
+					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, nil, false, true, false, nlayers, nfingers, w, rd, rs, ts, nil, "")
 				}
 			} else {
 				// not malicious
 				if k < PaxosSize {
 					// non malicious master
-					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, newservers, true, false, false, nlayers, nfingers, w, rd, rs, ts)
+					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, newservers, true, false, false, nlayers, nfingers, w, rd, rs, ts, nil, "")
 				} else {
 					// normal villager
-					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, nil, false, false, false, nlayers, nfingers, w, rd, rs, ts)
+					ws[k] = StartServer(kvh, k, kvh[k], neighbors[k], master_servers, nil, false, false, false, nlayers, nfingers, w, rd, rs, ts, nil, "")
 				}
 			}
 		}
 
 		var cka [nservers]*Clerk
 		for i := 0; i < nservers; i++ {
-			cka[i] = MakeClerk(kvh[i])
+			cka[i] = MakeClerk(kvh[i], nil)
 		}
 
 		fmt.Printf("\033[95m%s\033[0m\n", "Test: Paxos Cluster Composition")
@@ -1675,7 +1673,7 @@ func TestClusterComp(t *testing.T) {
 		elapsed := time.Since(start)
 		fmt.Printf("Finished setup from initiate setup, time: %s\n", elapsed)
 		for i := 0; i < nservers; i++ {
-			fmt.Printf("ws[%d].kvstore length: %s\n", i, len(ws[i].kvstore))
+			fmt.Printf("ws[%d].kvstore length: %d\n", i, len(ws[i].kvstore))
 
 			for key, val := range ws[i].kvstore {
 				fmt.Printf("Paxos cluster for key %s: %s\n", key, val)
@@ -1722,3 +1720,2350 @@ func TestClusterComp(t *testing.T) {
 		fmt.Printf("Percent clusters with sybil majoriy: %v\n", float64(numMajority)/float64(totalClusters))
 	}
 }
+
+// Same as TestLookup, but over the in-memory transport, so no
+// sockets are created.
+func TestLookupMemTransport(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	const nservers = 10
+	const nkeys = 50
+	const k = nkeys / nservers
+
+	constant := 5
+	nlayers := int(math.Log(float64(k*nservers))) + 1
+	nfingers := int(math.Sqrt(k * nservers))
+	w := constant * int(math.Log(float64(nservers)))
+	rd := 2 * int(math.Sqrt(k*nservers))
+	rs := constant * int(math.Sqrt(k*nservers))
+	ts := 5
+
+	mem := transport.NewMem()
+	var ws []*WhanauServer = make([]*WhanauServer, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(ws)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = "mem-basic-" + strconv.Itoa(i)
+	}
+
+	for i := 0; i < nservers; i++ {
+		neighbors := make([]string, 0)
+		for j := 0; j < nservers; j++ {
+			if j != i {
+				neighbors = append(neighbors, kvh[j])
+			}
+		}
+		ws[i] = StartServer(kvh, i, kvh[i], neighbors,
+			make([]string, 0), nil, false, false, false,
+			nlayers, nfingers, w, rd, rs, ts, mem, "")
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Lookup over in-memory transport")
+
+	records := make(map[KeyType]ValueType)
+	counter := 0
+	for i := 0; i < nservers; i++ {
+		for j := 0; j < k; j++ {
+			key := KeyType(strconv.Itoa(counter))
+			counter++
+			val := ValueType{[]string{"ws" + strconv.Itoa(rand.Intn(PaxosSize))}}
+			records[key] = val
+			ws[i].kvstore[key] = val
+		}
+	}
+
+	c := make(chan bool)
+	for i := 0; i < nservers; i++ {
+		go func(srv int) {
+			ws[srv].Setup()
+			c <- true
+		}(i)
+	}
+	for i := 0; i < nservers; i++ {
+		<-c
+	}
+
+	numFound := 0
+	for i := 0; i < nservers; i++ {
+		for key, want := range records {
+			largs := &LookupArgs{key, nil}
+			lreply := &LookupReply{}
+			ws[i].Lookup(largs, lreply)
+			if lreply.Err != OK {
+				continue
+			}
+			if len(lreply.Value.Servers) != 1 ||
+				lreply.Value.Servers[0] != want.Servers[0] {
+				t.Fatalf("Wrong value for key %s: %v expected %v",
+					key, lreply.Value, want)
+			}
+			numFound++
+		}
+	}
+
+	frac := float64(numFound) / float64(nservers*nkeys)
+	fmt.Printf("Percent lookups successful: %f\n", frac)
+	if frac < 0.5 {
+		t.Fatalf("too few lookups succeeded: %f", frac)
+	}
+}
+
+// Lookups keep working while the servers run setup again, off the
+// routing tables of the last round.
+func TestLookupDuringSetup(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	const nservers = 10
+	const nkeys = 50
+	const k = nkeys / nservers
+
+	constant := 5
+	nlayers := int(math.Log(float64(k*nservers))) + 1
+	nfingers := int(math.Sqrt(k * nservers))
+	w := constant * int(math.Log(float64(nservers)))
+	rd := 2 * int(math.Sqrt(k*nservers))
+	rs := constant * int(math.Sqrt(k*nservers))
+	ts := 5
+
+	mem := transport.NewMem()
+	var ws []*WhanauServer = make([]*WhanauServer, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(ws)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = "mem-resetup-" + strconv.Itoa(i)
+	}
+
+	for i := 0; i < nservers; i++ {
+		neighbors := make([]string, 0)
+		for j := 0; j < nservers; j++ {
+			if j != i {
+				neighbors = append(neighbors, kvh[j])
+			}
+		}
+		ws[i] = StartServer(kvh, i, kvh[i], neighbors,
+			make([]string, 0), nil, false, false, false,
+			nlayers, nfingers, w, rd, rs, ts, mem, "")
+	}
+
+	records := make(map[KeyType]ValueType)
+	counter := 0
+	for i := 0; i < nservers; i++ {
+		for j := 0; j < k; j++ {
+			key := KeyType(strconv.Itoa(counter))
+			counter++
+			val := ValueType{[]string{"ws" + strconv.Itoa(rand.Intn(PaxosSize))}}
+			records[key] = val
+			ws[i].kvstore[key] = val
+		}
+	}
+
+	setup := func() chan bool {
+		c := make(chan bool, nservers)
+		for i := 0; i < nservers; i++ {
+			go func(srv int) {
+				ws[srv].Setup()
+				c <- true
+			}(i)
+		}
+		return c
+	}
+	c := setup()
+	for i := 0; i < nservers; i++ {
+		<-c
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Lookups during setup")
+
+	c = setup()
+	ndone := 0
+	numTried := 0
+	numFound := 0
+	for ndone < nservers {
+		for key, want := range records {
+			largs := &LookupArgs{key, nil}
+			lreply := &LookupReply{}
+			ws[numTried%nservers].Lookup(largs, lreply)
+			numTried++
+			if lreply.Err == OK {
+				if len(lreply.Value.Servers) != 1 ||
+					lreply.Value.Servers[0] != want.Servers[0] {
+					t.Fatalf("Wrong value for key %s: %v expected %v",
+						key, lreply.Value, want)
+				}
+				numFound++
+			}
+		}
+		for more := true; more; {
+			select {
+			case <-c:
+				ndone++
+			default:
+				more = false
+			}
+		}
+	}
+
+	frac := float64(numFound) / float64(numTried)
+	fmt.Printf("Percent of %d lookups successful: %f\n", numTried, frac)
+	if frac < 0.5 {
+		t.Fatalf("too few lookups succeeded: %f", frac)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// pick a free loopback port for a tcp test.
+func tcpport(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// Whanau servers and their Paxos clusters addressed by host:port,
+// as they would be on a LAN.
+func TestTCPDeployment(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 10
+	const nkeys = 20
+	const k = nkeys / nservers
+
+	constant := 5
+	nlayers := int(math.Log(float64(k*nservers))) + 1
+	nfingers := int(math.Sqrt(k * nservers))
+	w := constant * int(math.Log(float64(nservers)))
+	rd := 2 * int(math.Sqrt(k*nservers))
+	rs := constant * int(math.Sqrt(k*nservers))
+	ts := 5
+
+	tr := transport.TCP{}
+	var ws []*WhanauServer = make([]*WhanauServer, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(ws)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = tcpport(t)
+	}
+
+	master_servers := []string{kvh[0], kvh[1], kvh[2]}
+
+	for i := 0; i < nservers; i++ {
+		neighbors := make([]string, 0)
+		for j := 0; j < nservers; j++ {
+			if j != i {
+				neighbors = append(neighbors, kvh[j])
+			}
+		}
+		ws[i] = StartServer(kvh, i, kvh[i], neighbors, master_servers,
+			master_servers, i < 3, false, false,
+			nlayers, nfingers, w, rd, rs, ts, tr, "")
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: TCP deployment")
+
+	for i := 0; i < nservers; i++ {
+		paxos_cluster := []string{kvh[i], kvh[(i+1)%nservers], kvh[(i+2)%nservers]}
+		uid := ClusterUID(paxos_cluster)
+		wps := make([]*WhanauPaxos, len(paxos_cluster))
+		for m := range paxos_cluster {
+			wps[m] = StartWhanauPaxos(paxos_cluster, m, uid,
+				ws[(i+m)%nservers].rpc, tr, "")
+		}
+
+		for j := 0; j < k; j++ {
+			key := KeyType(strconv.Itoa(i*k + j))
+			ws[i].kvstore[key] = ValueType{paxos_cluster}
+			for m, wp := range wps {
+				srv := ws[(i+m)%nservers]
+				srv.paxosInstances[key] = wp
+				val := TrueValueType{"hello", wp.myaddr, nil, &srv.secretKey.PublicKey}
+				val.Sign, _ = SignTrueValue(val, srv.secretKey)
+				wp.db[key] = val
+			}
+		}
+	}
+
+	c := make(chan bool)
+	for i := 0; i < nservers; i++ {
+		go func(srv int) {
+			ws[srv].Setup()
+			c <- true
+		}(i)
+	}
+	for i := 0; i < nservers; i++ {
+		<-c
+	}
+
+	cl := MakeClerk(kvh[0], tr)
+
+	if v := cl.ClientGet("0"); v != "hello" {
+		t.Fatalf("ClientGet(0) over tcp = %q, expected hello", v)
+	}
+
+	cl.ClientPut("0", "helloworld")
+	if v := cl.ClientGet("0"); v != "helloworld" {
+		t.Fatalf("ClientGet(0) after put over tcp = %q, expected helloworld", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func wpdir(tag string, host int) string {
+	return port(tag, host) + "-state"
+}
+
+// put through wp itself, rather than through the cluster's leader.
+func putValue(t *testing.T, wp *WhanauPaxos, key KeyType, value string, reqID int64) {
+	args := &PaxosPutArgs{key, TrueValueType{value, "test", nil, nil}, reqID, true}
+	reply := &PaxosPutReply{}
+	wp.PaxosPut(args, reply)
+	if reply.Err != OK {
+		t.Fatalf("PaxosPut(%v) failed: %v", key, reply.Err)
+	}
+}
+
+func checkValue(t *testing.T, wp *WhanauPaxos, key KeyType, value string) {
+	wp.dbLock.Lock()
+	defer wp.dbLock.Unlock()
+	if v, ok := wp.db[key]; !ok || v.TrueValue != value {
+		t.Fatalf("replica %v has %v=%q, expected %q", wp.me, key, v.TrueValue, value)
+	}
+}
+
+// WhanauPaxos replicas that crash come back with their data, and
+// catch up on what they missed while they were down.
+func TestWhanauPaxosRestart(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nreplicas = 3
+	mem := transport.NewMem()
+	servers := make([]string, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		servers[i] = "wp-restart-" + strconv.Itoa(i)
+		os.RemoveAll(wpdir("wprestart", i))
+	}
+	defer func() {
+		for i := 0; i < nreplicas; i++ {
+			os.RemoveAll(wpdir("wprestart", i))
+		}
+	}()
+
+	uid := ClusterUID(servers)
+	start := func(i int) *WhanauPaxos {
+		return StartWhanauPaxos(servers, i, uid, nil, mem, wpdir("wprestart", i))
+	}
+
+	wps := make([]*WhanauPaxos, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		wps[i] = start(i)
+	}
+	defer func() {
+		for i := 0; i < nreplicas; i++ {
+			wps[i].Kill()
+		}
+	}()
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: WhanauPaxos replica restart")
+
+	for i := 0; i < 6; i++ {
+		putValue(t, wps[i%nreplicas], KeyType("k"+strconv.Itoa(i)), "a"+strconv.Itoa(i), NRand())
+	}
+
+	// one replica misses some puts.
+	wps[2].Kill()
+	for i := 0; i < 6; i++ {
+		putValue(t, wps[i%2], KeyType("k"+strconv.Itoa(i)), "b"+strconv.Itoa(i), NRand())
+	}
+
+	wps[2] = start(2)
+	checkValue(t, wps[2], "k0", "a0")
+	putValue(t, wps[2], "k6", "b6", NRand())
+	for i := 0; i <= 6; i++ {
+		checkValue(t, wps[2], KeyType("k"+strconv.Itoa(i)), "b"+strconv.Itoa(i))
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: WhanauPaxos whole cluster restart")
+
+	reqID := NRand()
+	putValue(t, wps[0], "k7", "c7", reqID)
+
+	for i := 0; i < nreplicas; i++ {
+		wps[i].Kill()
+	}
+	for i := 0; i < nreplicas; i++ {
+		wps[i] = start(i)
+	}
+
+	for i := 0; i < nreplicas; i++ {
+		checkValue(t, wps[i], "k7", "c7")
+	}
+
+	// a retried request is not applied twice, even across restarts.
+	putValue(t, wps[1], "k7", "d7", reqID)
+	args := &PaxosGetArgs{"k7", NRand(), false}
+	reply := &PaxosGetReply{}
+	wps[1].PaxosGet(args, reply)
+	if reply.Err != OK || reply.Value.TrueValue != "c7" {
+		t.Fatalf("Get(k7) = %q %v, expected c7", reply.Value.TrueValue, reply.Err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: WhanauPaxos log with a torn length")
+
+	putValue(t, wps[0], "k8", "e8", NRand())
+	wps[0].Kill()
+	f, err := os.OpenFile(logPath(wpdir("wprestart", 0), uid),
+		os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 1, 2, 3})
+	f.Close()
+
+	wps[0] = start(0)
+	checkValue(t, wps[0], "k8", "e8")
+	putValue(t, wps[0], "k9", "e9", NRand())
+	wps[0].Kill()
+	wps[0] = start(0)
+	checkValue(t, wps[0], "k9", "e9")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A restarted server starts its cluster replicas again from its dir.
+func TestServerRestart(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 3
+	mem := transport.NewMem()
+	var ws []*WhanauServer = make([]*WhanauServer, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(ws)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = "srv-restart-" + strconv.Itoa(i)
+		os.RemoveAll(wpdir("srvrestart", i))
+	}
+	defer func() {
+		for i := 0; i < nservers; i++ {
+			os.RemoveAll(wpdir("srvrestart", i))
+		}
+	}()
+
+	start := func(i int) *WhanauServer {
+		return StartServer(kvh, i, kvh[i], nil, make([]string, 0), nil,
+			false, false, false, 1, 1, 1, 1, 1, 1, mem, wpdir("srvrestart", i))
+	}
+	for i := 0; i < nservers; i++ {
+		ws[i] = start(i)
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Server restart restores its clusters")
+
+	uid := ClusterUID(kvh)
+	for i := 0; i < nservers; i++ {
+		wp := StartWhanauPaxos(kvh, i, uid, ws[i].rpc, mem, ws[i].dir)
+		ws[i].paxosInstances["key"] = wp
+	}
+	putValue(t, ws[0].paxosInstances["key"], "key", "value", NRand())
+
+	ws[1].Kill()
+	ws[1] = start(1)
+
+	wp, ok := ws[1].paxosInstances["key"]
+	if !ok {
+		t.Fatalf("restarted server lost its cluster")
+	}
+	checkValue(t, wp, "key", "value")
+	putValue(t, wp, "key", "value2", NRand())
+
+	// the others learn the new value through the log.
+	args := &PaxosGetArgs{"key", NRand(), false}
+	reply := &PaxosGetReply{}
+	ws[0].paxosInstances["key"].PaxosGet(args, reply)
+	if reply.Err != OK || reply.Value.TrueValue != "value2" {
+		t.Fatalf("Get(key) = %q %v, expected value2", reply.Value.TrueValue, reply.Err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A replica that missed more than LogTail instances catches up by
+// installing another replica's snapshot.
+func TestWhanauPaxosSnapshotTransfer(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nreplicas = 3
+	mem := transport.NewMem()
+	servers := make([]string, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		servers[i] = "wp-transfer-" + strconv.Itoa(i)
+		os.RemoveAll(wpdir("wptransfer", i))
+	}
+	defer func() {
+		for i := 0; i < nreplicas; i++ {
+			os.RemoveAll(wpdir("wptransfer", i))
+		}
+	}()
+
+	uid := ClusterUID(servers)
+	start := func(i int) *WhanauPaxos {
+		return StartWhanauPaxos(servers, i, uid, nil, mem, wpdir("wptransfer", i))
+	}
+
+	wps := make([]*WhanauPaxos, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		wps[i] = start(i)
+	}
+	defer func() {
+		for i := 0; i < nreplicas; i++ {
+			wps[i].Kill()
+		}
+	}()
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Lagging WhanauPaxos replica installs a snapshot")
+
+	putValue(t, wps[0], "k", "before", NRand())
+	wps[2].Kill()
+
+	const nputs = LogTail + 20
+	for i := 0; i < nputs; i++ {
+		putValue(t, wps[i%2], KeyType("k"+strconv.Itoa(i%10)), "v"+strconv.Itoa(i), NRand())
+	}
+	if wps[0].px.Compacted() < 0 {
+		t.Fatalf("replicas did not compact their log")
+	}
+
+	wps[2] = start(2)
+	putValue(t, wps[2], "k", "after", NRand())
+
+	checkValue(t, wps[2], "k", "after")
+	for i := nputs - 10; i < nputs; i++ {
+		checkValue(t, wps[2], KeyType("k"+strconv.Itoa(i%10)), "v"+strconv.Itoa(i))
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// wait until the replicas in live agree on a leader, and return it.
+func waitWPLeader(t *testing.T, wps []*WhanauPaxos, live []int) int {
+	for iters := 0; iters < 100; iters++ {
+		time.Sleep(50 * time.Millisecond)
+		l, ok := wps[live[0]].px.Leader()
+		for _, i := range live[1:] {
+			if li, oki := wps[i].px.Leader(); !oki || li != l {
+				ok = false
+			}
+		}
+		for _, i := range live {
+			if ok && wps[i].myaddr == l {
+				return i
+			}
+		}
+	}
+	t.Fatalf("no leader elected")
+	return -1
+}
+
+// Requests sent to any replica are served by the cluster's leader,
+// and keep being served after the leader dies.
+func TestWhanauPaxosLeader(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nreplicas = 3
+	mem := transport.NewMem()
+	servers := make([]string, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		servers[i] = "wp-leader-" + strconv.Itoa(i)
+	}
+
+	uid := ClusterUID(servers)
+	wps := make([]*WhanauPaxos, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		wps[i] = StartWhanauPaxos(servers, i, uid, nil, mem, "")
+	}
+	defer func() {
+		for i := 0; i < nreplicas; i++ {
+			wps[i].Kill()
+		}
+	}()
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: WhanauPaxos requests go to the leader")
+
+	leader := waitWPLeader(t, wps, []int{0, 1, 2})
+	follower := (leader + 1) % nreplicas
+
+	args := &PaxosPutArgs{"a", TrueValueType{"1", "test", nil, nil}, NRand(), false}
+	reply := &PaxosPutReply{}
+	wps[follower].PaxosPut(args, reply)
+	if reply.Err != OK {
+		t.Fatalf("Put through follower failed: %v", reply.Err)
+	}
+	checkValue(t, wps[leader], "a", "1")
+	wps[follower].logLock.Lock()
+	_, handled := wps[follower].handledRequests[args.RequestID]
+	wps[follower].logLock.Unlock()
+	if handled {
+		t.Fatalf("follower served the Put itself")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: WhanauPaxos survives losing its leader")
+
+	wps[leader].Kill()
+	args = &PaxosPutArgs{"a", TrueValueType{"2", "test", nil, nil}, NRand(), false}
+	reply = &PaxosPutReply{}
+	wps[follower].PaxosPut(args, reply)
+	if reply.Err != OK {
+		t.Fatalf("Put after leader failure: %v", reply.Err)
+	}
+
+	gargs := &PaxosGetArgs{"a", NRand(), false}
+	greply := &PaxosGetReply{}
+	wps[(leader+2)%nreplicas].PaxosGet(gargs, greply)
+	if greply.Err != OK || greply.Value.TrueValue != "2" {
+		t.Fatalf("Get(a) = %q %v, expected 2", greply.Value.TrueValue, greply.Err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A transport that can cut some addresses off from the rest, as a
+// network partition would. Every replica dials through its own.
+type splitNet struct {
+	mu       sync.Mutex
+	isolated map[string]bool
+}
+
+type splitTransport struct {
+	*transport.Mem
+	me    string
+	split *splitNet
+}
+
+func (st splitTransport) Dial(addr string) (net.Conn, error) {
+	st.split.mu.Lock()
+	apart := st.split.isolated[st.me] != st.split.isolated[addr]
+	st.split.mu.Unlock()
+	if apart {
+		return nil, fmt.Errorf("%v is partitioned from %v", st.me, addr)
+	}
+	return st.Mem.Dial(addr)
+}
+
+func (sn *splitNet) isolate(addr string, cut bool) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.isolated[addr] = cut
+}
+
+// The leader answers reads from its own db while it holds a lease,
+// and a leader cut off from the others never answers with a value
+// they have since overwritten.
+func TestWhanauPaxosLeaseRead(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nreplicas = 3
+	mem := transport.NewMem()
+	split := &splitNet{isolated: make(map[string]bool)}
+	servers := make([]string, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		servers[i] = "wp-lease-" + strconv.Itoa(i)
+	}
+
+	uid := ClusterUID(servers)
+	wps := make([]*WhanauPaxos, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		tr := splitTransport{mem, servers[i], split}
+		wps[i] = StartWhanauPaxos(servers, i, uid, nil, tr, "")
+	}
+	defer func() {
+		for i := 0; i < nreplicas; i++ {
+			wps[i].Kill()
+		}
+	}()
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: WhanauPaxos leader serves reads under its lease")
+
+	leader := waitWPLeader(t, wps, []int{0, 1, 2})
+	putValue(t, wps[leader], "a", "1", NRand())
+
+	for iters := 0; !wps[leader].px.HasLease(); iters++ {
+		if iters > 100 {
+			t.Fatalf("leader never got a lease")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	wps[leader].mu.Lock()
+	before := wps[leader].currSeq
+	wps[leader].mu.Unlock()
+
+	gargs := &PaxosGetArgs{"a", NRand(), false}
+	greply := &PaxosGetReply{}
+	wps[leader].PaxosGet(gargs, greply)
+	if greply.Err != OK || greply.Value.TrueValue != "1" {
+		t.Fatalf("Get(a) = %q %v, expected 1", greply.Value.TrueValue, greply.Err)
+	}
+
+	wps[leader].mu.Lock()
+	after := wps[leader].currSeq
+	wps[leader].mu.Unlock()
+	if after != before {
+		t.Fatalf("lease read went through the log")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Partitioned leader does not serve stale reads")
+
+	split.isolate(servers[leader], true)
+	rest := []int{}
+	for i := 0; i < nreplicas; i++ {
+		if i != leader {
+			rest = append(rest, i)
+		}
+	}
+	newleader := waitWPLeader(t, wps, rest)
+	putValue(t, wps[newleader], "a", "2", NRand())
+
+	done := make(chan PaxosGetReply)
+	go func() {
+		gargs := &PaxosGetArgs{"a", NRand(), false}
+		greply := PaxosGetReply{}
+		wps[leader].PaxosGet(gargs, &greply)
+		done <- greply
+	}()
+
+	select {
+	case r := <-done:
+		t.Fatalf("isolated leader answered Get(a) = %q", r.Value.TrueValue)
+	case <-time.After(time.Second):
+	}
+
+	split.isolate(servers[leader], false)
+	select {
+	case r := <-done:
+		if r.Err != OK || r.Value.TrueValue != "2" {
+			t.Fatalf("Get(a) = %q %v after healing, expected 2", r.Value.TrueValue, r.Err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Get(a) never finished after the partition healed")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A member of a WhanauPaxos cluster is swapped for a new replica,
+// which gets the cluster's data, after which the old one can go.
+func TestWhanauPaxosReconfigure(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nreplicas = 3
+	mem := transport.NewMem()
+	servers := make([]string, nreplicas+1)
+	for i := 0; i < nreplicas+1; i++ {
+		servers[i] = "wp-reconfig-" + strconv.Itoa(i)
+	}
+
+	uid := ClusterUID(servers[0:nreplicas])
+	wps := make([]*WhanauPaxos, nreplicas+1)
+	for i := 0; i < nreplicas; i++ {
+		wps[i] = StartWhanauPaxos(servers[0:nreplicas], i, uid, nil, mem, "")
+	}
+	defer func() {
+		for i := 0; i < nreplicas+1; i++ {
+			if wps[i] != nil {
+				wps[i].Kill()
+			}
+		}
+	}()
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: New WhanauPaxos member takes over a replica's data")
+
+	for i := 0; i < 5; i++ {
+		putValue(t, wps[i%nreplicas], KeyType("k"+strconv.Itoa(i)),
+			strconv.Itoa(i), NRand())
+	}
+
+	// replica 3 takes replica 0's place.
+	newservers := []string{servers[3], servers[1], servers[2]}
+	args := &PaxosReconfigArgs{newservers, NRand(), false}
+	reply := &PaxosReconfigReply{}
+	wps[1].PaxosReconfig(args, reply)
+	if reply.Err != OK {
+		t.Fatalf("PaxosReconfig failed: %v", reply.Err)
+	}
+	wps[3] = JoinWhanauPaxos(newservers, 0, uid, reply.From, nil, mem, "")
+	for i := 0; i < 5; i++ {
+		checkValue(t, wps[3], KeyType("k"+strconv.Itoa(i)), strconv.Itoa(i))
+	}
+
+	preply := &PaxosPutReply{}
+	wps[0].PaxosPut(&PaxosPutArgs{"k0", TrueValueType{"x", "test", nil, nil},
+		NRand(), false}, preply)
+	if preply.Err != ErrWrongGroup {
+		t.Fatalf("removed replica answered Put with %v", preply.Err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: New WhanauPaxos members carry on without the old one")
+
+	wps[0].Kill()
+	wps[0] = nil
+	putValue(t, wps[3], "k5", "5", NRand())
+
+	// the new member is needed for a majority now.
+	wps[1].Kill()
+	wps[1] = nil
+	putValue(t, wps[2], "k6", "6", NRand())
+	for i := 0; i < 7; i++ {
+		checkValue(t, wps[2], KeyType("k"+strconv.Itoa(i)), strconv.Itoa(i))
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A replica restarted with the members it was started with comes back
+// with the members it had, and its data, from its snapshot and log.
+func TestWhanauPaxosRestartMembers(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nreplicas = 3
+	mem := transport.NewMem()
+	servers := make([]string, nreplicas+1)
+	for i := 0; i < nreplicas+1; i++ {
+		servers[i] = "wp-remembers-" + strconv.Itoa(i)
+		os.RemoveAll(wpdir("wpremembers", i))
+	}
+	defer func() {
+		for i := 0; i < nreplicas+1; i++ {
+			os.RemoveAll(wpdir("wpremembers", i))
+		}
+	}()
+
+	uid := ClusterUID(servers[0:nreplicas])
+	wps := make([]*WhanauPaxos, nreplicas+1)
+	for i := 0; i < nreplicas; i++ {
+		wps[i] = StartWhanauPaxos(servers[0:nreplicas], i, uid, nil, mem,
+			wpdir("wpremembers", i))
+	}
+	defer func() {
+		for i := 0; i < nreplicas+1; i++ {
+			if wps[i] != nil {
+				wps[i].Kill()
+			}
+		}
+	}()
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Restarted WhanauPaxos replica keeps its new members")
+
+	for i := 0; i < 3; i++ {
+		putValue(t, wps[i], KeyType("k"+strconv.Itoa(i)), strconv.Itoa(i), NRand())
+	}
+
+	newservers := []string{servers[3], servers[1], servers[2]}
+	args := &PaxosReconfigArgs{newservers, NRand(), false}
+	reply := &PaxosReconfigReply{}
+	wps[1].PaxosReconfig(args, reply)
+	if reply.Err != OK {
+		t.Fatalf("PaxosReconfig failed: %v", reply.Err)
+	}
+	wps[3] = JoinWhanauPaxos(newservers, 0, uid, reply.From, nil, mem,
+		wpdir("wpremembers", 3))
+	putValue(t, wps[3], "k3", "3", NRand())
+
+	// fewer than LogTail changes: the restart reads them from the log.
+	wps[2].Kill()
+	wps[2] = StartWhanauPaxos(servers[0:nreplicas], 2, uid, nil, mem,
+		wpdir("wpremembers", 2))
+	if got := wps[2].Servers(); fmt.Sprint(got) != fmt.Sprint(newservers) {
+		t.Fatalf("restarted replica has members %v, expected %v", got, newservers)
+	}
+	for i := 0; i < 4; i++ {
+		checkValue(t, wps[2], KeyType("k"+strconv.Itoa(i)), strconv.Itoa(i))
+	}
+
+	// the removed member stays removed.
+	wps[0].Kill()
+	wps[0] = StartWhanauPaxos(servers[0:nreplicas], 0, uid, nil, mem,
+		wpdir("wpremembers", 0))
+	preply := &PaxosPutReply{}
+	wps[0].PaxosPut(&PaxosPutArgs{"k0", TrueValueType{"x", "test", nil, nil},
+		NRand(), false}, preply)
+	if preply.Err != ErrWrongGroup {
+		t.Fatalf("restarted removed replica answered Put with %v", preply.Err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A cluster's leader replaces a dead member, and then a suspected
+// one, with neighbors, without losing the cluster's data.
+func TestRepairClusters(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	const nservers = 5
+	const nreplicas = 3
+	mem := transport.NewMem()
+	var ws []*WhanauServer = make([]*WhanauServer, nservers)
+	var kvh []string = make([]string, nservers)
+	defer cleanup(ws)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = "srv-repair-" + strconv.Itoa(i)
+	}
+	for i := 0; i < nservers; i++ {
+		ws[i] = StartServer(kvh, i, kvh[i], kvh, make([]string, 0), nil,
+			false, false, false, 1, 1, 1, 1, 1, 1, mem, "")
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Leader replaces a dead cluster member")
+
+	uid := ClusterUID(kvh[0:nreplicas])
+	wps := make([]*WhanauPaxos, nservers)
+	for i := 0; i < nreplicas; i++ {
+		wps[i] = StartWhanauPaxos(kvh[0:nreplicas], i, uid, ws[i].rpc, mem, "")
+		ws[i].paxosInstances["key"] = wps[i]
+	}
+	putValue(t, wps[0], "key", "value", NRand())
+
+	// the dead member is not the leader.
+	leader := waitWPLeader(t, wps, []int{0, 1, 2})
+	dead := (leader + 1) % nreplicas
+	ws[dead].Kill()
+	ws[dead] = nil
+
+	ws[leader].RepairClusters(nil)
+	members := wps[leader].Servers()
+	if IndexOf(kvh[dead], members) >= 0 {
+		t.Fatalf("dead server %v is still a member: %v", kvh[dead], members)
+	}
+	joined := -1
+	for i := nreplicas; i < nservers; i++ {
+		if IndexOf(kvh[i], members) >= 0 {
+			joined = i
+		}
+	}
+	if joined < 0 {
+		t.Fatalf("no neighbor joined the cluster: %v", members)
+	}
+	wps[joined] = ws[joined].paxosInstances["key"]
+	if wps[joined] == nil {
+		t.Fatalf("server %v did not start its replica", kvh[joined])
+	}
+	checkValue(t, wps[joined], "key", "value")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Leader replaces a suspected cluster member")
+
+	suspect := -1
+	for i := 0; i < nreplicas; i++ {
+		if i != leader && i != dead {
+			suspect = i
+		}
+	}
+	ws[leader].RepairClusters(map[string]bool{kvh[suspect]: true})
+	members = wps[leader].Servers()
+	if IndexOf(kvh[suspect], members) >= 0 {
+		t.Fatalf("suspect %v is still a member: %v", kvh[suspect], members)
+	}
+	other := nreplicas + (joined+1-nreplicas)%(nservers-nreplicas)
+	if IndexOf(kvh[other], members) < 0 {
+		t.Fatalf("%v did not join the cluster: %v", kvh[other], members)
+	}
+
+	// only the original leader is left of the first members.
+	putValue(t, wps[leader], "key", "value2", NRand())
+	wps[other] = ws[other].paxosInstances["key"]
+	args := &PaxosGetArgs{"key", NRand(), false}
+	reply := &PaxosGetReply{}
+	wps[other].PaxosGet(args, reply)
+	if reply.Err != OK || reply.Value.TrueValue != "value2" {
+		t.Fatalf("Get(key) = %q %v, expected value2", reply.Value.TrueValue, reply.Err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A Byzantine cluster is sized for MaxFaulty liars, keeps going
+// without its first primary, and brings a replica that missed
+// compacted instances back from a checkpoint its peers agree on.
+func TestWhanauBFT(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	SetReplication(Byzantine)
+	defer SetReplication(CrashFault)
+	if PaxosSize != 3*MaxFaulty+1 {
+		t.Fatalf("PaxosSize is %v with Byzantine replication", PaxosSize)
+	}
+
+	const nreplicas = 4
+	mem := transport.NewMem()
+	servers := make([]string, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		servers[i] = "wp-bft-" + strconv.Itoa(i)
+	}
+
+	uid := ClusterUID(servers)
+	wps := make([]*WhanauPaxos, nreplicas)
+	for i := 0; i < nreplicas; i++ {
+		wps[i] = StartWhanauBFT(servers, i, uid, nil, mem, "")
+	}
+	defer func() {
+		for i := 0; i < nreplicas; i++ {
+			wps[i].Kill()
+		}
+	}()
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Byzantine WhanauPaxos cluster agrees on Puts")
+
+	for i := 0; i < nreplicas; i++ {
+		putValue(t, wps[i], KeyType("k"+strconv.Itoa(i)), strconv.Itoa(i), NRand())
+	}
+	putValue(t, wps[1], "k", "v", NRand())
+	for i := 0; i < nreplicas; i++ {
+		checkValue(t, wps[1], KeyType("k"+strconv.Itoa(i)), strconv.Itoa(i))
+	}
+
+	args := &PaxosReconfigArgs{servers[1:], NRand(), false}
+	reply := &PaxosReconfigReply{}
+	wps[0].PaxosReconfig(args, reply)
+	if reply.Err != ErrNoReconfig {
+		t.Fatalf("PaxosReconfig on a Byzantine cluster: %v", reply.Err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Byzantine member gets bad ops decided")
+
+	// replica 3 lies: it asks every member to order a change of
+	// members, which PaxosReconfig never proposes, and ops whose
+	// arguments are not of their type.
+	bad := []Op{
+		Op{RECONFIG, PaxosReconfigArgs{servers[1:], NRand(), false}, NRand(), NRand()},
+		Op{PUT, PaxosGetArgs{"k0", NRand(), false}, NRand(), NRand()},
+		Op{EPOCH, nil, NRand(), NRand()},
+	}
+	seq := wps[3].px.Max() + 1
+	for i, op := range bad {
+		for _, srv := range servers {
+			call(mem, srv, "PBFT-"+uid+".Request",
+				&pbft.RequestArgs{Seq: seq + i, Value: op}, &pbft.RequestReply{})
+		}
+	}
+	for i := range bad {
+		for iters := 0; ; iters++ {
+			if decided, _ := wps[1].px.Status(seq + i); decided {
+				break
+			}
+			if iters == 100 {
+				t.Fatalf("bad op %v was not decided", i)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// every member applies them, and carries on as before.
+	for i := 0; i < nreplicas; i++ {
+		putValue(t, wps[i], KeyType("b"+strconv.Itoa(i)), strconv.Itoa(i), NRand())
+	}
+	for i := 0; i < nreplicas; i++ {
+		if got := wps[i].Servers(); len(got) != nreplicas {
+			t.Fatalf("replica %v has members %v after a bad RECONFIG", i, got)
+		}
+		checkValue(t, wps[i], "k0", "0")
+		checkValue(t, wps[i], KeyType("b"+strconv.Itoa(i)), strconv.Itoa(i))
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Byzantine WhanauPaxos replica catches up from a checkpoint")
+
+	// replica 0 is the first primary, so this takes a view change too.
+	wps[0].Kill()
+	const nputs = LogTail + 20
+	for i := 0; i < nputs; i++ {
+		putValue(t, wps[1+i%3], KeyType("k"+strconv.Itoa(i%10)),
+			"v"+strconv.Itoa(i), NRand())
+	}
+	if wps[1].px.Compacted() < 0 {
+		t.Fatalf("replicas did not compact their log")
+	}
+
+	wps[0] = StartWhanauBFT(servers, 0, uid, nil, mem, "")
+	putValue(t, wps[0], "k", "after", NRand())
+	checkValue(t, wps[0], "k", "after")
+	for i := nputs - 10; i < nputs; i++ {
+		checkValue(t, wps[0], KeyType("k"+strconv.Itoa(i%10)), "v"+strconv.Itoa(i))
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// wait until every server in ws has finished setup for epoch.
+func waitEpoch(t *testing.T, ws []*WhanauServer, epoch int) {
+	for iters := 0; iters < 600; iters++ {
+		done := 0
+		for _, s := range ws {
+			s.mu.Lock()
+			if s.epoch >= epoch && s.state == Normal {
+				done++
+			}
+			s.mu.Unlock()
+		}
+		if done == len(ws) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("servers did not finish setup for epoch %v", epoch)
+}
+
+// check that the cluster srv put key in has value.
+func checkPending(t *testing.T, srv *WhanauServer, key KeyType, value string) {
+	srv.mu.Lock()
+	record, ok := srv.kvstore[key]
+	srv.mu.Unlock()
+	if !ok {
+		t.Fatalf("%v has no cluster for key %v", srv.myaddr, key)
+	}
+	ck := MakeClerk(srv.myaddr, srv.tr)
+	if v := ck.Get(key, record.Servers); v != value {
+		t.Fatalf("Get(%v) = %v, expected %v", key, v, value)
+	}
+}
+
+// have srv add a pending write of value to key.
+func addPending(t *testing.T, srv *WhanauServer, key KeyType, value string) {
+	val := TrueValueType{value, srv.myaddr, nil, &srv.secretKey.PublicKey}
+	val.Sign, _ = SignTrueValue(val, srv.secretKey)
+	var reply PendingReply
+	srv.AddPendingRPC(&PendingArgs{key, val, srv.myaddr}, &reply)
+	if reply.Err != ErrPending {
+		t.Fatalf("AddPendingRPC(%v): %v", key, reply.Err)
+	}
+}
+
+// Start nservers servers over mem, all neighbors of each other, the
+// first nmasters of them masters, with a few keys each, and run the
+// first setup.
+func startEpochNetwork(tag string, nservers int,
+	nmasters int) ([]*WhanauServer, []string, *transport.Mem) {
+	const k = 5 // keys per server
+
+	constant := 5
+	nlayers := int(math.Log(float64(k*nservers))) + 1
+	nfingers := int(math.Sqrt(float64(k * nservers)))
+	w := constant * int(math.Log(float64(nservers)))
+	rd := 2 * int(math.Sqrt(float64(k*nservers)))
+	rs := constant * int(math.Sqrt(float64(k*nservers)))
+	ts := 5
+
+	mem := transport.NewMem()
+	var ws []*WhanauServer = make([]*WhanauServer, nservers)
+	var kvh []string = make([]string, nservers)
+
+	for i := 0; i < nservers; i++ {
+		kvh[i] = "mem-" + tag + "-" + strconv.Itoa(i)
+	}
+	masters := kvh[:nmasters]
+
+	for i := 0; i < nservers; i++ {
+		neighbors := make([]string, 0)
+		for j := 0; j < nservers; j++ {
+			if j != i {
+				neighbors = append(neighbors, kvh[j])
+			}
+		}
+		if i < nmasters {
+			ws[i] = StartServer(kvh, i, kvh[i], neighbors, masters, masters,
+				true, false, false, nlayers, nfingers, w, rd, rs, ts, mem, "")
+		} else {
+			ws[i] = StartServer(kvh, i, kvh[i], neighbors, masters, nil,
+				false, false, false, nlayers, nfingers, w, rd, rs, ts, mem, "")
+		}
+	}
+
+	counter := 0
+	for i := 0; i < nservers; i++ {
+		for j := 0; j < k; j++ {
+			key := KeyType(strconv.Itoa(counter))
+			counter++
+			ws[i].kvstore[key] = ValueType{[]string{kvh[rand.Intn(nservers)]}}
+		}
+	}
+
+	c := make(chan bool)
+	for i := 0; i < nservers; i++ {
+		go func(srv int) {
+			ws[srv].Setup()
+			c <- true
+		}(i)
+	}
+	for i := 0; i < nservers; i++ {
+		<-c
+	}
+	return ws, kvh, mem
+}
+
+// The masters agree on a schedule of setup rounds, and every round
+// folds in the pending writes made since the last one.
+func TestEpochs(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	defer func(length time.Duration) { EpochLength = length }(EpochLength)
+	EpochLength = 10 * time.Second
+
+	const nservers = 10
+	const nmasters = 3
+	ws, kvh, mem := startEpochNetwork("epochs", nservers, nmasters)
+	defer cleanup(ws)
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Masters schedule setup rounds")
+
+	ck := MakeClerk(kvh[5], mem)
+	ck.ClientPut("new-a", "a")
+
+	start := time.Now()
+	for i := 0; i < nmasters; i++ {
+		go ws[i].InitiateSetup()
+	}
+	waitEpoch(t, ws, 1)
+	fmt.Printf("First round done in %v\n", time.Since(start))
+
+	// whichever master told them, everybody ran the same round.
+	begin := ws[0].next.Start
+	for i := 1; i < nservers; i++ {
+		if ws[i].next.Epoch != 1 || !ws[i].next.Start.Equal(begin) {
+			t.Fatalf("%v ran round %v at %v, not 1 at %v", kvh[i],
+				ws[i].next.Epoch, ws[i].next.Start, begin)
+		}
+	}
+	checkPending(t, ws[5], "new-a", "a")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: The next round picks up new writes")
+
+	ck = MakeClerk(kvh[7], mem)
+	ck.ClientPut("new-b", "b")
+	waitEpoch(t, ws, 2)
+	if since := time.Since(begin); since < EpochLength {
+		t.Fatalf("second round came %v after the first", since)
+	}
+	checkPending(t, ws[7], "new-b", "b")
+	checkPending(t, ws[5], "new-a", "a")
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// Puts are turned away with ErrInSetup during setup, and setup waits
+// for the Puts and other client requests already under way.
+func TestPutDuringSetup(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	mem := transport.NewMem()
+	addr := "mem-drain-0"
+	ws := []*WhanauServer{StartServer([]string{addr}, 0, addr, nil,
+		nil, nil, false, false, false, 1, 1, 1, 1, 1, 1, mem, "")}
+	defer cleanup(ws)
+
+	cluster := []string{addr}
+	wp := StartWhanauPaxos(cluster, 0, ClusterUID(cluster), ws[0].rpc, mem, "")
+	ws[0].paxosInstances["k"] = wp
+	ws[0].kvstore["k"] = ValueType{cluster}
+
+	put := func(value string) Err {
+		args := &ClientPutArgs{"k", TrueValueType{value, addr, nil, nil},
+			NRand(), addr}
+		var reply ClientPutReply
+		if !call(mem, addr, "WhanauServer.PaxosPutRPC", args, &reply) {
+			t.Fatalf("PaxosPutRPC failed")
+		}
+		return reply.Err
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Puts during setup are turned away")
+
+	if err := put("before"); err != OK {
+		t.Fatalf("Put before setup: %v", err)
+	}
+	for _, state := range []State{PreSetup, Setup, WhanauSetup} {
+		ws[0].enterState(state)
+		if err := put("during"); err != ErrInSetup {
+			t.Fatalf("Put in %v: %v", state, err)
+		}
+		ck := MakeClerk(addr, mem)
+		if err := ck.ClientPut("k", "during"); err != ErrInSetup {
+			t.Fatalf("ClientPut in %v: %v", state, err)
+		}
+	}
+	ws[0].enterState(Normal)
+	if err := put("after"); err != OK {
+		t.Fatalf("Put after setup: %v", err)
+	}
+	checkValue(t, wp, "k", "after")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Setup waits for Puts under way")
+
+	state, ok := ws[0].startPut()
+	if !ok {
+		t.Fatalf("startPut in %v", state)
+	}
+	entered := make(chan bool)
+	go func() {
+		ws[0].enterState(PreSetup)
+		entered <- true
+	}()
+	select {
+	case <-entered:
+		t.Fatalf("setup went ahead with a Put under way")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := put("late"); err != ErrInSetup {
+		t.Fatalf("Put while draining: %v", err)
+	}
+	ws[0].finishRequest(state)
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatalf("setup did not go ahead once the Put was done")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Setup waits for other requests under way")
+
+	// lookups are still served during setup...
+	ck := MakeClerk(addr, mem)
+	if v := ck.Lookup("k"); len(v.Servers) != 1 || v.Servers[0] != addr {
+		t.Fatalf("Lookup(k) in PreSetup = %v", v)
+	}
+
+	// ...but setup waits for them, like for Puts.
+	state = ws[0].startRequest()
+	go func() {
+		ws[0].enterState(Setup)
+		entered <- true
+	}()
+	select {
+	case <-entered:
+		t.Fatalf("setup went ahead with a request under way")
+	case <-time.After(200 * time.Millisecond):
+	}
+	ws[0].finishRequest(state)
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatalf("setup did not go ahead once the request was done")
+	}
+	ws[0].enterState(Normal)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A pending write is folded in by the setup round after the view it
+// was made in, so writes to one key in different views don't get in
+// each other's way, and the masters forget writes once they are in.
+func TestPendingViews(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	defer func(length time.Duration) { EpochLength = length }(EpochLength)
+	EpochLength = 10 * time.Second
+
+	const nservers = 10
+	const nmasters = 3
+	ws, _, _ := startEpochNetwork("views", nservers, nmasters)
+	defer cleanup(ws)
+
+	pend := func(srv int, key KeyType, value string) {
+		addPending(t, ws[srv], key, value)
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Pending writes to one key in successive views")
+
+	pend(5, "x", "x0")
+	for i := 0; i < nmasters; i++ {
+		go ws[i].InitiateSetup()
+	}
+	waitEpoch(t, ws, 1)
+	checkPending(t, ws[5], "x", "x0")
+
+	// the masters must not hand this one to ws[5] with the last.
+	pend(7, "x", "x1")
+	waitEpoch(t, ws, 2)
+	checkPending(t, ws[7], "x", "x1")
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Masters forget pending writes once they are in")
+
+	waitEpoch(t, ws, 3)
+	for i := 0; i < nmasters; i++ {
+		wp := ws[i].master_paxos_cluster
+		view, _ := wp.Epoch()
+		wp.pwLock.Lock()
+		for k := range wp.pending_writes {
+			if k.View < view {
+				t.Fatalf("master %v kept %v in view %v", i, k, view)
+			}
+		}
+		wp.pwLock.Unlock()
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// With no master cluster, pending writes go to coordinators the
+// routing tables pick, and their servers collect them in the next
+// setup round.
+func TestCoordinators(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	SetPendingRouting(ViaCoordinators)
+	defer SetPendingRouting(ViaMasters)
+
+	const nservers = 10
+	ws, kvh, _ := startEpochNetwork("coords", nservers, 0)
+	defer cleanup(ws)
+
+	// someone has to start the rounds.
+	startRound := func(epoch int) {
+		args := &StartSetupArgs{kvh[0], epoch, time.Now().Add(EpochLead)}
+		var reply StartSetupReply
+		ws[0].StartSetup(args, &reply)
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Picking coordinators for a key")
+
+	coords := ws[3].Coordinators("x")
+	if len(coords) != NCoordinators {
+		t.Fatalf("Coordinators(x) = %v", coords)
+	}
+	for i, srv := range ws[3].Coordinators("x") {
+		if srv != coords[i] {
+			t.Fatalf("Coordinators(x) changed from %v", coords)
+		}
+	}
+
+	// a node that got no fingers in setup still has coordinators.
+	ws[4].tables_mu.Lock()
+	rt := *ws[4].routing
+	rt.fingers = nil
+	ws[4].routing = &rt
+	ws[4].tables_mu.Unlock()
+	if coords := ws[4].Coordinators("x"); len(coords) != NCoordinators {
+		t.Fatalf("Coordinators(x) without fingers = %v", coords)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Pending writes through coordinators")
+
+	addPending(t, ws[5], "x", "x0")
+	addPending(t, ws[6], "y", "y0")
+	startRound(1)
+	waitEpoch(t, ws, 1)
+	checkPending(t, ws[5], "x", "x0")
+	checkPending(t, ws[6], "y", "y0")
+
+	addPending(t, ws[7], "x", "x1")
+
+	// a lying coordinator makes up a write for ws[6]; the others
+	// never heard of it.
+	forged := TrueValueType{"forged", ws[9].myaddr, nil, nil}
+	ws[9].mu.Lock()
+	ws[9].coordinated[PendingInsertsKey{"z", ws[9].epoch}] =
+		PendingWrite{forged, ws[6].myaddr}
+	ws[9].mu.Unlock()
+	ws[6].mu.Lock()
+	ws[6].coordinators[ws[9].myaddr] = true
+	ws[6].mu.Unlock()
+
+	startRound(2)
+	waitEpoch(t, ws, 2)
+	checkPending(t, ws[7], "x", "x1")
+	ws[6].mu.Lock()
+	_, ok := ws[6].kvstore["z"]
+	ws[6].mu.Unlock()
+	if ok {
+		t.Fatalf("server put in a write only one coordinator sent")
+	}
+
+	// all but the forged write, which stays with the liar, and ws[6]
+	// asks it again, until it is PendingViews old.
+	want := map[int]int{6: 1, 9: 1}
+	for i := 0; i < nservers; i++ {
+		ws[i].mu.Lock()
+		n := len(ws[i].coordinated) + len(ws[i].coordinators)
+		ws[i].mu.Unlock()
+		if n != want[i] {
+			t.Fatalf("server %v still holds %v pending writes", i, n)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Coordinators a view apart agree on pending writes")
+
+	byaddr := make(map[string]*WhanauServer)
+	for _, srv := range ws {
+		byaddr[srv.myaddr] = srv
+	}
+	writer := -1
+	coords = nil
+	for i := 0; i < nservers && writer < 0; i++ {
+		coords = ws[i].Coordinators("w")
+		writer = i
+		for _, srv := range coords {
+			if srv == ws[i].myaddr {
+				writer = -1
+			}
+		}
+	}
+
+	// two coordinators have gone on to the next view, and one is too
+	// far ahead to take the write at all; the other two alone are no
+	// majority.
+	ws[writer].mu.Lock()
+	view := ws[writer].epoch
+	ws[writer].mu.Unlock()
+	for i, shift := range []int{1, 1, 5} {
+		c := byaddr[coords[i]]
+		c.mu.Lock()
+		c.epoch += shift
+		c.mu.Unlock()
+	}
+	addPending(t, ws[writer], "w", "w0")
+	for i, srv := range coords {
+		c := byaddr[srv]
+		c.mu.Lock()
+		w, ok := c.coordinated[PendingInsertsKey{"w", view}]
+		c.mu.Unlock()
+		if ok != (i != 2) || ok && w.Server != ws[writer].myaddr {
+			t.Fatalf("coordinator %v holds %v for view %v", srv, w, view)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A pending write goes through while a majority of the masters is
+// up, and the Put gives up with ErrNoMaster once it is not.
+func TestPendingMasterOutage(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	defer func(timeout time.Duration) { PendingTimeout = timeout }(PendingTimeout)
+	PendingTimeout = 2 * time.Second
+
+	const nservers = 10
+	const nmasters = 3
+	ws, kvh, mem := startEpochNetwork("outage", nservers, nmasters)
+	defer cleanup(ws)
+
+	put := func(key KeyType, expected Err) {
+		ck := MakeClerk(kvh[5], mem)
+		start := time.Now()
+		if err := ck.ClientPut(key, "v"); err != expected {
+			t.Fatalf("ClientPut(%v) = %v, expected %v", key, err, expected)
+		}
+		if time.Since(start) > PendingTimeout+time.Second {
+			t.Fatalf("ClientPut(%v) took %v", key, time.Since(start))
+		}
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Pending writes with a master down")
+
+	ws[0].Kill()
+	put("new-a", ErrPending)
+	put("new-b", ErrPending)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Pending writes without a majority of masters")
+
+	// the last master takes the write, but can't get it agreed.
+	ws[1].Kill()
+	put("new-c", ErrNoMaster)
+
+	ws[2].Kill()
+	put("new-d", ErrNoMaster)
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Pending writes with no masters at all")
+
+	var reply PendingReply
+	ws[6].masters = nil
+	ws[6].AddPendingRPC(&PendingArgs{"new-e", TrueValueType{}, kvh[6]}, &reply)
+	if reply.Err != ErrNoMaster {
+		t.Fatalf("AddPendingRPC with no masters: %v", reply.Err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A client can follow a pending write from the masters' queue into
+// a cluster, even when another server's write to the key won.
+func TestPendingStatus(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	defer func(length time.Duration) { EpochLength = length }(EpochLength)
+	EpochLength = 10 * time.Second
+
+	const nservers = 10
+	const nmasters = 3
+	ws, kvh, mem := startEpochNetwork("status", nservers, nmasters)
+	defer cleanup(ws)
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Status of a queued write")
+
+	ck := MakeClerk(kvh[5], mem)
+	if status := ck.PendingStatus("new-s"); status.Err != ErrNoKey {
+		t.Fatalf("PendingStatus before the Put: %v", status)
+	}
+	if err := ck.ClientPut("new-s", "s"); err != ErrPending {
+		t.Fatalf("ClientPut(new-s) = %v", err)
+	}
+	status := ck.PendingStatus("new-s")
+	if status.Err != OK || status.State != Queued ||
+		status.Server != kvh[5] || status.View != 0 {
+		t.Fatalf("PendingStatus after the Put: %v", status)
+	}
+	if err := ck.WaitCommitted("new-s", 200*time.Millisecond); err != ErrPending {
+		t.Fatalf("WaitCommitted before setup = %v", err)
+	}
+
+	// ws[5]'s write got there first.
+	ck2 := MakeClerk(kvh[6], mem)
+	if err := ck2.ClientPut("new-s", "s2"); err != ErrLost {
+		t.Fatalf("ClientPut(new-s) = %v", err)
+	}
+	if status := ck2.PendingStatus("new-s"); status.State != Lost ||
+		status.Server != kvh[5] {
+		t.Fatalf("PendingStatus of the losing write: %v", status)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Two servers write one key at once")
+
+	writers := []*Clerk{MakeClerk(kvh[7], mem), MakeClerk(kvh[8], mem)}
+	errs := make([]Err, len(writers))
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = writers[i].ClientPut("new-c", "c"+strconv.Itoa(i))
+		}(i)
+	}
+	wg.Wait()
+	winner := -1
+	for i, err := range errs {
+		if err == ErrPending {
+			winner = i
+		} else if err != ErrLost {
+			t.Fatalf("ClientPut(new-c) from writer %v = %v", i, err)
+		}
+	}
+	if winner < 0 || errs[1-winner] != ErrLost {
+		t.Fatalf("ClientPut(new-c) = %v, expected one ErrPending and one ErrLost", errs)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Waiting for a write to be committed")
+
+	for i := 0; i < nmasters; i++ {
+		go ws[i].InitiateSetup()
+	}
+	if err := ck.WaitCommitted("new-s", 30*time.Second); err != OK {
+		t.Fatalf("WaitCommitted = %v", err)
+	}
+	status = ck.PendingStatus("new-s")
+	if status.State != Committed || status.Server != kvh[5] ||
+		status.View != 1 {
+		t.Fatalf("PendingStatus after setup: %v", status)
+	}
+	if err := ck2.WaitCommitted("new-s", 5*time.Second); err != ErrLost {
+		t.Fatalf("WaitCommitted of the losing write = %v", err)
+	}
+	if err := writers[winner].WaitCommitted("new-c", 30*time.Second); err != OK {
+		t.Fatalf("WaitCommitted of the winning write = %v", err)
+	}
+	if err := writers[1-winner].WaitCommitted("new-c", time.Second); err != ErrLost {
+		t.Fatalf("WaitCommitted of the losing write = %v", err)
+	}
+	checkPending(t, ws[7+winner], "new-c", "c"+strconv.Itoa(winner))
+	if err := ck.WaitCommitted("never-put", time.Second); err != ErrNoKey {
+		t.Fatalf("WaitCommitted(never-put) = %v", err)
+	}
+
+	// mixing dies with its neighbors.
+	waitEpoch(t, ws, 1)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// The pending writes master hands ws[srv] in setup round epoch.
+func collectPending(t *testing.T, master *WhanauServer, srv *WhanauServer,
+	epoch int) map[KeyType]TrueValueType {
+	args := &ReceiveNewPaxosClusterArgs{srv.myaddr, []string{srv.myaddr}, epoch}
+	var reply ReceiveNewPaxosClusterReply
+	master.ReceiveNewPaxosCluster(args, &reply)
+	if reply.Err != OK {
+		t.Fatalf("ReceiveNewPaxosCluster: %v", reply.Err)
+	}
+	return reply.KV
+}
+
+// Masters hold on to pending writes until their server says they are
+// in its cluster, and any master can record that.
+func TestPendingHandoff(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	defer func(length time.Duration) { EpochLength = length }(EpochLength)
+	EpochLength = 10 * time.Second
+
+	const nservers = 10
+	const nmasters = 3
+	ws, _, _ := startEpochNetwork("handoff", nservers, nmasters)
+	defer cleanup(ws)
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: A server crashes with pending writes")
+
+	addPending(t, ws[5], "x", "x0")
+
+	// ws[5] collects x, and goes down before it is in.
+	if kv := collectPending(t, ws[0], ws[5], 1); kv["x"].TrueValue != "x0" {
+		t.Fatalf("ReceiveNewPaxosCluster = %v", kv)
+	}
+	if kv := collectPending(t, ws[0], ws[5], 1); kv["x"].TrueValue != "x0" {
+		t.Fatalf("masters let go of x before it was in")
+	}
+
+	// so it collects it again in the round.
+	for i := 0; i < nmasters; i++ {
+		go ws[i].InitiateSetup()
+	}
+	waitEpoch(t, ws, 1)
+	checkPending(t, ws[5], "x", "x0")
+	if kv := collectPending(t, ws[1], ws[5], 2); len(kv) != 0 {
+		t.Fatalf("masters still hand out %v once it is in", kv)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: A master crashes in the handoff")
+
+	addPending(t, ws[6], "y", "y0")
+	if kv := collectPending(t, ws[0], ws[6], 2); kv["y"].TrueValue != "y0" {
+		t.Fatalf("ReceiveNewPaxosCluster = %v", kv)
+	}
+	ws[0].Kill()
+
+	if !ws[6].ackPending(ws[0].myaddr, 2, []KeyType{"y"}) {
+		t.Fatalf("no master recorded the handoff")
+	}
+	for i := 1; i < nmasters; i++ {
+		if kv := collectPending(t, ws[i], ws[6], 2); len(kv) != 0 {
+			t.Fatalf("master %v still hands out %v", i, kv)
+		}
+	}
+
+	// mixing dies with its neighbors.
+	waitEpoch(t, ws[1:], 1)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// Pending writes live in the masters' log, so a write any master took
+// reaches its server when that master is gone.
+func TestReplicatedPending(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	defer func(length time.Duration) { EpochLength = length }(EpochLength)
+	EpochLength = 10 * time.Second
+	defer func(timeout time.Duration) { PendingTimeout = timeout }(PendingTimeout)
+	PendingTimeout = 2 * time.Second
+
+	const nservers = 10
+	const nmasters = 3
+	ws, kvh, _ := startEpochNetwork("replicated", nservers, nmasters)
+	defer cleanup(ws)
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Every master has every pending write")
+
+	for i := 0; i < nmasters; i++ {
+		key := KeyType("new-" + strconv.Itoa(i))
+		val := TrueValueType{"v" + strconv.Itoa(i), kvh[5], nil,
+			&ws[5].secretKey.PublicKey}
+		val.Sign, _ = SignTrueValue(val, ws[5].secretKey)
+		var reply PendingReply
+		ws[i].AddPendingRPCMaster(&PendingArgs{key, val, kvh[5]}, &reply)
+		if reply.Err != OK {
+			t.Fatalf("AddPendingRPCMaster(%v): %v", key, reply.Err)
+		}
+	}
+	for i := 0; i < nmasters; i++ {
+		kv := collectPending(t, ws[i], ws[5], 1)
+		if len(kv) != nmasters {
+			t.Fatalf("master %v hands out %v", i, kv)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Pending writes survive the master that took them")
+
+	// ws[0] took new-0. It stays up as a node, since neighbors
+	// wait for each other while mixing.
+	ws[0].master_paxos_cluster.Kill()
+	for i := 1; i < nmasters; i++ {
+		go ws[i].InitiateSetup()
+	}
+	waitEpoch(t, ws, 1)
+	for i := 0; i < nmasters; i++ {
+		checkPending(t, ws[5], KeyType("new-"+strconv.Itoa(i)), "v"+strconv.Itoa(i))
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// Answers every Lookup with the same servers.
+type fixedLookup struct {
+	Honest
+	servers []string
+}
+
+func (b fixedLookup) Lookup(ws *WhanauServer, key KeyType, steps int) LookupReply {
+	return LookupReply{OK, ValueType{b.servers}}
+}
+
+// A Sybil that also turns every Get away.
+type noGetSybil struct {
+	Sybil
+}
+
+func (noGetSybil) PaxosGet(ws *WhanauServer, args *ClientGetArgs,
+	reply *ClientGetReply) {
+	reply.Err = ErrWrongGroup
+}
+
+// Servers hand their RPCs to the behavior they were started with, and
+// behaviors combine by embedding.
+func TestBehavior(t *testing.T) {
+	mem := transport.NewMem()
+	kvh := []string{"mem-behavior-0", "mem-behavior-1", "mem-behavior-2"}
+	behaviors := []Behavior{Honest{}, fixedLookup{Honest{}, []string{"x"}},
+		noGetSybil{}}
+	ws := make([]*WhanauServer, len(kvh))
+	defer cleanup(ws)
+	for i := range kvh {
+		neighbors := make([]string, 0)
+		for j := range kvh {
+			if j != i {
+				neighbors = append(neighbors, kvh[j])
+			}
+		}
+		ws[i] = StartServerBehavior(kvh, i, kvh[i], neighbors, nil, nil,
+			false, behaviors[i], false, 1, 1, 1, 1, 1, 1, mem, "")
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Servers behave the way they were started")
+
+	if ws[0].is_sybil || !ws[1].is_sybil || !ws[2].is_sybil {
+		t.Fatalf("only honest servers should count as honest")
+	}
+
+	ck := MakeClerk(kvh[1], mem)
+	if servers, err := ck.FindServers("k"); err != OK ||
+		len(servers) != 1 || servers[0] != "x" {
+		t.Fatalf("FindServers = %v, %v", servers, err)
+	}
+
+	args := &ClientGetArgs{"k", NRand()}
+	var reply ClientGetReply
+	call(mem, kvh[2], "WhanauServer.PaxosGetRPC", args, &reply)
+	if reply.Err != ErrWrongGroup {
+		t.Fatalf("PaxosGetRPC = %v", reply.Err)
+	}
+	// the rest is the Sybil's.
+	var rwreply RandomWalkReply
+	call(mem, kvh[2], "WhanauServer.RandomWalk", &RandomWalkArgs{1}, &rwreply)
+	if rwreply.Err != OK || IndexOf(rwreply.Server, kvh[:2]) < 0 {
+		t.Fatalf("RandomWalk = %v", rwreply)
+	}
+	reply = ClientGetReply{}
+	call(mem, kvh[0], "WhanauServer.PaxosGetRPC", args, &reply)
+	if reply.Err != ErrNoKey {
+		t.Fatalf("honest PaxosGetRPC = %v", reply.Err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// Start nhonest honest servers holding 5 keys each and a server for
+// each of sybils, all neighbors of each other, and run setup.
+func startSybilNetwork(tag string, nhonest int,
+	sybils []Behavior) ([]*WhanauServer, []string) {
+	nservers := nhonest + len(sybils)
+	const k = 5
+
+	constant := 5
+	nlayers := int(math.Log(float64(k*nhonest))) + 1
+	nfingers := int(math.Sqrt(float64(k * nhonest)))
+	w := constant * int(math.Log(float64(nservers)))
+	rd := 2 * int(math.Sqrt(float64(k*nhonest)))
+	rs := constant * int(math.Sqrt(float64(k*nhonest)))
+	ts := 5
+
+	mem := transport.NewMem()
+	ws := make([]*WhanauServer, nservers)
+	kvh := make([]string, nservers)
+	for i := 0; i < nservers; i++ {
+		kvh[i] = "mem-" + tag + "-" + strconv.Itoa(i)
+	}
+
+	for i := 0; i < nservers; i++ {
+		neighbors := make([]string, 0)
+		for j := 0; j < nservers; j++ {
+			if j != i {
+				neighbors = append(neighbors, kvh[j])
+			}
+		}
+		var behavior Behavior = Honest{}
+		if i >= nhonest {
+			behavior = sybils[i-nhonest]
+		}
+		ws[i] = StartServerBehavior(kvh, i, kvh[i], neighbors,
+			make([]string, 0), nil, false, behavior, false,
+			nlayers, nfingers, w, rd, rs, ts, mem, "")
+	}
+
+	counter := 0
+	for i := 0; i < nhonest; i++ {
+		for j := 0; j < k; j++ {
+			key := KeyType(strconv.Itoa(counter))
+			counter++
+			ws[i].kvstore[key] = ValueType{[]string{"ws" + strconv.Itoa(i)}}
+		}
+	}
+
+	c := make(chan bool)
+	for i := 0; i < nservers; i++ {
+		go func(srv int) {
+			ws[srv].Setup()
+			c <- true
+		}(i)
+	}
+	for i := 0; i < nservers; i++ {
+		<-c
+	}
+	return ws, kvh
+}
+
+// A clustering Sybil's id is always strictly below its victim.
+func TestClusterID(t *testing.T) {
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Clustering ids lie below the victim")
+
+	victims := []KeyType{"17", "1", "\x01", "ab\x00", "a\x00\x00", "\x00",
+		"\x00\x00", "\xff"}
+	for _, victim := range victims {
+		id, ok := clusterID(victim, "mem-sybil-1")
+		if !ok || id >= victim {
+			t.Fatalf("clusterID(%q) = %q, %v", victim, id, ok)
+		}
+	}
+	if id, ok := clusterID("ab\x00", "s"); id != "aa\xffs" || !ok {
+		t.Fatalf("clusterID(ab\\x00) = %q, %v", id, ok)
+	}
+	if id, ok := clusterID("", "s"); ok {
+		t.Fatalf("clusterID of the empty key = %q", id)
+	}
+
+	// successors the Sybils hand out lie between the key asked for
+	// and the victim; a key with no room before the victim gets what
+	// any Sybil gives, which here is nothing.
+	ws := &WhanauServer{myaddr: "mem-sybil-1", t: 3}
+	ws.routing = &routingTables{}
+	attack := Clustering{Victim: "17"}
+	for _, key := range []KeyType{"", "1", "16", "16\xff"} {
+		reply := attack.SampleSuccessors(ws, key)
+		if reply.Err != OK || len(reply.Successors) != ws.t {
+			t.Fatalf("SampleSuccessors(%q) = %v", key, reply)
+		}
+		for _, r := range reply.Successors {
+			if r.Key <= key || r.Key >= attack.Victim {
+				t.Fatalf("SampleSuccessors(%q) has %q", key, r.Key)
+			}
+		}
+	}
+	for _, key := range []KeyType{"17", "16\xff\xff", "2"} {
+		if reply := attack.SampleSuccessors(ws, key); reply.Err == OK {
+			t.Fatalf("SampleSuccessors(%q) = %v", key, reply)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// Sybils that cluster their ids just below a key take over the honest
+// fingers that precede it.
+func TestClusteringAttack(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	const nhonest = 10
+	victim := KeyType("17")
+	attack := Clustering{Victim: victim, Layer: AllLayers}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Clustering attack on one key")
+
+	ws, kvh := startSybilNetwork("cluster", nhonest,
+		[]Behavior{attack, attack, attack})
+	defer cleanup(ws)
+
+	sybils := make(map[string]bool)
+	for _, srv := range kvh[nhonest:] {
+		sybils[srv] = true
+	}
+	nlayers := ws[0].nlayers
+
+	// every Sybil id sits between victim and the key below it.
+	for i := nhonest; i < len(ws); i++ {
+		for layer := 0; layer < nlayers; layer++ {
+			var reply GetIdReply
+			ws[i].GetId(&GetIdArgs{layer}, &reply)
+			id := reply.Key
+			if id == victim {
+				continue
+			}
+			if !(KeyType("16") < id && id < victim) {
+				t.Fatalf("Sybil id %q is not next to %q", id, victim)
+			}
+		}
+	}
+
+	// of the honest fingers that most closely precede victim, how
+	// many are Sybils?
+	nclosest, ncaptured := 0, 0
+	for i := 0; i < nhonest; i++ {
+		for _, layer := range ws[i].tables().fingers {
+			if len(layer) == 0 {
+				continue
+			}
+			j := sort.Search(len(layer), func(j int) bool {
+				return layer[j].Id > victim
+			})
+			nclosest++
+			if sybils[layer[(j-1+len(layer))%len(layer)].Address] {
+				ncaptured++
+			}
+		}
+	}
+
+	numFound := 0
+	for i := 0; i < nhonest; i++ {
+		lreply := &LookupReply{}
+		ws[i].Lookup(&LookupArgs{victim, nil}, lreply)
+		if lreply.Err == OK {
+			numFound++
+		}
+	}
+
+	fmt.Printf("Fingers captured: %d/%d, lookups of victim successful: %d/%d\n",
+		ncaptured, nclosest, numFound, nhonest)
+	if ncaptured == 0 {
+		t.Fatalf("no honest finger went to a Sybil")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// Sybils that answer every key with their own cluster fool a lookup
+// far less often when it takes the majority of several paths.
+func TestForgingAttack(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	const nhonest = 15
+	forged := []string{"sybil-cluster-0", "sybil-cluster-1", "sybil-cluster-2"}
+	attack := Forging{Servers: forged}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Value-forging attack")
+
+	ws, _ := startSybilNetwork("forge", nhonest, []Behavior{attack})
+	defer cleanup(ws)
+
+	// the fraction of the other servers' keys whose lookups are forged.
+	forgedFrac := func() float64 {
+		nforged, nlookups := 0, 0
+		for i := 0; i < nhonest; i++ {
+			for key := 0; key < 5*nhonest; key++ {
+				if key/5 == i {
+					continue
+				}
+				lreply := &LookupReply{}
+				ws[i].Lookup(&LookupArgs{KeyType(strconv.Itoa(key)), nil}, lreply)
+				nlookups++
+				if lreply.Err == OK && IndexOf(forged[0], lreply.Value.Servers) >= 0 {
+					nforged++
+				}
+			}
+		}
+		return float64(nforged) / float64(nlookups)
+	}
+
+	paths, answers := LookupPaths, MinLookupAnswers
+	defer func() { LookupPaths, MinLookupAnswers = paths, answers }()
+	// a lookup that takes one path's word.
+	LookupPaths, MinLookupAnswers = 1, 1
+	single := forgedFrac()
+	LookupPaths, MinLookupAnswers = 5, answers
+	majority := forgedFrac()
+
+	fmt.Printf("Forged lookups: %f with one path, %f with %d\n", single,
+		majority, LookupPaths)
+	if single == 0 {
+		t.Fatalf("the Sybils forged no lookups")
+	}
+	if majority >= single {
+		t.Fatalf("majority of paths did not help: %f >= %f", majority, single)
+	}
+
+	// a key's own server knows its value.
+	lreply := &LookupReply{}
+	ws[3].Lookup(&LookupArgs{"15", nil}, lreply)
+	if lreply.Err != OK || lreply.Value.Servers[0] != "ws3" {
+		t.Fatalf("Lookup of own key = %v", lreply)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// A node whose Try finds every key in servers.
+type finding struct {
+	Honest
+	servers []string
+}
+
+func (f finding) Try(ws *WhanauServer, key KeyType) TryReply {
+	return TryReply{ValueType{f.servers}, OK}
+}
+
+// A lookup takes a value only if more than half of its paths found
+// it, so forged paths that tie the honest ones get no value.
+func TestLookupTie(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	mem := transport.NewMem()
+	honest := []string{"honest-cluster"}
+	forged := []string{"sybil-cluster"}
+	behaviors := []Behavior{finding{servers: honest}, Forging{Servers: forged},
+		finding{servers: honest}, Forging{Servers: forged}}
+	kvh := make([]string, len(behaviors))
+	for i := range kvh {
+		kvh[i] = "mem-tie-" + strconv.Itoa(i)
+	}
+	ws := make([]*WhanauServer, len(behaviors))
+	for i, b := range behaviors {
+		ws[i] = StartServerBehavior(kvh, i, kvh[i], nil, nil, nil, false, b,
+			false, 1, 1, 1, 2, 1, 1, mem, "")
+	}
+	defer cleanup(ws)
+
+	// ws[0] tries the key itself, then at the end of servers and
+	// back, round again once it gets to the start.
+	lookupFrom := func(paths int, servers []string) LookupReply {
+		ws[0].rw_mu.Lock()
+		ws[0].rw_servers = servers
+		ws[0].nreserved = len(servers)
+		ws[0].lookup_idx = 0
+		ws[0].rw_mu.Unlock()
+
+		defer func(paths int) { LookupPaths = paths }(LookupPaths)
+		LookupPaths = paths
+		var reply LookupReply
+		ws[0].Lookup(&LookupArgs{"k", nil}, &reply)
+		return reply
+	}
+	// at ws[1], ws[2] and ws[3].
+	lookup := func(paths int) LookupReply {
+		return lookupFrom(paths, []string{kvh[3], kvh[2], kvh[1]})
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Forged lookup paths that tie the honest ones")
+
+	if reply := lookup(3); reply.Err != OK ||
+		fmt.Sprint(reply.Value.Servers) != fmt.Sprint(honest) {
+		t.Fatalf("Lookup with 2 of 3 honest paths = %v", reply)
+	}
+	if reply := lookup(4); reply.Err != ErrNoKey {
+		t.Fatalf("Lookup with 2 of 4 honest paths = %v", reply)
+	}
+	if reply := lookup(2); reply.Err != ErrNoKey {
+		t.Fatalf("Lookup with 1 of 2 honest paths = %v", reply)
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Lookup paths that fail don't count against the value")
+
+	// more paths than a lookup tries: ws[0] itself, then three
+	// rounds of a server that is gone, ws[2] and ws[1], for 4 honest
+	// answers, 3 forged ones and 3 that failed.
+	gone := "mem-tie-gone"
+	if reply := lookupFrom(2*TIMEOUT, []string{kvh[1], kvh[2], gone}); reply.Err != OK ||
+		fmt.Sprint(reply.Value.Servers) != fmt.Sprint(honest) {
+		t.Fatalf("Lookup with 4 honest, 3 forged and 3 failed paths = %v", reply)
+	}
+	// one answer is no majority, even if it is the only one.
+	if reply := lookupFrom(2*TIMEOUT, []string{gone}); reply.Err != ErrNoKey {
+		t.Fatalf("Lookup with 1 honest and 9 failed paths = %v", reply)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// Sybils that forward only Sybil addresses while mixing poison more
+// of the honest random-walk pools than Sybils that mix honestly.
+func TestEclipseAttack(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	const nhonest = 10
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Eclipse attack on systolic mixing")
+
+	ws, _ := startSybilNetwork("mix", nhonest,
+		[]Behavior{Sybil{}, Sybil{}})
+	mixed := PoisonedFraction(ws)
+	cleanup(ws)
+
+	sybils := []string{"mem-eclipse-10", "mem-eclipse-11"}
+	attack := Eclipse{Sybils: sybils}
+	ws, _ = startSybilNetwork("eclipse", nhonest,
+		[]Behavior{attack, attack})
+	defer cleanup(ws)
+	eclipsed := PoisonedFraction(ws)
+
+	fmt.Printf("Poisoned pool entries: %f mixing, %f eclipsing\n", mixed,
+		eclipsed)
+	if eclipsed <= mixed {
+		t.Fatalf("eclipsing poisoned no more than mixing: %f <= %f",
+			eclipsed, mixed)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// Servers take their neighbors from a social graph, with a Sybil
+// region behind a few attack edges.
+func TestSocialGraph(t *testing.T) {
+	runtime.GOMAXPROCS(8)
+
+	const nservers = 20
+	const k = 5
+
+	// a ring, each node also joined to the nodes 2 and 3 on.
+	edges := ""
+	for i := 0; i < nservers; i++ {
+		for d := 1; d <= 3; d++ {
+			edges += fmt.Sprintf("%d %d\n", i, (i+d)%nservers)
+		}
+	}
+	g, err := graph.ReadEdgeList(strings.NewReader(edges))
+	if err != nil {
+		t.Fatalf("ReadEdgeList: %v", err)
+	}
+	g, sybil, err := g.SybilRegion(4, 2, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("SybilRegion: %v", err)
+	}
+
+	constant := 5
+	nlayers := int(math.Log(float64(k*nservers))) + 1
+	nfingers := int(math.Sqrt(k * nservers))
+	w := constant * int(math.Log(float64(nservers)))
+	rd := 2 * int(math.Sqrt(k*nservers))
+	rs := constant * int(math.Sqrt(k*nservers))
+	ts := 5
+
+	mem := transport.NewMem()
+	ws := make([]*WhanauServer, nservers)
+	kvh := make([]string, nservers)
+	defer cleanup(ws)
+	for i := 0; i < nservers; i++ {
+		kvh[i] = "mem-graph-" + g.ID(i)
+	}
+	neighbors := g.ServerNeighbors(kvh)
+	for i := 0; i < nservers; i++ {
+		ws[i] = StartServer(kvh, i, kvh[i], neighbors[i], make([]string, 0),
+			nil, false, sybil[i], false, nlayers, nfingers, w, rd, rs, ts,
+			mem, "")
+	}
+
+	fmt.Printf("\033[95m%s\033[0m\n", "Test: Lookup on a social graph")
+
+	records := make(map[KeyType]ValueType)
+	counter := 0
+	for i := 0; i < nservers; i++ {
+		if sybil[i] {
+			continue
+		}
+		for j := 0; j < k; j++ {
+			key := KeyType(strconv.Itoa(counter))
+			counter++
+			records[key] = ValueType{[]string{"ws" + strconv.Itoa(i)}}
+			ws[i].kvstore[key] = records[key]
+		}
+	}
+
+	c := make(chan bool)
+	for i := 0; i < nservers; i++ {
+		go func(srv int) {
+			ws[srv].Setup()
+			c <- true
+		}(i)
+	}
+	for i := 0; i < nservers; i++ {
+		<-c
+	}
+
+	numFound, numTotal := 0, 0
+	for i := 0; i < nservers; i++ {
+		if sybil[i] {
+			continue
+		}
+		for key, want := range records {
+			lreply := &LookupReply{}
+			ws[i].Lookup(&LookupArgs{key, nil}, lreply)
+			numTotal++
+			if lreply.Err == OK && lreply.Value.Servers[0] == want.Servers[0] {
+				numFound++
+			}
+		}
+	}
+
+	frac := float64(numFound) / float64(numTotal)
+	fmt.Printf("Attack edges: %d, percent lookups successful: %f\n",
+		g.AttackEdges(sybil), frac)
+	if frac < 0.5 {
+		t.Fatalf("too few lookups succeeded: %f", frac)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
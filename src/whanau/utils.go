@@ -4,6 +4,9 @@ import "math/rand"
 import (
 	"crypto/sha1"
 	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
 )
 
 import "fmt"
@@ -20,6 +23,17 @@ func IsInList(val int, array []int) bool {
 	return false
 }
 
+// Returns the index of val in array, or -1.
+func IndexOf(val string, array []string) int {
+	for i, v := range array {
+		if v == val {
+			return i
+		}
+	}
+
+	return -1
+}
+
 // Returns the index of the first record with key >= k.
 // Circular, so if k is larger than any element, will return 0.
 func PositionOf(k KeyType, array []Record) int {
@@ -32,9 +46,34 @@ func PositionOf(k KeyType, array []Record) int {
 	return 0
 }
 
+// Where setup and lookups get their random choices from. Seeded by
+// the clock, unless SeedRandom says otherwise.
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+var random_mu sync.Mutex
+
+// Make setup and lookups choose the same every run, given seed, as
+// long as only one server runs at a time; for the simulator.
+func SeedRandom(seed int64) {
+	random_mu.Lock()
+	defer random_mu.Unlock()
+	random = rand.New(rand.NewSource(seed))
+}
+
+func randIntn(n int) int {
+	random_mu.Lock()
+	defer random_mu.Unlock()
+	return random.Intn(n)
+}
+
+func randPerm(n int) []int {
+	random_mu.Lock()
+	defer random_mu.Unlock()
+	return random.Perm(n)
+}
+
 func Shuffle(src []string) []string {
 	dest := make([]string, len(src))
-	perm := rand.Perm(len(src))
+	perm := randPerm(len(src))
 	for i, v := range perm {
 		dest[v] = src[i]
 	}
@@ -49,7 +88,11 @@ func (ws *WhanauServer) GetLookupServer() (string, bool) {
 	//fmt.Printf("asking ws %v: idx wants %d, len is %d\n",
 	//	ws.me, ws.rw_idx, len(ws.rw_servers))
 
-	if len(ws.rw_servers) <= ws.nreserved {
+	if len(ws.rw_servers) == 0 {
+		// setup has not given us any yet
+		return "", false
+	}
+	if ws.lookup_idx >= ws.nreserved || ws.lookup_idx >= len(ws.rw_servers) {
 		// wrap around: we have reserved a certain number for lookups
 		ws.lookup_idx = 0
 	}
@@ -70,7 +113,7 @@ func (ws *WhanauServer) GetNextRWServer() (string, bool) {
 	//	ws.me, ws.rw_idx, len(ws.rw_servers))
 
 	fmt.Printf("")
-	if len(ws.rw_servers) <= ws.nreserved {
+	if ws.lookup_idx >= ws.nreserved || ws.lookup_idx >= len(ws.rw_servers) {
 		// 		log.Fatalf("not enough servers in ws %v: idx wants %d, len is %d\n",
 		// 			ws.me, ws.rw_idx, len(ws.rw_servers))
 		return "", false
@@ -81,16 +124,27 @@ func (ws *WhanauServer) GetNextRWServer() (string, bool) {
 	return retval, true
 }
 
-func (ws *WhanauServer) FindWPInstanceIfCreated(uid string) (WhanauPaxos, bool) {
-	var wp WhanauPaxos
-
-	for _, wp = range ws.paxosInstances {
+func (ws *WhanauServer) FindWPInstanceIfCreated(uid string) (*WhanauPaxos, bool) {
+	for _, wp := range ws.paxosInstances {
 		if wp.uid == uid {
 			return wp, true
 		}
 	}
 
-	return wp, false
+	return nil, false
+}
+
+// Name shared by every member of a Paxos cluster. It only depends on
+// the member addresses, so any server can compute it for any cluster,
+// whatever machine the members are on.
+func ClusterUID(servers []string) string {
+	return getShaHash(strings.Join(servers, " "))
+}
+
+// The master cluster gets a name of its own, so that it never shares
+// rpc service names with a key's cluster that has the same members.
+func MasterClusterUID(servers []string) string {
+	return getShaHash("master " + strings.Join(servers, " "))
 }
 
 func getShaHash(str string) string {
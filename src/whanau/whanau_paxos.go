@@ -5,35 +5,70 @@ package whanau
 
 import "net"
 import "paxos"
+import "pbft"
 import "time"
 import "sync"
 import "math"
 import "net/rpc"
 import "encoding/gob"
+import "transport"
+import "log"
+import "os"
+import "fmt"
 
 type WhanauPaxos struct {
 	mu     sync.Mutex
-	me     int
+	me     int  // index into servers, or -1 once we are no longer a member
 	dead   bool // for testing
 	myaddr string
 	l      net.Listener
 	rpc    *rpc.Server
+	tr     transport.Transport
 
-	px              *paxos.Paxos
+	px              agreement
+	bft             bool // px is pbft; members may lie
 	handledRequests map[int64]interface{}
 
 	currSeq  int // how far in the log are we?
 	logLock  sync.Mutex
 	dbLock   sync.Mutex
-	currView int
+	currView int // the master cluster's view is the latest setup round agreed on
+
+	epoch_start time.Time // when the setup round currView starts
 
 	db map[KeyType]TrueValueType
 
 	// only applicable if this server is a master
 	pwLock         sync.Mutex
-	pending_writes map[PendingInsertsKey]string // this is a mapping from a pending write keys to servers
+	pending_writes map[PendingInsertsKey]PendingWrite // the pending writes, and the servers they go to
+
+	uid          string   // concatenation of server names...
+	servers      []string // the members of this cluster
+	servers_from int      // the instance servers took over at
+	dir          string   // where the snapshot lives; "" keeps state in memory only
 
-	uid string // concatenation of server names...
+	oplog    *os.File     // changes since the snapshot; see snapshot.go
+	logSize  int64        // bytes in oplog
+	logged   int          // entries in oplog
+	logIndex int          // the index the next entry gets
+	unlogged []wpLogEntry // applied, but not yet in oplog
+
+	checkpoints map[int]wpSnapshot // bft only; see snapshot.go
+}
+
+// What a replica needs from the protocol that orders its log:
+// *paxos.Paxos, or *pbft.PBFT when members may lie.
+type agreement interface {
+	Start(seq int, v interface{})
+	Status(seq int) (bool, interface{})
+	Max() int
+	Done(seq int)
+	Compact(seq int)
+	Compacted() int
+	Leader() (string, bool)
+	HasLease() bool
+	Reconfigure(from int, peers []string)
+	Kill()
 }
 
 type Op struct {
@@ -43,10 +78,19 @@ type Op struct {
 	RequestID int64
 }
 
+// Get op decided, and return the instance it was decided at, or -1
+// if we turn out not to be a member any more.
 func (wp *WhanauPaxos) RunPaxos(op Op) int {
 	currSeq := wp.px.Max()
 
 	for !wp.dead {
+		// an earlier instance may have changed the members, and we
+		// must propose to the right ones.
+		wp.LogUpdates(wp.currSeq, currSeq-1)
+		if wp.removed() {
+			return -1
+		}
+
 		wp.px.Start(currSeq, op)
 		var decidedOp Op // Paxos might actually decide on some other operation
 
@@ -56,7 +100,9 @@ func (wp *WhanauPaxos) RunPaxos(op Op) int {
 		for {
 			decided, value := wp.px.Status(currSeq)
 			if decided {
-				decidedOp = value.(Op)
+				// a nil value means the instance was compacted
+				// away, so it certainly is not ours.
+				decidedOp, _ = value.(Op)
 				break
 			}
 			time.Sleep(timeout)
@@ -102,78 +148,333 @@ func (wp *WhanauPaxos) LogGet(args *PaxosGetArgs, reply *PaxosGetReply) {
 	}
 }
 
+// The write belongs to the view it is decided in, and the next setup
+// round folds it in. The first write to a key in a view gets it.
+// Called with mu held.
 func (wp *WhanauPaxos) LogPending(args *PaxosPendingInsertsArgs, reply *PaxosPendingInsertsReply) {
 	wp.pwLock.Lock()
 	defer wp.pwLock.Unlock()
 
-	v, ok := wp.pending_writes[PendingInsertsKey{args.Key, args.View}]
+	key := PendingInsertsKey{args.Key, wp.currView}
+	v, ok := wp.pending_writes[key]
 	if ok {
-		reply.Server = v
+		reply.Server = v.Server
 		reply.Err = OK
 	} else {
-		wp.pending_writes[PendingInsertsKey{args.Key, args.View}] = args.Server
+		wp.pending_writes[key] = PendingWrite{args.Value, args.Server}
 		reply.Server = args.Server
 		reply.Err = OK
 	}
+	reply.View = wp.currView
+}
+
+// The pending writes that go to args.Server, from the views before
+// args.Epoch; the latest view's, if a key was written in several.
+// Called with mu held.
+func (wp *WhanauPaxos) LogCollect(args *PaxosCollectArgs, reply *PaxosCollectReply) {
+	wp.pwLock.Lock()
+	defer wp.pwLock.Unlock()
+
+	reply.KV = make(map[KeyType]TrueValueType)
+	views := make(map[KeyType]int)
+	for k, w := range wp.pending_writes {
+		if w.Server != args.Server || k.View >= args.Epoch {
+			continue
+		}
+		if view, ok := views[k.Key]; !ok || k.View > view {
+			reply.KV[k.Key] = w.Value
+			views[k.Key] = k.View
+		}
+	}
+	reply.Err = OK
+}
+
+// Record that setup round args.Epoch starts at args.Start, unless a
+// start was already agreed for it. Called with mu held.
+func (wp *WhanauPaxos) LogEpoch(args *PaxosEpochArgs, reply *PaxosEpochReply) {
+	if args.Epoch == wp.currView+1 {
+		wp.currView = args.Epoch
+		wp.epoch_start = args.Start
+
+		// the masters give up on writes whose server never came
+		// for them.
+		wp.pwLock.Lock()
+		for k := range wp.pending_writes {
+			if k.View < wp.currView-PendingViews {
+				delete(wp.pending_writes, k)
+			}
+		}
+		wp.pwLock.Unlock()
+	}
+	reply.Epoch = wp.currView
+	reply.Start = wp.epoch_start
+	reply.Err = OK
+}
+
+// Forget the pending writes args.Server has put in its cluster: the
+// masters need not hand them out again. Called with mu held.
+func (wp *WhanauPaxos) LogHandoff(args *PaxosHandoffArgs, reply *PaxosHandoffReply) {
+	wp.pwLock.Lock()
+	defer wp.pwLock.Unlock()
+
+	done := make(map[KeyType]bool)
+	for _, key := range args.Keys {
+		done[key] = true
+	}
+	for k, w := range wp.pending_writes {
+		if w.Server == args.Server && k.View < args.Epoch && done[k.Key] {
+			delete(wp.pending_writes, k)
+		}
+	}
+	reply.Err = OK
+}
+
+// The latest setup round this replica knows the masters agreed on,
+// and when it starts.
+func (wp *WhanauPaxos) Epoch() (int, time.Time) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.currView, wp.epoch_start
 }
 
 // Fast forward the log from fromSeq up to toSeq, applying all the  updates.
 func (wp *WhanauPaxos) LogUpdates(fromSeq int, toSeq int) {
 	for i := fromSeq; i <= toSeq; i++ {
+		if i < wp.currSeq {
+			// covered by a snapshot we installed.
+			continue
+		}
+		if wp.removed() {
+			// nobody tells us about the new members' instances.
+			return
+		}
+
 		decided, value := wp.px.Status(i)
 
-		for !decided {
+		for waited := 0; !decided; waited++ {
 			// wait for instance to reach agreement
 			// TODO should time out after a while in case too many
 			// nodes have failed
+			if waited == 10 {
+				// we may have been down when it was decided; a no-op
+				// proposal will learn whatever the others agreed on.
+				wp.px.Start(i, Op{NOOP, nil, NRand(), 0})
+			}
 			time.Sleep(time.Millisecond * 50)
 			decided, value = wp.px.Status(i)
 		}
 
-		op := value.(Op)
-
-		_, handled := wp.handledRequests[op.RequestID]
-		if handled {
-			// don't re-serve the request, though this shouldn't
-			// be an issue
-			continue
+		if op, ok := value.(Op); ok {
+			wp.applyOp(op, i)
+			wp.advance(i+1, op)
+		} else if value != nil {
+			// a pbft view change filled the instance with nothing.
+			wp.advance(i+1, Op{})
+		} else {
+			// the other replicas compacted the instance; only
+			// a snapshot can tell us what it did.
+			wp.catchUp(i)
 		}
+	}
+}
 
-		if op.Type == PUT {
-			args := op.OpArgs.(PaxosPutArgs)
+// note that everything before seq has been applied, the last of it
+// op.
+func (wp *WhanauPaxos) advance(seq int, op Op) {
+	wp.mu.Lock()
+	wp.currSeq = seq
+	wp.record(wpLogEntry{Seq: seq - 1, Op: op})
+	wp.mu.Unlock()
+	if wp.bft && seq%LogTail == 0 {
+		wp.checkpoint()
+	}
+}
+
+// apply the operation decided at seq to the db, unless it was
+// already applied under the same request ID.
+func (wp *WhanauPaxos) applyOp(op Op, seq int) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	_, handled := wp.handledRequests[op.RequestID]
+	if handled {
+		// don't re-serve the request, though this shouldn't
+		// be an issue
+		return
+	}
+
+	// a Byzantine member can get any op decided; one whose
+	// arguments are not of its type does nothing.
+	switch op.Type {
+	case PUT:
+		if args, ok := op.OpArgs.(PaxosPutArgs); ok {
 			var reply PaxosPutReply
 			reply.Err = OK
 			wp.LogPut(&args, &reply)
 			wp.handledRequests[args.RequestID] = reply
-		} else if op.Type == GET {
-			args := op.OpArgs.(PaxosGetArgs)
+		}
+	case GET:
+		if args, ok := op.OpArgs.(PaxosGetArgs); ok {
 			var reply PaxosGetReply
 			reply.Err = OK
 			wp.LogGet(&args, &reply)
 			wp.handledRequests[args.RequestID] = reply
-		} else if op.Type == PENDING {
-			args := op.OpArgs.(PaxosPendingInsertsArgs)
+		}
+	case PENDING:
+		if args, ok := op.OpArgs.(PaxosPendingInsertsArgs); ok {
 			reply := PaxosPendingInsertsReply{}
 			reply.Err = OK
 			wp.LogPending(&args, &reply)
 			wp.handledRequests[args.RequestID] = reply
 		}
+	case EPOCH:
+		if args, ok := op.OpArgs.(PaxosEpochArgs); ok {
+			var reply PaxosEpochReply
+			wp.LogEpoch(&args, &reply)
+			wp.handledRequests[args.RequestID] = reply
+		}
+	case HANDOFF:
+		if args, ok := op.OpArgs.(PaxosHandoffArgs); ok {
+			var reply PaxosHandoffReply
+			wp.LogHandoff(&args, &reply)
+			wp.handledRequests[args.RequestID] = reply
+		}
+	case COLLECT:
+		if args, ok := op.OpArgs.(PaxosCollectArgs); ok {
+			var reply PaxosCollectReply
+			wp.LogCollect(&args, &reply)
+			wp.handledRequests[args.RequestID] = reply
+		}
+	case RECONFIG:
+		args, ok := op.OpArgs.(PaxosReconfigArgs)
+		if !ok {
+			break
+		}
+		if wp.bft {
+			// PaxosReconfig never proposes one here, so a
+			// Byzantine member did; the members are fixed.
+			wp.handledRequests[args.RequestID] = PaxosReconfigReply{0, ErrNoReconfig}
+			break
+		}
+		wp.setServers(args.Servers, seq+1)
+		wp.handledRequests[args.RequestID] = PaxosReconfigReply{seq + 1, OK}
+	}
+}
 
+// make servers the members from instance from on. called with mu
+// held.
+func (wp *WhanauPaxos) setServers(servers []string, from int) {
+	wp.servers = servers
+	wp.servers_from = from
+	wp.me = IndexOf(wp.myaddr, servers)
+	if wp.px != nil {
+		// nil while the log is replayed at start; Paxos has its own.
+		wp.px.Reconfigure(from, servers)
 	}
 }
 
+// true once a change of members has left us out.
+func (wp *WhanauPaxos) removed() bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.me < 0
+}
+
+// The current members of the cluster.
+func (wp *WhanauPaxos) Servers() []string {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return append([]string{}, wp.servers...)
+}
+
 func (wp *WhanauPaxos) AgreeAndLogRequests(op Op) error {
 	agreedSeq := wp.RunPaxos(op)
+	if agreedSeq < 0 {
+		return nil
+	}
 	wp.LogUpdates(wp.currSeq, agreedSeq)
-	// discard old instances
+
+	// the changes must be on disk before paxos may forget the
+	// instances they came from.
+	if err := wp.persist(); err != nil {
+		log.Printf("WhanauPaxos(%v) log: %v", wp.me, err)
+		return err
+	}
+
+	// discard old instances. Done only frees instances every
+	// replica has seen; keep a tail of the log for replicas that
+	// are a little behind, and let the rest catch up by snapshot.
 	wp.px.Done(agreedSeq)
-	wp.currSeq = agreedSeq + 1
+	if agreedSeq >= LogTail {
+		wp.px.Compact(agreedSeq - LogTail)
+	}
 
 	return nil
 }
 
+// Store a value for key without going through the log, for a key
+// that is handed to a newly created cluster.
+func (wp *WhanauPaxos) Preload(key KeyType, value TrueValueType) error {
+	wp.logLock.Lock()
+	defer wp.logLock.Unlock()
+
+	wp.dbLock.Lock()
+	wp.db[key] = value
+	wp.dbLock.Unlock()
+
+	wp.mu.Lock()
+	wp.record(wpLogEntry{Seq: -1, Key: key, Value: value})
+	wp.mu.Unlock()
+	return wp.persist()
+}
+
+// tell the replica to shut itself down.
+func (wp *WhanauPaxos) Kill() {
+	wp.dead = true
+	if wp.l != nil {
+		wp.l.Close()
+	}
+	wp.px.Kill()
+
+	wp.mu.Lock()
+	if wp.oplog != nil {
+		wp.oplog.Close()
+		wp.oplog = nil
+	}
+	wp.mu.Unlock()
+}
+
+// Pass a request on to the cluster's leader, unless we lead or do
+// not know who does. Returns false if we should handle it ourselves.
+func (wp *WhanauPaxos) forward(method string, args interface{},
+	reply interface{}) bool {
+	if wp.bft {
+		// a lying leader could drop the request; every member
+		// hands its own requests to pbft instead.
+		return false
+	}
+	leader, ok := wp.px.Leader()
+	if !ok || leader == wp.myaddr {
+		return false
+	}
+	return call(wp.tr, leader, "WhanauPaxos-"+wp.uid+"."+method, args, reply)
+}
+
 func (wp *WhanauPaxos) PaxosGet(args *PaxosGetArgs,
 	reply *PaxosGetReply) error {
+	if wp.removed() {
+		// we are no longer one of the cluster's members.
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	if !args.Forwarded {
+		fargs := *args
+		fargs.Forwarded = true
+		if wp.forward("PaxosGet", &fargs, reply) {
+			return nil
+		}
+	}
+
 	wp.logLock.Lock()
 	defer wp.logLock.Unlock()
 
@@ -181,20 +482,41 @@ func (wp *WhanauPaxos) PaxosGet(args *PaxosGetArgs,
 
 	// Have we handled this request already?
 	if r, ok := wp.handledRequests[args.RequestID]; ok {
-		getreply := r.(PaxosGetReply)
+		getreply, ok := r.(PaxosGetReply)
 
-		if getreply.Err != ErrWrongGroup {
+		if ok && getreply.Err != ErrWrongGroup {
 			reply.Err = getreply.Err
 			reply.Value = getreply.Value
 			return nil
 		}
 	}
 
+	// a leader that holds a lease and has applied everything it
+	// knows was decided already has the latest value; no need to
+	// put the read through the log.
+	if wp.px.HasLease() {
+		wp.mu.Lock()
+		applied := wp.currSeq > wp.px.Max()
+		wp.mu.Unlock()
+		if applied {
+			wp.LogGet(args, reply)
+			return nil
+		}
+	}
+
 	// Okay, try handling the request.
 	getop := Op{GET, *args, NRand(), args.RequestID}
-	wp.AgreeAndLogRequests(getop)
+	if err := wp.AgreeAndLogRequests(getop); err != nil {
+		reply.Err = ErrPersist
+		return nil
+	}
 
-	getreply := wp.handledRequests[args.RequestID].(PaxosGetReply)
+	getreply, ok := wp.handledRequests[args.RequestID].(PaxosGetReply)
+	if !ok {
+		// we were left out of the cluster before it got done.
+		reply.Err = ErrWrongGroup
+		return nil
+	}
 	reply.Err = getreply.Err
 	reply.Value = getreply.Value
 
@@ -203,6 +525,18 @@ func (wp *WhanauPaxos) PaxosGet(args *PaxosGetArgs,
 
 func (wp *WhanauPaxos) PaxosPut(args *PaxosPutArgs,
 	reply *PaxosPutReply) error {
+	if wp.removed() {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	if !args.Forwarded {
+		fargs := *args
+		fargs.Forwarded = true
+		if wp.forward("PaxosPut", &fargs, reply) {
+			return nil
+		}
+	}
+
 	wp.logLock.Lock()
 	defer wp.logLock.Unlock()
 
@@ -210,9 +544,9 @@ func (wp *WhanauPaxos) PaxosPut(args *PaxosPutArgs,
 
 	// Have we handled this request already?
 	if r, ok := wp.handledRequests[args.RequestID]; ok {
-		putreply := r.(PaxosPutReply)
+		putreply, ok := r.(PaxosPutReply)
 
-		if putreply.Err != ErrWrongGroup {
+		if ok && putreply.Err != ErrWrongGroup {
 			reply.Err = putreply.Err
 			return nil
 		}
@@ -220,24 +554,44 @@ func (wp *WhanauPaxos) PaxosPut(args *PaxosPutArgs,
 
 	// Okay, try handling the request.
 	putop := Op{PUT, *args, NRand(), args.RequestID}
-	wp.AgreeAndLogRequests(putop)
+	if err := wp.AgreeAndLogRequests(putop); err != nil {
+		reply.Err = ErrPersist
+		return nil
+	}
 
-	putreply := wp.handledRequests[args.RequestID].(PaxosPutReply)
+	putreply, ok := wp.handledRequests[args.RequestID].(PaxosPutReply)
+	if !ok {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
 	reply.Err = putreply.Err
 
 	return nil
 }
 
 func (wp *WhanauPaxos) PaxosPendingInsert(args *PaxosPendingInsertsArgs, reply *PaxosPendingInsertsReply) error {
+	if wp.removed() {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	if !args.Forwarded {
+		fargs := *args
+		fargs.Forwarded = true
+		if wp.forward("PaxosPendingInsert", &fargs, reply) {
+			return nil
+		}
+	}
+
 	wp.logLock.Lock()
 	defer wp.logLock.Unlock()
 
 	// Have we handled this request already?
 	if r, ok := wp.handledRequests[args.RequestID]; ok {
-		pending_reply := r.(PaxosPendingInsertsReply)
+		pending_reply, ok := r.(PaxosPendingInsertsReply)
 
-		if pending_reply.Err != ErrWrongGroup {
+		if ok && pending_reply.Err != ErrWrongGroup {
 			reply.Server = pending_reply.Server
+			reply.View = pending_reply.View
 			reply.Err = pending_reply.Err
 			return nil
 		}
@@ -245,11 +599,19 @@ func (wp *WhanauPaxos) PaxosPendingInsert(args *PaxosPendingInsertsArgs, reply *
 
 	// Okay, try handling the request.
 	op := Op{PENDING, *args, NRand(), args.RequestID}
-	wp.AgreeAndLogRequests(op)
+	if err := wp.AgreeAndLogRequests(op); err != nil {
+		reply.Err = ErrPersist
+		return nil
+	}
 
-	pending_reply := wp.handledRequests[args.RequestID].(PaxosPendingInsertsReply)
+	pending_reply, ok := wp.handledRequests[args.RequestID].(PaxosPendingInsertsReply)
+	if !ok {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
 
 	reply.Server = pending_reply.Server
+	reply.View = pending_reply.View
 	reply.Err = pending_reply.Err
 
 	//fmt.Printf("PENDING INSERT DECIDED ON %v\n", reply.Server)
@@ -257,33 +619,287 @@ func (wp *WhanauPaxos) PaxosPendingInsert(args *PaxosPendingInsertsArgs, reply *
 	return nil
 }
 
+// Propose that setup round args.Epoch starts at args.Start. The reply
+// has the latest round agreed on and its start, which are another
+// master's if that master got its proposal into the log first.
+func (wp *WhanauPaxos) PaxosEpoch(args *PaxosEpochArgs,
+	reply *PaxosEpochReply) error {
+	if wp.removed() {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	if !args.Forwarded {
+		fargs := *args
+		fargs.Forwarded = true
+		if wp.forward("PaxosEpoch", &fargs, reply) {
+			return nil
+		}
+	}
+
+	wp.logLock.Lock()
+	defer wp.logLock.Unlock()
+
+	if r, ok := wp.handledRequests[args.RequestID].(PaxosEpochReply); ok {
+		*reply = r
+		return nil
+	}
+
+	op := Op{EPOCH, *args, NRand(), args.RequestID}
+	if err := wp.AgreeAndLogRequests(op); err != nil {
+		reply.Err = ErrPersist
+		return nil
+	}
+
+	r, ok := wp.handledRequests[args.RequestID].(PaxosEpochReply)
+	if !ok {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	*reply = r
+	return nil
+}
+
+// Record in the log that a server has put pending writes in its
+// cluster, so that they are not handed out again.
+func (wp *WhanauPaxos) PaxosHandoff(args *PaxosHandoffArgs,
+	reply *PaxosHandoffReply) error {
+	if wp.removed() {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	if !args.Forwarded {
+		fargs := *args
+		fargs.Forwarded = true
+		if wp.forward("PaxosHandoff", &fargs, reply) {
+			return nil
+		}
+	}
+
+	wp.logLock.Lock()
+	defer wp.logLock.Unlock()
+
+	if r, ok := wp.handledRequests[args.RequestID].(PaxosHandoffReply); ok {
+		*reply = r
+		return nil
+	}
+
+	op := Op{HANDOFF, *args, NRand(), args.RequestID}
+	if err := wp.AgreeAndLogRequests(op); err != nil {
+		reply.Err = ErrPersist
+		return nil
+	}
+
+	r, ok := wp.handledRequests[args.RequestID].(PaxosHandoffReply)
+	if !ok {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	*reply = r
+	return nil
+}
+
+// Read the pending writes that go to a server through the log, so
+// that the reply has every write the masters agreed on so far.
+func (wp *WhanauPaxos) PaxosCollect(args *PaxosCollectArgs,
+	reply *PaxosCollectReply) error {
+	if wp.removed() {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	if !args.Forwarded {
+		fargs := *args
+		fargs.Forwarded = true
+		if wp.forward("PaxosCollect", &fargs, reply) {
+			return nil
+		}
+	}
+
+	wp.logLock.Lock()
+	defer wp.logLock.Unlock()
+
+	if r, ok := wp.handledRequests[args.RequestID].(PaxosCollectReply); ok {
+		*reply = r
+		return nil
+	}
+
+	op := Op{COLLECT, *args, NRand(), args.RequestID}
+	if err := wp.AgreeAndLogRequests(op); err != nil {
+		reply.Err = ErrPersist
+		return nil
+	}
+
+	r, ok := wp.handledRequests[args.RequestID].(PaxosCollectReply)
+	if !ok {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	*reply = r
+	return nil
+}
+
+// Replace the cluster's members with args.Servers. The change is
+// decided in the log like any other operation, and the reply waits
+// until a majority of the old members has applied it too: until
+// then, old members that are behind could still decide instances
+// among themselves (see paxos/config.go).
+func (wp *WhanauPaxos) PaxosReconfig(args *PaxosReconfigArgs,
+	reply *PaxosReconfigReply) error {
+	if wp.removed() {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	if wp.bft {
+		// pbft's peers are fixed (see pbft/pbft.go).
+		reply.Err = ErrNoReconfig
+		return nil
+	}
+	if !args.Forwarded {
+		fargs := *args
+		fargs.Forwarded = true
+		if wp.forward("PaxosReconfig", &fargs, reply) {
+			return nil
+		}
+	}
+
+	wp.logLock.Lock()
+	defer wp.logLock.Unlock()
+
+	// Have we handled this request already?
+	if reconfig_reply, ok := wp.handledRequests[args.RequestID].(PaxosReconfigReply); ok {
+		reply.From = reconfig_reply.From
+		reply.Err = reconfig_reply.Err
+		return nil
+	}
+
+	old := wp.Servers()
+	op := Op{RECONFIG, *args, NRand(), args.RequestID}
+	if err := wp.AgreeAndLogRequests(op); err != nil {
+		reply.Err = ErrPersist
+		return nil
+	}
+
+	reconfig_reply, ok := wp.handledRequests[args.RequestID].(PaxosReconfigReply)
+	if !ok {
+		reply.Err = ErrWrongGroup
+		return nil
+	}
+	wp.stopOldServers(old, reconfig_reply.From-1)
+
+	reply.From = reconfig_reply.From
+	reply.Err = reconfig_reply.Err
+	return nil
+}
+
+// Wait until a majority of old has applied instance seq. Called
+// with logLock held, after we applied it ourselves.
+func (wp *WhanauPaxos) stopOldServers(old []string, seq int) {
+	applied := make(map[string]bool)
+	applied[wp.myaddr] = true
+	for !wp.dead {
+		n := 0
+		for _, srv := range old {
+			if !applied[srv] {
+				args := &PaxosApplyArgs{seq}
+				var reply PaxosApplyReply
+				ok := call(wp.tr, srv, "WhanauPaxos-"+wp.uid+".PaxosApply",
+					args, &reply)
+				applied[srv] = ok && reply.Err == OK
+			}
+			if applied[srv] {
+				n++
+			}
+		}
+		if n > len(old)/2 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Apply the log up to instance args.Seq, so that this replica knows
+// about the change of members decided there.
+func (wp *WhanauPaxos) PaxosApply(args *PaxosApplyArgs,
+	reply *PaxosApplyReply) error {
+	wp.logLock.Lock()
+	defer wp.logLock.Unlock()
+
+	wp.LogUpdates(wp.currSeq, args.Seq)
+	if err := wp.persist(); err != nil {
+		return err
+	}
+	reply.Err = OK
+	return nil
+}
+
+// Start this server's replica of the Paxos cluster servers, where
+// servers[me] is this server. The replica's Paxos peer is registered
+// on rpcs under a name derived from uid, so its address is simply the
+// server's own address and a cluster can span any set of machines.
+//
+// If dir is not "", the replica keeps a snapshot of its state and
+// its Paxos log there, and a replica started again with the same
+// arguments picks up where it left off.
 func StartWhanauPaxos(servers []string, me int, uid string,
-	rpcs *rpc.Server) *WhanauPaxos {
+	rpcs *rpc.Server, tr transport.Transport, dir string) *WhanauPaxos {
+	return startWhanauPaxos(servers, me, uid, 0, false, rpcs, tr, dir)
+}
 
-	wp := new(WhanauPaxos)
+// Like StartWhanauPaxos, but the replicas agree through PBFT, so the
+// cluster keeps working, and keeps its data, as long as fewer than a
+// third of servers are faulty, whatever those do. Its members cannot
+// be changed.
+func StartWhanauBFT(servers []string, me int, uid string,
+	rpcs *rpc.Server, tr transport.Transport, dir string) *WhanauPaxos {
+	return startWhanauPaxos(servers, me, uid, 0, true, rpcs, tr, dir)
+}
 
-	if rpcs != nil {
-		// caller will create socket &c
-		rpcs.Register(wp)
-	} else {
-		rpcs := rpc.NewServer()
-		rpcs.Register(wp)
+// Start our replica of the key cluster servers, the way the
+// deployment replicates key clusters (see SetReplication).
+func startKeyCluster(servers []string, me int, uid string,
+	rpcs *rpc.Server, tr transport.Transport, dir string) *WhanauPaxos {
+	return startWhanauPaxos(servers, me, uid, 0, replication == Byzantine,
+		rpcs, tr, dir)
+}
+
+// Like StartWhanauPaxos, but for a server that a change of members
+// decided at instance from-1 added to cluster uid. The replica takes
+// no part in the instances before from; it gets their effect from
+// another member's snapshot before it returns.
+func JoinWhanauPaxos(servers []string, me int, uid string, from int,
+	rpcs *rpc.Server, tr transport.Transport, dir string) *WhanauPaxos {
+	return startWhanauPaxos(servers, me, uid, from, false, rpcs, tr, dir)
+}
+
+func startWhanauPaxos(servers []string, me int, uid string, from int,
+	bft bool, rpcs *rpc.Server, tr transport.Transport,
+	dir string) *WhanauPaxos {
+
+	wp := new(WhanauPaxos)
+	if tr == nil {
+		tr = transport.Unix{}
 	}
+	wp.tr = tr
 
-	newservers := make([]string, len(servers))
-	for i, _ := range servers {
-		newservers[i] = port(uid+"-wp", i)
+	// with a nil rpcs the replica listens on servers[me] by itself
+	listen := rpcs == nil
+	if listen {
+		rpcs = rpc.NewServer()
 	}
+	rpcs.RegisterName("WhanauPaxos-"+uid, wp)
+	wp.rpc = rpcs
 
 	wp.handledRequests = make(map[int64]interface{})
-	wp.px = paxos.Make(newservers, me, nil)
 	wp.db = make(map[KeyType]TrueValueType)
-	wp.pending_writes = make(map[PendingInsertsKey]string)
+	wp.pending_writes = make(map[PendingInsertsKey]PendingWrite)
 	wp.currSeq = 0
 	wp.currView = 0
 	wp.me = me
 	wp.myaddr = servers[me]
 	wp.uid = uid
+	wp.servers = servers
+	wp.dir = dir
+	wp.bft = bft
+	wp.checkpoints = make(map[int]wpSnapshot)
 
 	gob.Register(Op{})
 	gob.Register(PaxosGetArgs{})
@@ -292,6 +908,80 @@ func StartWhanauPaxos(servers []string, me int, uid string,
 	gob.Register(PaxosPutReply{})
 	gob.Register(PaxosPendingInsertsArgs{})
 	gob.Register(PaxosPendingInsertsReply{})
+	gob.Register(PaxosReconfigArgs{})
+	gob.Register(PaxosReconfigReply{})
+	gob.Register(PaxosEpochArgs{})
+	gob.Register(PaxosEpochReply{})
+	gob.Register(PaxosHandoffArgs{})
+	gob.Register(PaxosHandoffReply{})
+	gob.Register(PaxosCollectArgs{})
+	gob.Register(PaxosCollectReply{})
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			log.Fatal("WhanauPaxos dir: ", err)
+		}
+		if err := wp.loadSnapshot(); err != nil {
+			log.Fatal("WhanauPaxos snapshot: ", err)
+		}
+	}
+
+	if bft {
+		// pbft keeps only its key on disk; the snapshot has to do
+		// for the rest.
+		wp.px = pbft.MakeService("PBFT-"+uid, servers, me, rpcs, tr, dir)
+		wp.px.Compact(wp.currSeq - 1)
+	} else {
+		px := paxos.MakeService("Paxos-"+uid, servers, me, rpcs, tr, dir)
+		if from > wp.servers_from {
+			wp.servers = servers
+			wp.me = me
+			wp.servers_from = from
+			px.Reconfigure(from, servers)
+			px.Compact(from - 1)
+		} else if wp.servers_from > 0 {
+			// the members the snapshot has, in case Paxos's own log
+			// was compacted before it heard of them.
+			px.Reconfigure(wp.servers_from, wp.servers)
+		}
+		px.EnableLeader()
+		wp.px = px
+	}
+
+	// apply whatever was decided after the snapshot was taken, and
+	// record the cluster so a restarted server can find it again.
+	wp.replayDecided()
+	wp.logLock.Lock()
+	if wp.currSeq < from {
+		wp.catchUp(from - 1)
+	}
+	if err := wp.saveSnapshot(); err != nil {
+		log.Fatal("WhanauPaxos snapshot: ", err)
+	}
+	wp.logLock.Unlock()
+
+	if listen {
+		l, e := tr.Listen(servers[me])
+		if e != nil {
+			log.Fatal("listen error: ", e)
+		}
+		wp.l = l
+
+		go func() {
+			for wp.dead == false {
+				conn, err := wp.l.Accept()
+				if err == nil && wp.dead == false {
+					go rpcs.ServeConn(conn)
+				} else if err == nil {
+					conn.Close()
+				}
+				if err != nil && wp.dead == false {
+					fmt.Printf("WhanauPaxos(%v) accept: %v\n", me, err.Error())
+					wp.Kill()
+				}
+			}
+		}()
+	}
 
 	return wp
 }